@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	auditRelationshipsViewed   = "relationships.viewed"
+	auditRelationshipsRemoved  = "relationships.removed"
+	auditRelationshipsExported = "relationships.exported"
+	auditUserSuspended         = "user.suspended"
+	auditUserUnsuspended       = "user.unsuspended"
+	auditBlocksRemoved         = "blocks.removed"
+
+	defaultAuditLimit = 100
+)
+
+// relationshipRow is a relationship as it is stored, for moderators only
+type relationshipRow struct {
+	ID        int       `json:"id"`
+	Requestor string    `json:"requestor"`
+	Target    string    `json:"target"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// suspension hides a user from the friend lists and the recipients of messages of others
+type suspension struct {
+	Email       string    `json:"email"`
+	Reason      string    `json:"reason"`
+	SuspendedBy string    `json:"suspended_by"`
+	SuspendedAt time.Time `json:"suspended_at"`
+}
+
+type suspendRequest struct {
+	Reason string `json:"reason"`
+}
+
+type unblockRequest struct {
+	Blocks []userRequest `json:"blocks"`
+}
+
+type auditEntry struct {
+	ID        int             `json:"id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Details   json.RawMessage `json:"details"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// audited runs an admin action and its audit entry in one transaction
+func audited(ctx context.Context, action string, details interface{}, fn func(tx *txn) error) error {
+	id, _ := identityOf(ctx)
+	return withTx(ctx, func(tx *txn) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return insertAuditEntry(ctx, tx, id.Email, action, details)
+	})
+}
+
+func listRelationshipRows(ctx context.Context, email string) (rows []relationshipRow, err error) {
+	ctx, span := tracer.Start(ctx, "listRelationshipRows")
+	defer span.End()
+
+	if err = validate(check("email", email, validEmail("invalid user"))); err != nil {
+		return
+	}
+	email = strings.ToLower(email)
+
+	err = audited(ctx, auditRelationshipsViewed, map[string]string{"email": email}, func(tx *txn) error {
+		rows, err = getRelationshipRows(ctx, tx, email)
+		return err
+	})
+	return
+}
+
+// exportRelationshipRows hands every stored relationship to fn in the order they were made
+func exportRelationshipRows(ctx context.Context, fn func(row relationshipRow) error) error {
+	ctx, span := tracer.Start(ctx, "exportRelationshipRows")
+	defer span.End()
+
+	// the export is on record before its first row goes out
+	err := audited(ctx, auditRelationshipsExported, map[string]interface{}{}, func(tx *txn) error { return nil })
+	if err != nil {
+		return err
+	}
+	return eachRelationshipRow(ctx, db, fn)
+}
+
+// removeRelationships deletes every relationship between the two users whatever its status
+func removeRelationships(ctx context.Context, users []string) error {
+	ctx, span := tracer.Start(ctx, "removeRelationships")
+	defer span.End()
+
+	err := validate(check("users", users, each(validEmail("invalid user")), distinct("cannot remove the relationships of a user with oneself")))
+	if err != nil {
+		return err
+	}
+	user1, user2 := strings.ToLower(users[0]), strings.ToLower(users[1])
+
+	return audited(ctx, auditRelationshipsRemoved, map[string][]string{"users": {user1, user2}}, func(tx *txn) error {
+		removed, err := deleteRelationshipsBetween(ctx, tx, user1, user2)
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			return newNotFoundError("relationship_not_found", "users have no relationship")
+		}
+		return nil
+	})
+}
+
+func (s *suspension) suspend(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "suspension.suspend")
+	defer span.End()
+
+	err := validate(
+		check("email", s.Email, validEmail("invalid user")),
+		check("reason", s.Reason, required("no reason was provided")),
+	)
+	if err != nil {
+		return err
+	}
+	id, _ := identityOf(ctx)
+	s.Email, s.SuspendedBy, s.SuspendedAt = strings.ToLower(s.Email), id.Email, time.Now()
+
+	return audited(ctx, auditUserSuspended, map[string]string{"email": s.Email, "reason": s.Reason}, func(tx *txn) error {
+		return insertSuspension(ctx, tx, *s)
+	})
+}
+
+func unsuspend(ctx context.Context, email string) error {
+	ctx, span := tracer.Start(ctx, "unsuspend")
+	defer span.End()
+
+	if err := validate(check("email", email, validEmail("invalid user"))); err != nil {
+		return err
+	}
+	email = strings.ToLower(email)
+
+	return audited(ctx, auditUserUnsuspended, map[string]string{"email": email}, func(tx *txn) error {
+		return deleteSuspension(ctx, tx, email)
+	})
+}
+
+// unblock lifts every given block along with the friendship the block broke
+func (u unblockRequest) unblock(ctx context.Context) (removed int, err error) {
+	ctx, span := tracer.Start(ctx, "unblockRequest.unblock")
+	defer span.End()
+
+	checks := []fieldCheck{
+		check("blocks", u.Blocks,
+			required("no blocks were provided"),
+			atMost(maxBatchSize, fmt.Sprintf("at most %v blocks are lifted at once", maxBatchSize)),
+		),
+	}
+	for i, block := range u.Blocks {
+		checks = append(checks,
+			check(fmt.Sprintf("blocks.%v.requestor", i), block.Requestor, validEmail("invalid user")),
+			check(fmt.Sprintf("blocks.%v.target", i), block.Target, validEmail("invalid user")),
+		)
+	}
+	if err = validate(checks...); err != nil {
+		return
+	}
+
+	pairs := [][]string{}
+	for _, block := range u.Blocks {
+		pairs = append(pairs, []string{strings.ToLower(block.Requestor), strings.ToLower(block.Target)})
+	}
+	err = audited(ctx, auditBlocksRemoved, map[string][][]string{"blocks": pairs}, func(tx *txn) error {
+		for _, pair := range pairs {
+			affected, err := deleteBlock(ctx, tx, pair[0], pair[1])
+			if err != nil {
+				return err
+			}
+			removed += affected
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func insertAuditEntry(ctx context.Context, q execer, actor, action string, details interface{}) error {
+	ctx, done := measureQuery(ctx, "insert_audit_entry")
+	defer done()
+	payload, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	insertQuery := `
+		INSERT INTO admin_audit_log (actor, action, details, created_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	if _, err := q.ExecContext(ctx, insertQuery, actor, action, payload, time.Now()); err != nil {
+		return fmt.Errorf("failed to audit %v by %v err %w", action, actor, err)
+	}
+	return nil
+}
+
+// getAuditLog lists the latest entries first, it pages through the index on created_at and id
+func getAuditLog(ctx context.Context, limit int) (entries []auditEntry, err error) {
+	ctx, done := measureQuery(ctx, "get_audit_log")
+	defer done()
+	query := `SELECT id, actor, action, details, created_at FROM admin_audit_log ORDER BY created_at DESC, id DESC LIMIT $1`
+
+	rows, err := db.QueryContext(ctx, query, limit)
+	if err != nil {
+		err = fmt.Errorf("failed to list the audit log err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := auditEntry{}
+		if err = rows.Scan(&row.ID, &row.Actor, &row.Action, &row.Details, &row.CreatedAt); err != nil {
+			return
+		}
+		entries = append(entries, row)
+	}
+	return entries, rows.Err()
+}
+
+func getRelationshipRows(ctx context.Context, q querier, email string) (relationships []relationshipRow, err error) {
+	ctx, done := measureQuery(ctx, "get_relationship_rows")
+	defer done()
+	query := `
+		SELECT id, requestor, target, status, created_at, updated_at FROM relationships
+		WHERE requestor = $1 OR target = $1
+		ORDER BY id
+	`
+
+	rows, err := q.QueryContext(ctx, query, email)
+	if err != nil {
+		err = fmt.Errorf("failed to list the relationships of %v err %w", email, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := relationshipRow{}
+		if err = rows.Scan(&row.ID, &row.Requestor, &row.Target, &row.Status, &row.CreatedAt, &row.UpdatedAt); err != nil {
+			return
+		}
+		relationships = append(relationships, row)
+	}
+	return relationships, rows.Err()
+}
+
+// exportFetchSize is the most rows an export holds in memory at once
+const exportFetchSize = 1000
+
+// eachRelationshipRow hands every relationship to fn ordered by id, a page at a time
+func eachRelationshipRow(ctx context.Context, q querier, fn func(row relationshipRow) error) error {
+	ctx, done := measureQuery(ctx, "each_relationship_row")
+	defer done()
+	after := 0
+	for {
+		fetched, err := fetchRelationshipRows(ctx, q, after, func(row relationshipRow) error {
+			after = row.ID
+			return fn(row)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export the relationships err %w", err)
+		}
+		if fetched < exportFetchSize {
+			return nil
+		}
+	}
+}
+
+// fetchRelationshipRows hands the page of rows after the given id to fn and tells how many there were
+func fetchRelationshipRows(ctx context.Context, q querier, after int, fn func(row relationshipRow) error) (fetched int, err error) {
+	pageQuery := `
+		SELECT id, requestor, target, status, created_at, updated_at FROM relationships
+		WHERE id > $1 ORDER BY id LIMIT $2
+	`
+	rows, err := q.QueryContext(ctx, pageQuery, after, exportFetchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := relationshipRow{}
+		if err := rows.Scan(&row.ID, &row.Requestor, &row.Target, &row.Status, &row.CreatedAt, &row.UpdatedAt); err != nil {
+			return fetched, err
+		}
+		fetched++
+		if err := fn(row); err != nil {
+			return fetched, err
+		}
+	}
+	return fetched, rows.Err()
+}
+
+func deleteRelationshipsBetween(ctx context.Context, q execer, user1, user2 string) (int, error) {
+	ctx, done := measureQuery(ctx, "delete_relationships_between")
+	defer done()
+	deleteQuery := `
+		DELETE FROM relationships
+		WHERE (requestor = $1 AND target = $2) OR (requestor = $2 AND target = $1)
+	`
+	result, err := q.ExecContext(ctx, deleteQuery, user1, user2)
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove the relationships of %v and %v err %w", user1, user2, err)
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
+
+func deleteBlock(ctx context.Context, q execer, requestor, target string) (int, error) {
+	ctx, done := measureQuery(ctx, "delete_block")
+	defer done()
+	result, err := q.ExecContext(ctx, `DELETE FROM relationships WHERE requestor = $1 AND target = $2 AND status = $3`, requestor, target, relationshipIsBlocked)
+	if err != nil {
+		return 0, fmt.Errorf("failed to unblock %v for %v err %w", target, requestor, err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return int(affected), err
+	}
+
+	// blocking a friend only converts its own row, the reverse friend row is stale
+	_, err = q.ExecContext(ctx, `DELETE FROM relationships WHERE requestor = $1 AND target = $2 AND status = $3`, target, requestor, relationshipIsFriend)
+	if err != nil {
+		return 0, fmt.Errorf("failed to drop the friendship of %v and %v err %w", requestor, target, err)
+	}
+	return int(affected), nil
+}
+
+func insertSuspension(ctx context.Context, q execer, s suspension) error {
+	ctx, done := measureQuery(ctx, "insert_suspension")
+	defer done()
+	insertQuery := `
+		INSERT INTO suspended_users (email, reason, suspended_by, suspended_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (email) DO NOTHING
+	`
+	result, err := q.ExecContext(ctx, insertQuery, s.Email, s.Reason, s.SuspendedBy, s.SuspendedAt)
+	if err != nil {
+		return fmt.Errorf("failed to suspend %v err %w", s.Email, err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return newConflictError("already_suspended", "user is already suspended", fieldError{"email", s.Email})
+	}
+	return nil
+}
+
+func deleteSuspension(ctx context.Context, q execer, email string) error {
+	ctx, done := measureQuery(ctx, "delete_suspension")
+	defer done()
+	result, err := q.ExecContext(ctx, `DELETE FROM suspended_users WHERE email = $1`, email)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return newNotFoundError("suspension_not_found", "user is not suspended")
+	}
+	return nil
+}
+
+// withoutSuspendedUsers keeps the users who are not suspended, in the order they were given
+func withoutSuspendedUsers(ctx context.Context, users []string) (active []string, err error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	ctx, done := measureQuery(ctx, "without_suspended_users")
+	defer done()
+	query := `
+		SELECT users.email FROM unnest($1::varchar[]) WITH ORDINALITY AS users(email, i)
+		WHERE NOT EXISTS (SELECT 1 FROM suspended_users WHERE suspended_users.email = users.email)
+		ORDER BY users.i
+	`
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(users))
+	if err != nil {
+		err = fmt.Errorf("failed to leave out suspended users err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return
+		}
+		active = append(active, email)
+	}
+	return active, rows.Err()
+}
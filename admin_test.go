@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestUnblockLetsFriendsBefriendAgain(t *testing.T) {
+	needsDB(t)
+
+	andy, john := "unblock-andy@example.com", "unblock-john@example.com"
+	ctx := withIdentity(context.Background(), identity{Email: "unblock-admin@example.com", Scopes: []string{scopeAdmin}})
+	defer func() {
+		db.Exec("DELETE FROM relationships WHERE requestor IN ($1, $2)", andy, john)
+		db.Exec("DELETE FROM outbox WHERE pair_key = $1", pairKey(andy, john))
+		db.Exec("DELETE FROM admin_audit_log WHERE actor = $1", "unblock-admin@example.com")
+	}()
+
+	friends := &user{Friends: []string{andy, john}}
+	if err := friends.createFriends(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := (userRequest{Requestor: andy, Target: john}).blockUpdates(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := (unblockRequest{Blocks: []userRequest{{Requestor: andy, Target: john}}}).unblock(ctx); err != nil || removed != 1 {
+		t.Fatalf("expected the block to be lifted, have %v %v", removed, err)
+	}
+
+	if err := friends.createFriends(ctx, db); err != nil {
+		t.Errorf("expected the users to befriend again, have %v", err)
+	}
+}
@@ -1,23 +1,169 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
-	port := ":3000"
-	if os.Getenv("GO_ENV") == "test" {
-		port = ":3001"
+	c, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("failed to load the config", err)
+	}
+	logLevel.Set(c.LogLevel)
+	slog.Info("starting", "config", c)
+
+	if db, err = connectDB(c.Database); err != nil {
+		fatal("failed to connect to the database", err)
+	}
+	registerDBMetrics(db)
+
+	tracerProvider, err := setupTracing(c.Tracing)
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+
+	idempotencyKeyTTL = c.IdempotencyKeyTTL
+	queryTimeout = c.Database.QueryTimeout
+	// the route timeouts were validated with the rest of the config
+	routeQueryTimeouts, _ = parseRouteTimeouts(c.Database.RouteQueryTimeouts)
+	jwtSecret = []byte(c.Auth.JWTSecret)
+	// the proxies were validated with the rest of the config
+	trustedProxies, _ = parseTrustedProxies(c.HTTP.TrustedProxies)
+	// the limits were validated with the rest of the config
+	rateLimits[rateLimitRead], _ = parseRateLimit(c.RateLimit.Read)
+	rateLimits[rateLimitWrite], _ = parseRateLimit(c.RateLimit.Write)
+	rateLimitStore, err := newRateLimitStore(c.RateLimit.Store)
+	if err != nil {
+		fatal("failed to create the rate limit store", err)
+	}
+
+	// the admin API key lets an operator in to issue the first keys through /api/keys
+	if c.Auth.AdminAPIKey != "" {
+		if err := ensureAPIKey(context.Background(), c.Auth.AdminEmail, hashAPIKey(c.Auth.AdminAPIKey), []string{scopeAdmin}); err != nil {
+			fatal("failed to store the admin api key", err)
+		}
+	}
+
+	startIdempotencyKeyPurge()
+	if c.Features.Webhooks {
+		startWebhookWorker()
+	}
+	if c.Features.Outbox {
+		outboxPublisher, err := newOutboxPublisher(c.Outbox)
+		if err != nil {
+			fatal("failed to create the outbox publisher", err)
+		}
+		startOutboxRelay(outboxPublisher)
+	}
+	if c.Features.Digests {
+		digestNotifier, err := newDigestNotifier(c.Digest)
+		if err != nil {
+			fatal("failed to create the digest notifier", err)
+		}
+		startDigestScheduler(digestNotifier)
+	}
+
+	var grpcServer *grpc.Server
+	if c.Features.GRPC {
+		options := []grpc.ServerOption{}
+		if c.TLS.enabled() {
+			creds, err := credentials.NewServerTLSFromFile(c.TLS.CertFile, c.TLS.KeyFile)
+			if err != nil {
+				fatal("failed to load the tls certificate", err)
+			}
+			options = append(options, grpc.Creds(creds))
+		}
+		grpcServer = newGRPCServer(rateLimitStore, options...)
+		startGRPCServer(grpcServer, c.GRPC.Addr)
 	}
 
+	handler := http.Handler(router)
+	if !c.Features.GraphQL {
+		handler = withoutPaths(handler, "/graphql")
+	}
 	server := &http.Server{
-		Addr:    port,
-		Handler: router,
+		Addr:              c.HTTP.Addr,
+		Handler:           traceRequests(logRequests(measureRequests(limitQueryTime(limitRate(rateLimitStore, rateLimitByIP)(authenticate(limitRate(rateLimitStore, rateLimitByUser)(handler))))))),
+		ReadTimeout:       c.HTTP.ReadTimeout,
+		ReadHeaderTimeout: c.HTTP.ReadHeaderTimeout,
+		WriteTimeout:      c.HTTP.WriteTimeout,
+		IdleTimeout:       c.HTTP.IdleTimeout,
+	}
+
+	go func() {
+		var err error
+		if c.TLS.enabled() {
+			err = server.ListenAndServeTLS(c.TLS.CertFile, c.TLS.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fatal("http server failed", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	slog.Info("shutting down", "signal", (<-signals).String())
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.HTTP.ShutdownTimeout)
+	defer cancel()
+	shutdown(ctx, server, grpcServer, tracerProvider)
+}
+
+// withoutPaths answers the paths of a disabled feature as if they did not exist
+func withoutPaths(h http.Handler, paths ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range paths {
+			if r.URL.Path == path {
+				router.NotFound.ServeHTTP(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// shutdown stops taking requests, waits for the in-flight ones and the background runs
+// until ctx is done and then closes the database and flushes the spans
+func shutdown(ctx context.Context, server *http.Server, grpcServer *grpc.Server, tracerProvider *sdktrace.TracerProvider) {
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("failed to drain http connections", "err", err)
 	}
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			slog.Error("failed to drain grpc calls in time")
+			grpcServer.Stop()
+		}
+	}
+
+	if err := workers.shutdown(ctx); err != nil {
+		slog.Error("failed to stop background workers", "err", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("failed to close the database", "err", err)
+	}
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			slog.Error("failed to flush spans", "err", err)
+		}
 	}
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	apiKeyHeader   = "X-API-Key"
+	scopeAdmin     = "admin"
+	scopeModerator = "moderator"
+)
+
+// publicPaths are served without credentials
+var publicPaths = map[string]bool{
+	"/api/openapi.json": true,
+	"/api/docs":         true,
+	"/healthz":          true,
+	"/readyz":           true,
+}
+
+// jwtSecret verifies the HS256 bearer tokens, bearer tokens are refused while it is empty
+var jwtSecret []byte
+
+// identity is the authenticated caller, Email is the user the caller may act as
+type identity struct {
+	Email  string
+	Scopes []string
+}
+
+type identityKey struct{}
+
+func (id identity) hasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func withIdentity(ctx context.Context, id identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func identityOf(ctx context.Context) (identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(identity)
+	return id, ok
+}
+
+// authenticate requires an API key or a bearer JWT on every request but the public ones
+// and attaches the identity of the caller to the request context
+func authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if bearer == r.Header.Get("Authorization") {
+			bearer = ""
+		}
+		id, err := authenticateCredentials(r.Context(), r.Header.Get(apiKeyHeader), bearer)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, err)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(withCaller(withIdentity(r.Context(), id), id.Email)))
+	})
+}
+
+// authenticateCredentials resolves an API key or a bearer JWT into the identity of the caller
+func authenticateCredentials(ctx context.Context, apiKey, bearer string) (identity, error) {
+	switch {
+	case apiKey != "":
+		return getAPIKeyIdentity(ctx, hashAPIKey(apiKey))
+	case bearer != "":
+		return parseJWT(bearer)
+	default:
+		return identity{}, newUnauthorizedError("no credentials were provided")
+	}
+}
+
+// jwtClaims carry the user in sub and space separated scopes in scope
+type jwtClaims struct {
+	Scope string `json:"scope"`
+	jwt.RegisteredClaims
+}
+
+func parseJWT(token string) (identity, error) {
+	if len(jwtSecret) == 0 {
+		return identity{}, newUnauthorizedError("bearer tokens are not accepted")
+	}
+
+	claims := &jwtClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || !isEmailValid(claims.Subject) {
+		return identity{}, newUnauthorizedError("invalid bearer token")
+	}
+	return identity{Email: strings.ToLower(claims.Subject), Scopes: strings.Fields(claims.Scope)}, nil
+}
+
+// authorize lets the caller act as the given user only if it is that user or an admin,
+// an empty user is left for validation to report
+func authorize(ctx context.Context, email string) error {
+	id, _ := identityOf(ctx)
+	if email == "" || id.hasScope(scopeAdmin) || strings.EqualFold(id.Email, email) {
+		return nil
+	}
+	return newForbiddenError("cannot act on behalf of " + email)
+}
+
+// authorizeAny lets the caller read what the users share if it is one of them or an admin
+func authorizeAny(ctx context.Context, emails ...string) error {
+	var err error
+	for _, email := range emails {
+		if err = authorize(ctx, email); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+var (
+	adminOnly     = requireScope(scopeAdmin)
+	moderatorOnly = requireScope(scopeAdmin, scopeModerator)
+)
+
+// requireScope refuses callers that have none of the scopes, scopes double as roles
+func requireScope(scopes ...string) func(httprouter.Handle) httprouter.Handle {
+	return func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			id, _ := identityOf(r.Context())
+			for _, scope := range scopes {
+				if id.hasScope(scope) {
+					h(w, r, ps)
+					return
+				}
+			}
+			writeError(w, newForbiddenError("requires the "+strings.Join(scopes, " or ")+" scope"))
+		}
+	}
+}
+
+// apiKey is only returned in full when it is created, the database keeps its hash
+type apiKey struct {
+	ID     int      `json:"id"`
+	Key    string   `json:"key,omitempty"`
+	Email  string   `json:"email"`
+	Scopes []string `json:"scopes"`
+}
+
+type apiKeyRequest struct {
+	Email  string   `json:"email"`
+	Scopes []string `json:"scopes"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *apiKey) create(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "apiKey.create")
+	defer span.End()
+
+	err := validate(
+		check("email", k.Email, validEmail("invalid user")),
+		check("scopes", k.Scopes, each(oneOf("unknown scope", scopeAdmin, scopeModerator))),
+	)
+	if err != nil {
+		return err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	k.Key = hex.EncodeToString(secret)
+	k.Email = strings.ToLower(k.Email)
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+	k.ID, err = createAPIKey(ctx, k.Email, hashAPIKey(k.Key), k.Scopes)
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func createAPIKey(ctx context.Context, email, hash string, scopes []string) (id int, err error) {
+	ctx, done := measureQuery(ctx, "create_api_key")
+	defer done()
+	insertQuery := `
+		INSERT INTO api_keys (email, key_hash, scopes, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+	err = db.QueryRowContext(ctx, insertQuery, email, hash, pq.Array(scopes), time.Now()).Scan(&id)
+	return
+}
+
+// ensureAPIKey stores a key given by the operator, it keeps an existing key with the same hash
+func ensureAPIKey(ctx context.Context, email, hash string, scopes []string) error {
+	ctx, done := measureQuery(ctx, "ensure_api_key")
+	defer done()
+	insertQuery := `
+		INSERT INTO api_keys (email, key_hash, scopes, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (key_hash) DO NOTHING
+	`
+	if _, err := db.ExecContext(ctx, insertQuery, email, hash, pq.Array(scopes), time.Now()); err != nil {
+		return fmt.Errorf("failed to store the api key of %v err %w", email, err)
+	}
+	return nil
+}
+
+// getAPIKeyIdentity looks up the key by its hash, revoked keys are unknown
+func getAPIKeyIdentity(ctx context.Context, hash string) (id identity, err error) {
+	ctx, done := measureQuery(ctx, "get_api_key_identity")
+	defer done()
+	query := `SELECT email, scopes FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL`
+
+	err = db.QueryRowContext(ctx, query, hash).Scan(&id.Email, pq.Array(&id.Scopes))
+	if err == sql.ErrNoRows {
+		err = newUnauthorizedError("invalid api key")
+	} else if err != nil {
+		err = fmt.Errorf("failed to look up the api key err %w", err)
+	}
+	return
+}
+
+func revokeAPIKey(ctx context.Context, id int) error {
+	ctx, done := measureQuery(ctx, "revoke_api_key")
+	defer done()
+	result, err := db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return newNotFoundError("api_key_not_found", "api key does not exist")
+	}
+	return nil
+}
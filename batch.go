@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	batchIsTransactional = "transactional"
+	batchIsBestEffort    = "best_effort"
+
+	batchFriend    = "friend"
+	batchUnfriend  = "unfriend"
+	batchSubscribe = "subscribe"
+	batchBlock     = "block"
+)
+
+// maxBatchSize keeps a single transactional batch from holding its locks for too long
+var maxBatchSize = 1000
+
+// batch applies many relationship changes in one request, a transactional batch is committed only
+// if every operation succeeds while a best effort batch keeps whatever succeeded
+type batch struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+type batchOperation struct {
+	Action    string `json:"action"`
+	Requestor string `json:"requestor"`
+	Target    string `json:"target"`
+}
+
+type batchResult struct {
+	Index      int    `json:"index"`
+	Action     string `json:"action"`
+	RolledBack bool   `json:"rolled_back,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"`
+	responseStatus
+}
+
+func (b batch) run(ctx context.Context) (results []batchResult, err error) {
+	ctx, span := tracer.Start(ctx, "batch.run")
+	defer span.End()
+
+	err = validate(
+		check("operations", b.Operations,
+			required("no operations were provided"),
+			atMost(maxBatchSize, fmt.Sprintf("a batch holds at most %v operations", maxBatchSize)),
+		),
+		check("mode", b.Mode, oneOf("mode must be either transactional or best_effort", "", batchIsTransactional, batchIsBestEffort)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Mode == batchIsBestEffort {
+		for i, op := range b.Operations {
+			results = append(results, newBatchResult(i, op, op.run(ctx, db)))
+		}
+		return results, nil
+	}
+	return b.runTransactional(ctx)
+}
+
+// runTransactional stops at the first failed operation, rolls back the ones before it and skips
+// the ones after it, so every operation has a result
+func (b batch) runTransactional(ctx context.Context) (results []batchResult, err error) {
+	err = withTx(ctx, func(tx *txn) error {
+		for i, op := range b.Operations {
+			opErr := op.run(ctx, tx)
+			results = append(results, newBatchResult(i, op, opErr))
+			if opErr != nil {
+				apiErr := toAPIError(opErr)
+				return &apiError{
+					Kind:    apiErr.Kind,
+					Code:    apiErr.Code,
+					Message: fmt.Sprintf("operation %v failed, %v", i, apiErr.Message),
+					Details: apiErr.Details,
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		for i := range results {
+			results[i].RolledBack = results[i].Success
+		}
+		for i := len(results); i < len(b.Operations); i++ {
+			results = append(results, batchResult{Index: i, Action: b.Operations[i].Action, Skipped: true})
+		}
+	}
+	return
+}
+
+func (o batchOperation) run(ctx context.Context, q querier) error {
+	switch o.Action {
+	case batchFriend:
+		return (&user{Friends: []string{o.Requestor, o.Target}}).createFriends(ctx, q)
+	case batchUnfriend:
+		return (&user{Friends: []string{o.Requestor, o.Target}}).unfriend(ctx, q)
+	case batchSubscribe:
+		return userRequest{Requestor: o.Requestor, Target: o.Target}.subscribeUpdates(ctx, q)
+	case batchBlock:
+		return userRequest{Requestor: o.Requestor, Target: o.Target}.blockUpdates(ctx, q)
+	default:
+		return newValidationError("action", "action must be one of friend, unfriend, subscribe or block")
+	}
+}
+
+func newBatchResult(index int, op batchOperation, err error) batchResult {
+	result := batchResult{Index: index, Action: op.Action}
+	result.setError(err)
+	return result
+}
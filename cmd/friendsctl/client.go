@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// client calls the HTTP API of the server with the API key of the operator
+type client struct {
+	api    string
+	apiKey string
+	http   *http.Client
+}
+
+// apiResponse holds the fields of the API responses friendsctl reads
+type apiResponse struct {
+	Success       bool           `json:"success"`
+	Friends       []string       `json:"friends"`
+	Count         int            `json:"count"`
+	NextCursor    string         `json:"next_cursor"`
+	Relationships []relationship `json:"relationships"`
+	Results       []batchResult  `json:"results"`
+}
+
+// relationship is a stored relationship as the admin API and the export list it
+type relationship struct {
+	ID        int    `json:"id,omitempty"`
+	Requestor string `json:"requestor"`
+	Target    string `json:"target"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"created_at,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+// userPair is a block the unblock API lifts
+type userPair struct {
+	Requestor string `json:"requestor"`
+	Target    string `json:"target"`
+}
+
+// exportTrailer is the last line of an export
+type exportTrailer struct {
+	End   bool   `json:"end"`
+	Count int    `json:"count"`
+	Error string `json:"error"`
+}
+
+type batchOperation struct {
+	Action    string `json:"action"`
+	Requestor string `json:"requestor"`
+	Target    string `json:"target"`
+}
+
+type batchResult struct {
+	Index   int    `json:"index"`
+	Action  string `json:"action"`
+	Success bool   `json:"success"`
+	Errors  string `json:"errors"`
+	Code    string `json:"code"`
+}
+
+// apiError is a failed request, Code is the error code of the API when it answered with one
+type apiError struct {
+	Status  int    `json:"-"`
+	Message string `json:"errors"`
+	Code    string `json:"code"`
+}
+
+func (e *apiError) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%v (%v)", e.Message, e.Code)
+}
+
+// do sends body as JSON and decodes the response into out when it is not nil
+func (c *client) do(method, path string, query url.Values, body, out interface{}) error {
+	res, err := c.send(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to read the response of %v %v err %v", method, path, err)
+	}
+	return nil
+}
+
+// send returns the response of a successful request, the caller closes its body
+func (c *client) send(method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	target := strings.TrimRight(c.api, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		defer res.Body.Close()
+		return nil, readAPIError(res)
+	}
+	return res, nil
+}
+
+func readAPIError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(res.Body)
+	apiErr := &apiError{Status: res.StatusCode}
+	if json.Unmarshal(body, apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = res.Status
+	}
+	return apiErr
+}
+
+// userPath is the path of a user in the v2 API, e.g. /api/v2/users/andy%40example.com/friends
+func userPath(email string, rest ...string) string {
+	path := "/api/v2/users/" + url.PathEscape(email)
+	for _, segment := range rest {
+		path += "/" + url.PathEscape(segment)
+	}
+	return path
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+)
+
+// importBatchSize is the most operations the batch API takes at once
+const importBatchSize = 1000
+
+func addFriends(c *ctl, args []string) error {
+	if err := c.client.do("POST", userPath(args[0], "friends", args[1]), nil, nil, nil); err != nil {
+		return err
+	}
+	return c.printDone()
+}
+
+// removeFriends goes through the batch API, the only route that unfriends two users
+func removeFriends(c *ctl, args []string) error {
+	res := apiResponse{}
+	err := c.client.do("POST", "/api/batch", nil, map[string]interface{}{
+		"mode":       "transactional",
+		"operations": []batchOperation{{Action: "unfriend", Requestor: args[0], Target: args[1]}},
+	}, &res)
+	if err != nil {
+		return err
+	}
+	if len(res.Results) == 1 && !res.Results[0].Success {
+		return &apiError{Message: res.Results[0].Errors, Code: res.Results[0].Code}
+	}
+	return c.printDone()
+}
+
+func subscribe(c *ctl, args []string) error {
+	if err := c.client.do("POST", userPath(args[0], "subscriptions", args[1]), nil, nil, nil); err != nil {
+		return err
+	}
+	return c.printDone()
+}
+
+func block(c *ctl, args []string) error {
+	if err := c.client.do("POST", userPath(args[0], "blocks", args[1]), nil, nil, nil); err != nil {
+		return err
+	}
+	return c.printDone()
+}
+
+func unblock(c *ctl, args []string) error {
+	body := map[string]interface{}{"blocks": []userPair{{Requestor: args[0], Target: args[1]}}}
+	if err := c.client.do("POST", "/api/admin/unblocks", nil, body, nil); err != nil {
+		return err
+	}
+	return c.printDone()
+}
+
+// listFriends lists a friend once the friendship is stored in both directions, as the server does
+func listFriends(c *ctl, args []string) error {
+	oneWay := map[string]bool{}
+	return c.listRelated(args[0], "friends", func(email string, r relationship) (string, bool) {
+		if r.Status != "friend" || (r.Requestor != email && r.Target != email) {
+			return "", false
+		}
+		other := r.Target
+		if other == email {
+			other = r.Requestor
+		}
+		if oneWay[other] {
+			return other, true
+		}
+		oneWay[other] = true
+		return "", false
+	})
+}
+
+func listFollowers(c *ctl, args []string) error {
+	return c.listRelated(args[0], "followers", func(email string, r relationship) (string, bool) {
+		return r.Requestor, r.Target == email && r.Status == "subscribed"
+	})
+}
+
+func listBlocked(c *ctl, args []string) error {
+	return c.listRelated(args[0], "blocked", func(email string, r relationship) (string, bool) {
+		return r.Target, r.Requestor == email && r.Status == "blocked"
+	})
+}
+
+// listRelated reads the stored rows of a user from the admin API, unlike the public lists
+// they include suspended users and every kind of relationship. Emails are stored in lower
+// case so the user is matched in lower case
+func (c *ctl) listRelated(email, key string, match func(email string, r relationship) (string, bool)) error {
+	email = strings.ToLower(email)
+	res := apiResponse{}
+	if err := c.client.do("GET", "/api/admin/relationships", url.Values{"email": {email}}, nil, &res); err != nil {
+		return err
+	}
+	emails := []string{}
+	for _, row := range res.Relationships {
+		if other, ok := match(email, row); ok {
+			emails = append(emails, other)
+		}
+	}
+	return c.printEmails(key, emails)
+}
+
+// commonFriends follows the cursors of the v2 API until the last page
+func commonFriends(c *ctl, args []string) error {
+	emails := []string{}
+	query := url.Values{"limit": {"1000"}}
+	for {
+		res := apiResponse{}
+		err := c.client.do("GET", userPath(args[0], "common", args[1]), query, nil, &res)
+		if apiErr, ok := err.(*apiError); ok && apiErr.Code == "no_common_friends" {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		emails = append(emails, res.Friends...)
+		if res.NextCursor == "" {
+			break
+		}
+		query.Set("cursor", res.NextCursor)
+	}
+	return c.printEmails("friends", emails)
+}
+
+func previewRecipients(c *ctl, args []string) error {
+	preview := struct {
+		Recipients []string `json:"recipients"`
+		Mentioned  []string `json:"mentioned"`
+		Blocked    []string `json:"blocked"`
+	}{}
+	body := map[string]string{"sender": args[0], "text": args[1]}
+	if err := c.client.do("POST", "/api/messages/preview", nil, body, &preview); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return c.printJSON(preview)
+	}
+	rows := [][]string{}
+	for _, group := range []struct {
+		status string
+		emails []string
+	}{{"recipient", preview.Recipients}, {"mentioned", preview.Mentioned}, {"blocked", preview.Blocked}} {
+		for _, email := range group.emails {
+			rows = append(rows, []string{email, group.status})
+		}
+	}
+	return c.printTable([]string{"email", "status"}, rows)
+}
+
+// migrate runs the migrate binary the server is deployed with on the migrations directory.
+// migrate takes a database URL, not the key=value DATABASE_DSN of the server, so it has its
+// own FRIENDSCTL_DATABASE_URL
+func migrate(c *ctl, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	path := flags.String("path", "./migrations", "directory of the migrations")
+	database := flags.String("database", envOr("FRIENDSCTL_DATABASE_URL", "postgres://postgres@localhost:5433/friends_management?sslmode=disable"), "database URL")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("missing the migrate command, e.g. up")
+	}
+
+	cmd := exec.Command("migrate", append([]string{"-path", *path, "-database", *database}, flags.Args()...)...)
+	cmd.Stdin = c.stdin
+	cmd.Stdout = c.stdout
+	cmd.Stderr = c.stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run migrate err %v", err)
+	}
+	return nil
+}
+
+// exportRelationships writes the rows of the export without its trailer and fails when the
+// trailer is missing, carries an error or counts other rows than were written
+func exportRelationships(c *ctl, args []string) error {
+	// the whole export may take longer than -timeout
+	streaming := *c.client
+	streaming.http = &http.Client{Transport: c.client.http.Transport}
+	res, err := streaming.send("GET", "/api/admin/relationships/export", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	out := c.stdout
+	if len(args) == 1 {
+		file, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	written, trailer, err := copyExport(out, res.Body)
+	switch {
+	case err != nil:
+		return err
+	case trailer == nil:
+		return fmt.Errorf("export was cut short after %v rows", written)
+	case trailer.Error != "":
+		return fmt.Errorf("export failed after %v rows: %v", written, trailer.Error)
+	case trailer.Count != written:
+		return fmt.Errorf("export wrote %v rows but the server sent %v", written, trailer.Count)
+	}
+	return nil
+}
+
+// copyExport copies the rows of an export to out until its trailer, the trailer is nil when
+// the export ended without one
+func copyExport(out io.Writer, export io.Reader) (written int, trailer *exportTrailer, err error) {
+	reader := bufio.NewReader(export)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			end := exportTrailer{}
+			if json.Unmarshal(line, &end) == nil && end.End {
+				return written, &end, nil
+			}
+			if _, err := out.Write(line); err != nil {
+				return written, nil, fmt.Errorf("failed to write the export err %v", err)
+			}
+			written++
+		}
+		if readErr == io.EOF {
+			return written, nil, nil
+		}
+		if readErr != nil {
+			return written, nil, fmt.Errorf("failed to read the export err %v", readErr)
+		}
+	}
+}
+
+// importRelationships stores the rows of an export in best effort batches, a row that
+// fails, e.g. a friendship of a user who blocked the other, is counted and reported
+func importRelationships(c *ctl, args []string) error {
+	in := c.stdin
+	if len(args) == 1 {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	operations, err := readOperations(in)
+	if err != nil {
+		return err
+	}
+
+	imported, failed := 0, 0
+	for start := 0; start < len(operations); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(operations) {
+			end = len(operations)
+		}
+		res := apiResponse{}
+		err := c.client.do("POST", "/api/batch", nil, map[string]interface{}{
+			"mode":       "best_effort",
+			"operations": operations[start:end],
+		}, &res)
+		if err != nil {
+			return fmt.Errorf("failed to import rows %v to %v err %v", start+1, end, err)
+		}
+		for _, result := range res.Results {
+			if result.Success {
+				imported++
+				continue
+			}
+			failed++
+			op := operations[start+result.Index]
+			fmt.Fprintf(c.stderr, "%v %v %v: %v\n", op.Action, op.Requestor, op.Target, result.Errors)
+		}
+	}
+
+	if c.output == "json" {
+		return c.printJSON(map[string]int{"imported": imported, "failed": failed})
+	}
+	return c.printTable([]string{"imported", "failed"}, [][]string{{fmt.Sprint(imported), fmt.Sprint(failed)}})
+}
+
+// readOperations turns the rows of an export into batch operations, a friendship is stored
+// as two rows and imported once
+func readOperations(in io.Reader) ([]batchOperation, error) {
+	actions := map[string]string{"friend": "friend", "subscribed": "subscribe", "blocked": "block"}
+	operations := []batchOperation{}
+	friends := map[[2]string]bool{}
+
+	scanner := bufio.NewScanner(in)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		row := relationship{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, fmt.Errorf("line %v is not a relationship err %v", line, err)
+		}
+		action, ok := actions[row.Status]
+		if !ok {
+			return nil, fmt.Errorf("line %v has an unknown status %q", line, row.Status)
+		}
+		if action == "friend" {
+			pair := [2]string{row.Requestor, row.Target}
+			if pair[0] > pair[1] {
+				pair[0], pair[1] = pair[1], pair[0]
+			}
+			if friends[pair] {
+				continue
+			}
+			friends[pair] = true
+		}
+		operations = append(operations, batchOperation{Action: action, Requestor: row.Requestor, Target: row.Target})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the import err %v", err)
+	}
+	return operations, nil
+}
+
+func (c *ctl) printDone() error {
+	if c.output == "json" {
+		return c.printJSON(map[string]bool{"success": true})
+	}
+	_, err := fmt.Fprintln(c.stdout, "ok")
+	return err
+}
+
+func (c *ctl) printEmails(key string, emails []string) error {
+	if c.output == "json" {
+		return c.printJSON(map[string]interface{}{key: emails, "count": len(emails)})
+	}
+	rows := make([][]string, len(emails))
+	for i, email := range emails {
+		rows[i] = []string{email}
+	}
+	return c.printTable([]string{"email"}, rows)
+}
+
+func (c *ctl) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func (c *ctl) printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(header, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
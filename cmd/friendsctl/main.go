@@ -0,0 +1,136 @@
+// friendsctl manages the friends graph from the command line through the HTTP API of the
+// server, it needs an API key with the admin scope for most commands
+//
+//	friendsctl friends add andy@example.com john@example.com
+//	friendsctl -o json list friends andy@example.com
+//	friendsctl recipients andy@example.com "hello kate@example.com"
+//	friendsctl export relationships.jsonl
+//	friendsctl migrate up
+//
+// The API and the key are read from -api and -api-key or FRIENDSCTL_API and FRIENDSCTL_API_KEY,
+// the database URL of migrate from -database or FRIENDSCTL_DATABASE_URL.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// command is a subcommand, its name may have several words such as "friends add"
+type command struct {
+	name    string
+	usage   string
+	summary string
+	minArgs int
+	maxArgs int
+	run     func(ctl *ctl, args []string) error
+}
+
+var commands = []command{
+	{"friends add", "<email> <friend>", "connect two users as friends", 2, 2, addFriends},
+	{"friends remove", "<email> <friend>", "remove the friendship of two users", 2, 2, removeFriends},
+	{"subscribe", "<requestor> <target>", "subscribe to the updates of a user", 2, 2, subscribe},
+	{"block", "<requestor> <target>", "block the updates of a user", 2, 2, block},
+	{"unblock", "<requestor> <target>", "lift a block", 2, 2, unblock},
+	{"list friends", "<email>", "list the friends of a user", 1, 1, listFriends},
+	{"list followers", "<email>", "list the users subscribed to a user", 1, 1, listFollowers},
+	{"list blocked", "<email>", "list the users a user blocks", 1, 1, listBlocked},
+	{"common", "<email> <other>", "list the common friends of two users", 2, 2, commonFriends},
+	{"recipients", "<sender> <text>", "preview the recipients of a message", 2, 2, previewRecipients},
+	{"migrate", "[-path dir] [-database url] up|down|version|...", "run the database migrations", 1, -1, migrate},
+	{"export", "[file]", "write every relationship as JSON lines, to stdout without a file", 0, 1, exportRelationships},
+	{"import", "[file]", "store the relationships of an export, from stdin without a file", 0, 1, importRelationships},
+}
+
+// ctl is what the commands share, the client and where and how to print
+type ctl struct {
+	client *client
+	output string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run returns the exit code, 2 for a wrong usage and 1 for a failed command
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("friendsctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	api := flags.String("api", envOr("FRIENDSCTL_API", "http://localhost:3000"), "base URL of the server")
+	apiKey := flags.String("api-key", os.Getenv("FRIENDSCTL_API_KEY"), "API key sent as X-API-Key")
+	output := flags.String("o", "table", "output format, table or json")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout of each request")
+	flags.Usage = func() { printUsage(flags) }
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(stderr, "friendsctl: unknown output %v\n", *output)
+		return 2
+	}
+
+	cmd, rest, ok := findCommand(flags.Args())
+	if !ok {
+		printUsage(flags)
+		return 2
+	}
+	if len(rest) < cmd.minArgs || (cmd.maxArgs >= 0 && len(rest) > cmd.maxArgs) {
+		fmt.Fprintf(stderr, "usage: friendsctl %v %v\n", cmd.name, cmd.usage)
+		return 2
+	}
+
+	c := &ctl{
+		client: &client{api: *api, apiKey: *apiKey, http: &http.Client{Timeout: *timeout}},
+		output: *output,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	if err := cmd.run(c, rest); err != nil {
+		fmt.Fprintf(stderr, "friendsctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// findCommand matches the longest command name at the start of args
+func findCommand(args []string) (command, []string, bool) {
+	var found command
+	words := 0
+	for _, cmd := range commands {
+		name := strings.Fields(cmd.name)
+		if len(name) > len(args) || len(name) <= words {
+			continue
+		}
+		if strings.Join(args[:len(name)], " ") == cmd.name {
+			found, words = cmd, len(name)
+		}
+	}
+	return found, args[words:], words > 0
+}
+
+func printUsage(flags *flag.FlagSet) {
+	out := flags.Output()
+	fmt.Fprintln(out, "usage: friendsctl [flags] <command> [args]")
+	fmt.Fprintln(out, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-16v %v\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(out, "\nflags:")
+	flags.PrintDefaults()
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
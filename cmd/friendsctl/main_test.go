@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeAPI records the requests of a command and answers them with handler
+func fakeAPI(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, body []byte)) (*httptest.Server, *[]string) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			t.Errorf("expected the API key on %v", r.URL)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		handler(w, r, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func runCommand(server *httptest.Server, stdin string, args ...string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	args = append([]string{"-api", server.URL, "-api-key", "secret"}, args...)
+	code := run(args, strings.NewReader(stdin), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestFindCommand(t *testing.T) {
+	cmd, rest, ok := findCommand([]string{"list", "friends", "andy@example.com"})
+	if !ok || cmd.name != "list friends" || len(rest) != 1 {
+		t.Errorf("expected list friends with one argument, have %q %v", cmd.name, rest)
+	}
+	if _, _, ok := findCommand([]string{"list"}); ok {
+		t.Error("expected an incomplete command to be refused")
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	server, requests := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {})
+	for _, args := range [][]string{{"unknown"}, {"friends", "add", "andy@example.com"}, {"-o", "yaml", "export"}} {
+		if code, _, _ := runCommand(server, "", args...); code != 2 {
+			t.Errorf("expected %v to exit with 2, have %v", args, code)
+		}
+	}
+	if len(*requests) != 0 {
+		t.Errorf("expected no request, have %v", *requests)
+	}
+}
+
+func TestAddFriends(t *testing.T) {
+	server, requests := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		fmt.Fprint(w, `{"success": true}`)
+	})
+	code, stdout, _ := runCommand(server, "", "friends", "add", "andy@example.com", "john@example.com")
+	if code != 0 || stdout != "ok\n" {
+		t.Errorf("expected ok, have %v %q", code, stdout)
+	}
+	if (*requests)[0] != "POST /api/v2/users/andy@example.com/friends/john@example.com" {
+		t.Errorf("expected the v2 route, have %v", *requests)
+	}
+}
+
+func TestAPIErrorsFailTheCommand(t *testing.T) {
+	server, _ := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"success": false, "errors": "user is blocked", "code": "blocked"}`)
+	})
+	code, _, stderr := runCommand(server, "", "subscribe", "andy@example.com", "john@example.com")
+	if code != 1 || stderr != "friendsctl: user is blocked (blocked)\n" {
+		t.Errorf("expected the error of the API, have %v %q", code, stderr)
+	}
+}
+
+func TestListFollowers(t *testing.T) {
+	server, _ := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		fmt.Fprint(w, `{"success": true, "relationships": [
+			{"requestor": "lisa@example.com", "target": "andy@example.com", "status": "subscribed"},
+			{"requestor": "andy@example.com", "target": "kate@example.com", "status": "subscribed"},
+			{"requestor": "john@example.com", "target": "andy@example.com", "status": "blocked"}
+		]}`)
+	})
+
+	_, stdout, _ := runCommand(server, "", "list", "followers", "andy@example.com")
+	if stdout != "EMAIL\nlisa@example.com\n" {
+		t.Errorf("expected a table of followers, have %q", stdout)
+	}
+	_, stdout, _ = runCommand(server, "", "-o", "json", "list", "followers", "andy@example.com")
+	res := struct {
+		Followers []string `json:"followers"`
+		Count     int      `json:"count"`
+	}{}
+	if err := json.Unmarshal([]byte(stdout), &res); err != nil || res.Count != 1 || res.Followers[0] != "lisa@example.com" {
+		t.Errorf("expected the followers as JSON, have %q", stdout)
+	}
+}
+
+func TestCommonFriendsFollowsCursors(t *testing.T) {
+	server, requests := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		if r.URL.Query().Get("cursor") == "" {
+			fmt.Fprint(w, `{"success": true, "friends": ["kate@example.com"], "next_cursor": "abc"}`)
+			return
+		}
+		fmt.Fprint(w, `{"success": true, "friends": ["lisa@example.com"]}`)
+	})
+	_, stdout, _ := runCommand(server, "", "common", "andy@example.com", "john@example.com")
+	if stdout != "EMAIL\nkate@example.com\nlisa@example.com\n" || len(*requests) != 2 {
+		t.Errorf("expected both pages, have %q after %v", stdout, *requests)
+	}
+}
+
+func TestImportBatchesTheExport(t *testing.T) {
+	var operations []batchOperation
+	server, requests := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		request := struct {
+			Mode       string           `json:"mode"`
+			Operations []batchOperation `json:"operations"`
+		}{}
+		json.Unmarshal(body, &request)
+		if request.Mode != "best_effort" {
+			t.Errorf("expected a best effort batch, have %v", request.Mode)
+		}
+		operations = append(operations, request.Operations...)
+		results := []batchResult{}
+		for i := range request.Operations {
+			results = append(results, batchResult{Index: i, Success: i != 0, Errors: "blocked"})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	})
+
+	export := &bytes.Buffer{}
+	fmt.Fprintln(export, `{"requestor": "andy@example.com", "target": "john@example.com", "status": "friend"}`)
+	fmt.Fprintln(export, `{"requestor": "john@example.com", "target": "andy@example.com", "status": "friend"}`)
+	for i := 0; i < importBatchSize; i++ {
+		fmt.Fprintf(export, `{"requestor": "user%v@example.com", "target": "andy@example.com", "status": "subscribed"}`+"\n", i)
+	}
+
+	code, stdout, _ := runCommand(server, export.String(), "-o", "json", "import")
+	if code != 0 || len(*requests) != 2 {
+		t.Fatalf("expected two batches, have %v %v", code, *requests)
+	}
+	if len(operations) != importBatchSize+1 || operations[0].Action != "friend" || operations[1].Action != "subscribe" {
+		t.Errorf("expected one friend and the subscriptions, have %v operations", len(operations))
+	}
+	if stdout != "{\n  \"failed\": 2,\n  \"imported\": 999\n}\n" {
+		t.Errorf("expected the counts, have %q", stdout)
+	}
+}
+
+func TestUnblockSendsThePair(t *testing.T) {
+	var sent string
+	server, _ := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		sent = string(body)
+		fmt.Fprint(w, `{"success": true, "removed": 1}`)
+	})
+	if code, _, stderr := runCommand(server, "", "unblock", "andy@example.com", "john@example.com"); code != 0 {
+		t.Fatalf("expected the block to be lifted, have %v %q", code, stderr)
+	}
+	if sent != `{"blocks":[{"requestor":"andy@example.com","target":"john@example.com"}]}` {
+		t.Errorf("expected only the requestor and target, have %v", sent)
+	}
+}
+
+func TestListMatchesTheUserInLowerCase(t *testing.T) {
+	server, requests := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		fmt.Fprint(w, `{"success": true, "relationships": [
+			{"requestor": "andy@example.com", "target": "john@example.com", "status": "friend"},
+			{"requestor": "john@example.com", "target": "andy@example.com", "status": "friend"}
+		]}`)
+	})
+	_, stdout, _ := runCommand(server, "", "list", "friends", "Andy@Example.com")
+	if stdout != "EMAIL\njohn@example.com\n" {
+		t.Errorf("expected the friends of andy, have %q", stdout)
+	}
+	if (*requests)[0] != "GET /api/admin/relationships?email=andy%40example.com" {
+		t.Errorf("expected the lower case email, have %v", *requests)
+	}
+}
+
+func TestExportVerifiesTheTrailer(t *testing.T) {
+	row := `{"id":1,"requestor":"andy@example.com","target":"john@example.com","status":"friend"}` + "\n"
+	testSamples := []map[string]interface{}{
+		{"body": row + `{"end":true,"count":1}` + "\n", "code": 0, "stderr": ""},
+		{"body": row, "code": 1, "stderr": "friendsctl: export was cut short after 1 rows\n"},
+		{"body": row + `{"end":true,"count":1,"error":"internal server error"}` + "\n", "code": 1, "stderr": "friendsctl: export failed after 1 rows: internal server error\n"},
+		{"body": row + `{"end":true,"count":2}` + "\n", "code": 1, "stderr": "friendsctl: export wrote 1 rows but the server sent 2\n"},
+	}
+	for _, testSample := range testSamples {
+		server, _ := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+			fmt.Fprint(w, testSample["body"])
+		})
+		code, stdout, stderr := runCommand(server, "", "export")
+		if code != testSample["code"] || stderr != testSample["stderr"] {
+			t.Errorf("expecting %v %q but have %v %q", testSample["code"], testSample["stderr"], code, stderr)
+		}
+		if stdout != row {
+			t.Errorf("expected the rows without the trailer, have %q", stdout)
+		}
+	}
+}
+
+func TestListFriendsRequiresBothDirections(t *testing.T) {
+	server, _ := fakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		fmt.Fprint(w, `{"success": true, "relationships": [
+			{"requestor": "andy@example.com", "target": "john@example.com", "status": "friend"},
+			{"requestor": "john@example.com", "target": "andy@example.com", "status": "friend"},
+			{"requestor": "andy@example.com", "target": "kate@example.com", "status": "blocked"},
+			{"requestor": "kate@example.com", "target": "andy@example.com", "status": "friend"},
+			{"requestor": "andy@example.com", "target": "lisa@example.com", "status": "friend"}
+		]}`)
+	})
+	_, stdout, _ := runCommand(server, "", "list", "friends", "andy@example.com")
+	if stdout != "EMAIL\njohn@example.com\n" {
+		t.Errorf("expected only the friend of both directions, have %q", stdout)
+	}
+}
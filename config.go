@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redacted = "[redacted]"
+
+// config holds every setting of the server. Settings are read from a JSON file, then from
+// environment variables and then from command-line flags, a later source wins. The keys of
+// the file are the flag names, the environment variables are the flag names in upper case
+// with underscores, e.g. -http-read-timeout and HTTP_READ_TIMEOUT
+type config struct {
+	Env               string
+	LogLevel          slog.Level
+	HTTP              httpConfig
+	GRPC              grpcConfig
+	TLS               tlsConfig
+	Database          databaseConfig
+	Auth              authConfig
+	RateLimit         rateLimitConfig
+	Features          featureConfig
+	Outbox            outboxConfig
+	Digest            digestConfig
+	Tracing           tracingConfig
+	IdempotencyKeyTTL time.Duration
+}
+
+type httpConfig struct {
+	Addr              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+	TrustedProxies    string
+}
+
+type grpcConfig struct {
+	Addr string
+}
+
+// tlsConfig serves both HTTP and gRPC over TLS when the certificate and key are set
+type tlsConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+func (c tlsConfig) enabled() bool {
+	return c.CertFile != ""
+}
+
+type databaseConfig struct {
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnectTimeout  time.Duration
+
+	// QueryTimeout bounds the queries of a request, RouteQueryTimeouts overrides it by route
+	QueryTimeout       time.Duration
+	RouteQueryTimeouts string
+}
+
+type authConfig struct {
+	JWTSecret   string
+	AdminAPIKey string
+	AdminEmail  string
+}
+
+type rateLimitConfig struct {
+	Read  string
+	Write string
+	Store string
+}
+
+// featureConfig turns the optional parts of the server on and off
+type featureConfig struct {
+	GRPC     bool
+	GraphQL  bool
+	Webhooks bool
+	Outbox   bool
+	Digests  bool
+}
+
+type outboxConfig struct {
+	Publisher string
+	File      string
+}
+
+type digestConfig struct {
+	Notifier string
+	File     string
+}
+
+// tracingConfig picks where the spans go, none leaves tracing off
+type tracingConfig struct {
+	Exporter     string
+	OTLPEndpoint string
+	SampleRatio  float64
+}
+
+func defaultConfig() *config {
+	return &config{
+		HTTP: httpConfig{
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Database: databaseConfig{
+			MaxOpenConns:    20,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnectTimeout:  time.Minute,
+			QueryTimeout:    10 * time.Second,
+		},
+		Auth:              authConfig{AdminEmail: "admin@localhost"},
+		RateLimit:         rateLimitConfig{Read: "600/1m", Write: "60/1m", Store: "memory"},
+		Features:          featureConfig{GRPC: true, GraphQL: true, Webhooks: true, Outbox: true, Digests: true},
+		Outbox:            outboxConfig{Publisher: "ndjson", File: "outbox.ndjson"},
+		Digest:            digestConfig{Notifier: "log", File: "digests.ndjson"},
+		Tracing:           tracingConfig{Exporter: "none", OTLPEndpoint: "http://localhost:4318", SampleRatio: 1},
+		IdempotencyKeyTTL: 24 * time.Hour,
+	}
+}
+
+// flagSet binds every setting to its flag, the addresses and the DSN default to the
+// environment so they are left empty here
+func (c *config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("friends-management", flag.ContinueOnError)
+	fs.StringVar(&c.Env, "env", c.Env, "environment, test switches to the test database and ports")
+	fs.TextVar(&c.LogLevel, "log-level", c.LogLevel, "lowest level logged, debug, info, warn or error")
+	fs.StringVar(&c.HTTP.Addr, "http-addr", c.HTTP.Addr, "address of the HTTP server (default :3000)")
+	fs.DurationVar(&c.HTTP.ReadTimeout, "http-read-timeout", c.HTTP.ReadTimeout, "time to read a whole request")
+	fs.DurationVar(&c.HTTP.ReadHeaderTimeout, "http-read-header-timeout", c.HTTP.ReadHeaderTimeout, "time to read the request headers")
+	fs.DurationVar(&c.HTTP.WriteTimeout, "http-write-timeout", c.HTTP.WriteTimeout, "time to write a response")
+	fs.DurationVar(&c.HTTP.IdleTimeout, "http-idle-timeout", c.HTTP.IdleTimeout, "time a keep-alive connection may stay idle")
+	fs.DurationVar(&c.HTTP.ShutdownTimeout, "shutdown-timeout", c.HTTP.ShutdownTimeout, "time in-flight requests get to finish on shutdown")
+	fs.StringVar(&c.HTTP.TrustedProxies, "trusted-proxies", c.HTTP.TrustedProxies, "IPs and CIDRs of the proxies whose X-Forwarded-For is believed, e.g. 10.0.0.0/8")
+	fs.StringVar(&c.GRPC.Addr, "grpc-addr", c.GRPC.Addr, "address of the gRPC server (default :50051)")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert-file", c.TLS.CertFile, "certificate to serve HTTP and gRPC over TLS")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key-file", c.TLS.KeyFile, "private key of the TLS certificate")
+	fs.StringVar(&c.Database.DSN, "database-dsn", c.Database.DSN, "postgres connection string (default the local friends_management database)")
+	fs.IntVar(&c.Database.MaxOpenConns, "database-max-open-conns", c.Database.MaxOpenConns, "maximum open connections, 0 for no limit")
+	fs.IntVar(&c.Database.MaxIdleConns, "database-max-idle-conns", c.Database.MaxIdleConns, "maximum idle connections")
+	fs.DurationVar(&c.Database.ConnMaxLifetime, "database-conn-max-lifetime", c.Database.ConnMaxLifetime, "time a connection is reused, 0 for ever")
+	fs.DurationVar(&c.Database.ConnectTimeout, "database-connect-timeout", c.Database.ConnectTimeout, "time to keep retrying the database on start")
+	fs.DurationVar(&c.Database.QueryTimeout, "query-timeout", c.Database.QueryTimeout, "time the queries of a request may take before it fails with a 504")
+	fs.StringVar(&c.Database.RouteQueryTimeouts, "route-query-timeouts", c.Database.RouteQueryTimeouts, "query-timeout by route, e.g. GET /api/friends/common=5s,GET /api/friends=2s")
+	fs.StringVar(&c.Auth.JWTSecret, "jwt-secret", c.Auth.JWTSecret, "secret of the HS256 bearer tokens, bearer tokens are refused without it")
+	fs.StringVar(&c.Auth.AdminAPIKey, "admin-api-key", c.Auth.AdminAPIKey, "admin API key stored on start")
+	fs.StringVar(&c.Auth.AdminEmail, "admin-email", c.Auth.AdminEmail, "user of the admin API key")
+	fs.StringVar(&c.RateLimit.Read, "rate-limit-read", c.RateLimit.Read, "read requests per client IP and per user, 0 turns it off")
+	fs.StringVar(&c.RateLimit.Write, "rate-limit-write", c.RateLimit.Write, "write requests per client IP and per user, 0 turns it off")
+	fs.StringVar(&c.RateLimit.Store, "rate-limit-store", c.RateLimit.Store, "store of the rate limit buckets, memory")
+	fs.BoolVar(&c.Features.GRPC, "feature-grpc", c.Features.GRPC, "serve the gRPC API")
+	fs.BoolVar(&c.Features.GraphQL, "feature-graphql", c.Features.GraphQL, "serve the GraphQL endpoint")
+	fs.BoolVar(&c.Features.Webhooks, "feature-webhooks", c.Features.Webhooks, "deliver webhooks")
+	fs.BoolVar(&c.Features.Outbox, "feature-outbox", c.Features.Outbox, "relay the event outbox")
+	fs.BoolVar(&c.Features.Digests, "feature-digests", c.Features.Digests, "build and send digests")
+	fs.StringVar(&c.Outbox.Publisher, "outbox-publisher", c.Outbox.Publisher, "outbox publisher, ndjson or channel")
+	fs.StringVar(&c.Outbox.File, "outbox-file", c.Outbox.File, "file of the ndjson outbox publisher")
+	fs.StringVar(&c.Digest.Notifier, "digest-notifier", c.Digest.Notifier, "digest notifier, log or file")
+	fs.StringVar(&c.Digest.File, "digest-file", c.Digest.File, "file of the file digest notifier")
+	fs.StringVar(&c.Tracing.Exporter, "trace-exporter", c.Tracing.Exporter, "span exporter, none, stdout or otlp")
+	fs.StringVar(&c.Tracing.OTLPEndpoint, "trace-otlp-endpoint", c.Tracing.OTLPEndpoint, "URL of the OTLP/HTTP collector of the otlp exporter")
+	fs.Float64Var(&c.Tracing.SampleRatio, "trace-sample-ratio", c.Tracing.SampleRatio, "share of the traces started by the server that are sampled")
+	fs.DurationVar(&c.IdempotencyKeyTTL, "idempotency-key-ttl", c.IdempotencyKeyTTL, "time responses to idempotency keys are kept")
+	return fs
+}
+
+// envName is the environment variable of a flag, env keeps the GO_ENV it always had
+func envName(flagName string) string {
+	if flagName == "env" {
+		return "GO_ENV"
+	}
+	return strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// loadConfig reads the config file given by -config or CONFIG_FILE, the environment and args
+func loadConfig(args []string) (*config, error) {
+	// the flags are parsed first to find the config file, they are applied last
+	fs := defaultConfig().flagSet()
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "JSON config file keyed by flag name")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+
+	c := defaultConfig()
+	fs = c.flagSet()
+	if *file != "" {
+		if err := loadConfigFile(fs, *file); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && value != "" && err == nil {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid %v %v", envName(f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range flags {
+		fs.Set(name, value)
+	}
+
+	c.setEnvDefaults()
+	return c, c.validate()
+}
+
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file err %v", err)
+	}
+	defer file.Close()
+
+	settings := map[string]interface{}{}
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("failed to read config file %v err %v", path, err)
+	}
+	for name, value := range settings {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %v in config file %v", name, path)
+		}
+		text := ""
+		switch v := value.(type) {
+		case string:
+			text = v
+		case json.Number:
+			text = v.String()
+		case bool:
+			text = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("setting %v in config file %v must be a string, number or boolean", name, path)
+		}
+		if err := fs.Set(name, text); err != nil {
+			return fmt.Errorf("invalid %v in config file %v %v", name, path, err)
+		}
+	}
+	return nil
+}
+
+// setEnvDefaults fills the settings whose defaults depend on the environment
+func (c *config) setEnvDefaults() {
+	test := c.Env == "test"
+	if c.HTTP.Addr == "" {
+		c.HTTP.Addr = ":3000"
+		if test {
+			c.HTTP.Addr = ":3001"
+		}
+	}
+	if c.GRPC.Addr == "" {
+		c.GRPC.Addr = ":50051"
+		if test {
+			c.GRPC.Addr = ":50052"
+		}
+	}
+	if c.Database.DSN == "" {
+		c.Database.DSN = "user=postgres host=db sslmode=disable dbname=friends_management"
+		if test {
+			c.Database.DSN += "_test"
+		}
+	}
+}
+
+// validate reports every invalid setting at once
+func (c *config) validate() error {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.HTTP.Addr); err != nil {
+		problem("http-addr %q is not a host:port address", c.HTTP.Addr)
+	}
+	if _, _, err := net.SplitHostPort(c.GRPC.Addr); err != nil {
+		problem("grpc-addr %q is not a host:port address", c.GRPC.Addr)
+	}
+	timeouts := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"http-read-timeout", c.HTTP.ReadTimeout},
+		{"http-read-header-timeout", c.HTTP.ReadHeaderTimeout},
+		{"http-write-timeout", c.HTTP.WriteTimeout},
+		{"http-idle-timeout", c.HTTP.IdleTimeout},
+		{"shutdown-timeout", c.HTTP.ShutdownTimeout},
+		{"database-connect-timeout", c.Database.ConnectTimeout},
+		{"query-timeout", c.Database.QueryTimeout},
+		{"idempotency-key-ttl", c.IdempotencyKeyTTL},
+	}
+	for _, t := range timeouts {
+		if t.timeout <= 0 {
+			problem("%v must be positive", t.name)
+		}
+	}
+	if c.Database.QueryTimeout >= c.HTTP.WriteTimeout {
+		problem("query-timeout must be shorter than http-write-timeout")
+	}
+	if _, err := parseRouteTimeouts(c.Database.RouteQueryTimeouts); err != nil {
+		problem("route-query-timeouts %v", err)
+	}
+	if _, err := parseTrustedProxies(c.HTTP.TrustedProxies); err != nil {
+		problem("trusted-proxies %v", err)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problem("tls-cert-file and tls-key-file must be set together")
+	}
+	for _, path := range []string{c.TLS.CertFile, c.TLS.KeyFile} {
+		if _, err := os.Stat(path); path != "" && err != nil {
+			problem("cannot read %v", path)
+		}
+	}
+	if c.Database.MaxOpenConns < 0 || c.Database.MaxIdleConns < 0 || c.Database.ConnMaxLifetime < 0 {
+		problem("database pool settings cannot be negative")
+	}
+	if c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		problem("database-max-idle-conns cannot be more than database-max-open-conns")
+	}
+	if c.Auth.AdminAPIKey != "" && !isEmailValid(c.Auth.AdminEmail) {
+		problem("admin-email %q is not an email", c.Auth.AdminEmail)
+	}
+	if _, err := parseRateLimit(c.RateLimit.Read); err != nil {
+		problem("rate-limit-read %v", err)
+	}
+	if _, err := parseRateLimit(c.RateLimit.Write); err != nil {
+		problem("rate-limit-write %v", err)
+	}
+	choices := []struct {
+		name, value string
+		allowed     []string
+	}{
+		{"rate-limit-store", c.RateLimit.Store, []string{"memory"}},
+		{"outbox-publisher", c.Outbox.Publisher, []string{"ndjson", "channel"}},
+		{"digest-notifier", c.Digest.Notifier, []string{"log", "file"}},
+		{"trace-exporter", c.Tracing.Exporter, []string{"none", "stdout", "otlp"}},
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problem("trace-sample-ratio must be between 0 and 1")
+	}
+	if endpoint, err := url.Parse(c.Tracing.OTLPEndpoint); c.Tracing.Exporter == "otlp" && (err != nil || endpoint.Host == "") {
+		problem("trace-otlp-endpoint %q is not a URL", c.Tracing.OTLPEndpoint)
+	}
+	for _, choice := range choices {
+		if !contains(choice.allowed, choice.value) {
+			problem("%v must be one of %v", choice.name, strings.Join(choice.allowed, ", "))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid config: " + strings.Join(problems, ", "))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var dsnPassword = regexp.MustCompile(`password=('[^']*'|\S*)`)
+
+// redactedSettings lists the settings by flag name with the secrets redacted
+func (c config) redactedSettings(fn func(name, value string)) {
+	c.flagSet().VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case f.Name == "database-dsn":
+			value = redactDSN(value)
+		case (f.Name == "jwt-secret" || f.Name == "admin-api-key") && value != "":
+			value = redacted
+		}
+		fn(f.Name, value)
+	})
+}
+
+// String prints one setting a line as flag=value, secrets are redacted
+func (c config) String() string {
+	lines := []string{}
+	c.redactedSettings(func(name, value string) {
+		lines = append(lines, name+"="+value)
+	})
+	return strings.Join(lines, "\n")
+}
+
+// LogValue logs the settings as a group, secrets are redacted
+func (c config) LogValue() slog.Value {
+	attrs := []slog.Attr{}
+	c.redactedSettings(func(name, value string) {
+		attrs = append(attrs, slog.String(name, value))
+	})
+	return slog.GroupValue(attrs...)
+}
+
+// redactDSN hides the password of URL and key=value connection strings
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "password="+redacted)
+}
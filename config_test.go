@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	settings := `{"http-addr": ":4000", "grpc-addr": ":4001", "database-max-open-conns": 5, "database-max-idle-conns": 2, "feature-graphql": false, "rate-limit-write": "10/1s"}`
+	if err := ioutil.WriteFile(file, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("GRPC_ADDR", ":5001")
+	t.Setenv("RATE_LIMIT_WRITE", "20/1s")
+
+	c, err := loadConfig([]string{"-rate-limit-write", "30/1s", "-http-idle-timeout", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.Addr != ":4000" || c.Database.MaxOpenConns != 5 || c.Features.GraphQL {
+		t.Errorf("expected the file settings, got %+v", c)
+	}
+	if c.GRPC.Addr != ":5001" {
+		t.Errorf("expected the environment to override the file, got %v", c.GRPC.Addr)
+	}
+	if c.RateLimit.Write != "30/1s" || c.HTTP.IdleTimeout != time.Minute {
+		t.Errorf("expected the flags to override the environment, got %v %v", c.RateLimit.Write, c.HTTP.IdleTimeout)
+	}
+	if c.HTTP.ReadTimeout != 15*time.Second || !c.Features.GRPC {
+		t.Errorf("expected the defaults to be kept, got %+v", c)
+	}
+}
+
+func TestLoadConfigTestEnv(t *testing.T) {
+	t.Setenv("GO_ENV", "test")
+	t.Setenv("DATABASE_DSN", "")
+
+	c, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.Addr != ":3001" || c.GRPC.Addr != ":50052" || !strings.HasSuffix(c.Database.DSN, "dbname=friends_management_test") {
+		t.Errorf("expected the test ports and database, got %v %v %v", c.HTTP.Addr, c.GRPC.Addr, c.Database.DSN)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, err := loadConfig([]string{"-http-addr", "3000", "-shutdown-timeout", "0s", "-tls-cert-file", "cert.pem", "-rate-limit-read", "fast", "-outbox-publisher", "kafka", "-trace-exporter", "jaeger", "-trace-sample-ratio", "2", "-route-query-timeouts", "GET /nowhere=1s", "-trusted-proxies", "10.0.0.0/33"})
+	if err == nil {
+		t.Fatal("expected the config to be refused")
+	}
+	for _, problem := range []string{"http-addr", "shutdown-timeout must be positive", "must be set together", "rate-limit-read", "outbox-publisher must be one of ndjson", "trace-exporter must be one of none, stdout, otlp", "trace-sample-ratio", "route-query-timeouts", "trusted-proxies"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q in %v", problem, err)
+		}
+	}
+
+	t.Setenv("HTTP_WRITE_TIMEOUT", "soon")
+	if _, err := loadConfig(nil); err == nil || !strings.Contains(err.Error(), "HTTP_WRITE_TIMEOUT") {
+		t.Errorf("expected the environment variable to be named, got %v", err)
+	}
+}
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	c := defaultConfig()
+	c.Auth.JWTSecret = "jwt-secret-value"
+	c.Auth.AdminAPIKey = "admin-key-value"
+	c.Database.DSN = "user=postgres password=db-password host=db"
+
+	printed := c.String()
+	for _, secret := range []string{"jwt-secret-value", "admin-key-value", "db-password"} {
+		if strings.Contains(printed, secret) {
+			t.Errorf("expected %v to be redacted in %v", secret, printed)
+		}
+	}
+	if !strings.Contains(printed, "database-dsn=user=postgres password=[redacted] host=db") {
+		t.Errorf("expected the rest of the dsn to be printed, got %v", printed)
+	}
+	if redactDSN("postgres://postgres:db-password@db/friends") != "postgres://postgres:xxxxx@db/friends" {
+		t.Errorf("expected the password of a URL to be redacted, got %v", redactDSN("postgres://postgres:db-password@db/friends"))
+	}
+}
@@ -2,28 +2,53 @@ package main
 
 import (
 	"database/sql"
-	"log"
-	"os"
+	"fmt"
+	"log/slog"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
-var db *sql.DB
-
-func init() {
-	dbname := "friends_management"
+const (
+	// dbConnectBackoff is the delay before the first retry to connect, doubled on every failed attempt
+	dbConnectBackoff    = 500 * time.Millisecond
+	dbConnectMaxBackoff = 10 * time.Second
+)
 
-	if os.Getenv("GO_ENV") == "test" {
-		dbname += "_test"
-	}
+var db *sql.DB
 
-	conninfo := "user=postgres host=db sslmode=disable dbname=" + dbname
-	dbconn, err := sql.Open("postgres", conninfo)
+func openDB(c databaseConfig) (*sql.DB, error) {
+	dbconn, err := sql.Open("postgres", c.DSN)
 	if err != nil {
-		log.Fatalf("error in db connection info %+v", err)
+		return nil, fmt.Errorf("error in db connection info %+v", err)
 	}
+	dbconn.SetMaxOpenConns(c.MaxOpenConns)
+	dbconn.SetMaxIdleConns(c.MaxIdleConns)
+	dbconn.SetConnMaxLifetime(c.ConnMaxLifetime)
 	if err := dbconn.Ping(); err != nil {
-		log.Fatalf("error in pinging db %+v", err)
+		dbconn.Close()
+		return nil, fmt.Errorf("error in pinging db %+v", err)
+	}
+	return dbconn, nil
+}
+
+// connectDB keeps trying to open the database until ConnectTimeout runs out, the database
+// often starts along with the server
+func connectDB(c databaseConfig) (*sql.DB, error) {
+	deadline := time.Now().Add(c.ConnectTimeout)
+	delay := dbConnectBackoff
+	for attempt := 1; ; attempt++ {
+		dbconn, err := openDB(c)
+		if err == nil {
+			return dbconn, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("gave up on the database after %v attempts, %v", attempt, err)
+		}
+		slog.Warn("database is not reachable", "attempt", attempt, "retry_in", delay.String(), "err", err)
+		time.Sleep(delay)
+		if delay *= 2; delay > dbConnectMaxBackoff {
+			delay = dbConnectMaxBackoff
+		}
 	}
-	db = dbconn
 }
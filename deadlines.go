@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// queryTimeout is the deadline of a request unless routeQueryTimeouts has one for its route
+var (
+	queryTimeout       = 10 * time.Second
+	routeQueryTimeouts = map[string]time.Duration{}
+)
+
+// streamingRoutes get no deadline unless routeQueryTimeouts gives them one
+var streamingRoutes = map[string]bool{
+	"GET /api/admin/relationships/export": true,
+}
+
+// parseRouteTimeouts reads entries such as GET /api/webhooks/:id/deliveries=2s
+func parseRouteTimeouts(value string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	if strings.TrimSpace(value) == "" {
+		return timeouts, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		route, timeout, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		method, path, isRoute := strings.Cut(route, " ")
+		if !ok || !isRoute {
+			return nil, fmt.Errorf("%q is not METHOD /path=timeout", entry)
+		}
+		if routeOf(&http.Request{Method: method, URL: &url.URL{Path: path}}) != path {
+			return nil, fmt.Errorf("%q is not a route", route)
+		}
+		duration, err := time.ParseDuration(timeout)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("%q has an invalid timeout", entry)
+		}
+		timeouts[route] = duration
+	}
+	return timeouts, nil
+}
+
+// limitQueryTime cancels the queries of a request once the deadline of its route passes
+func limitQueryTime(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method + " " + routeOf(r)
+		timeout, ok := routeQueryTimeouts[route]
+		if !ok && streamingRoutes[route] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !ok {
+			timeout = queryTimeout
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestParseRouteTimeouts(t *testing.T) {
+	timeouts, err := parseRouteTimeouts("GET /api/friends/common=5s, GET /api/webhooks/:id/deliveries=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts["GET /api/friends/common"] != 5*time.Second || timeouts["GET /api/webhooks/:id/deliveries"] != 2*time.Second {
+		t.Errorf("expected both routes, have %v", timeouts)
+	}
+
+	for _, value := range []string{"GET /api/friends/common", "/api/friends=1s", "GET /api/nothing=1s", "GET /api/webhooks/7/deliveries=1s", "GET /api/friends=soon", "GET /api/friends=0s"} {
+		if _, err := parseRouteTimeouts(value); err == nil {
+			t.Errorf("expected %q to be refused", value)
+		}
+	}
+}
+
+func TestLimitQueryTime(t *testing.T) {
+	defer func(timeouts map[string]time.Duration) { routeQueryTimeouts = timeouts }(routeQueryTimeouts)
+	routeQueryTimeouts = map[string]time.Duration{"GET /api/friends/common": time.Minute}
+
+	var remaining time.Duration
+	var hasDeadline bool
+	handler := limitQueryTime(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		deadline, hasDeadline = r.Context().Deadline()
+		remaining = time.Until(deadline)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/friends/common", nil))
+	if remaining <= queryTimeout || remaining > time.Minute {
+		t.Errorf("expected the deadline of the route, have %v", remaining)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/friends", nil))
+	if remaining <= 0 || remaining > queryTimeout {
+		t.Errorf("expected the default deadline, have %v", remaining)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/admin/relationships/export", nil))
+	if hasDeadline {
+		t.Errorf("expected the export to stream without a deadline, have %v", remaining)
+	}
+}
+
+func TestTimeoutStatusCode(t *testing.T) {
+	for _, err := range []error{
+		fmt.Errorf("failed to list friends err %w", context.DeadlineExceeded),
+		fmt.Errorf("failed to list friends err %w", &pq.Error{Code: "57014"}),
+	} {
+		if status := statusCode(err); status != http.StatusGatewayTimeout {
+			t.Errorf("expected %v to be a timeout, have %v", err, status)
+		}
+	}
+	if status := statusCode(context.Canceled); status != http.StatusInternalServerError {
+		t.Errorf("expected other errors to stay internal, have %v", status)
+	}
+}
+
+func TestQueryIsCancelledOnDeadline(t *testing.T) {
+	needsDB(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	_, err := db.ExecContext(ctx, "SELECT pg_sleep(5)")
+	if !isTimeout(err) {
+		t.Errorf("expected a timeout, have %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("expected the query to be cancelled, it ran for %v", elapsed)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const unknownFieldPrefix = "json: unknown field "
+
+// maxBodySize caps every request body, larger bodies are rejected before they are decoded
+var maxBodySize int64 = 1 << 20
+
+// readBody reads the whole body up to maxBodySize
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	bodyBytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, newTooLargeError(fmt.Sprintf("request body is larger than %v bytes", maxBodySize))
+		}
+		return nil, newBadRequestError(fmt.Sprintf("failed to read the request body err: %v", err))
+	}
+	return bodyBytes, nil
+}
+
+// decodeJSON strictly decodes a JSON body declared as JSON into the request type v
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return newUnsupportedMediaTypeError("request body must be sent as application/json")
+	}
+	return decodeBody(w, r, v, true)
+}
+
+// decodeV1JSON decodes v1 bodies leniently, as v1 always has
+func decodeV1JSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	return decodeBody(w, r, v, false)
+}
+
+// decodeBody decodes a body holding a single JSON value into v
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}, strict bool) error {
+	bodyBytes, err := readBody(w, r)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(bodyBytes)) == 0 {
+		return newBadRequestError("request body is empty")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return decodingError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return newBadRequestError("request body must hold a single JSON value")
+	}
+	return nil
+}
+
+// decodingError points at the offending field whenever the decoder tells which one it is
+func decodingError(err error) *apiError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		message := fmt.Sprintf("%v must be a %v", typeErr.Field, jsonType(typeErr.Type.Kind().String()))
+		return newBadRequestError(message, fieldError{typeErr.Field, message})
+	}
+
+	// the decoder has no typed error for unknown fields, its message is `json: unknown field "name"`
+	if quoted, ok := strings.CutPrefix(err.Error(), unknownFieldPrefix); ok {
+		field, unquoteErr := strconv.Unquote(quoted)
+		if unquoteErr != nil {
+			field = quoted
+		}
+		message := fmt.Sprintf("unknown field %v", field)
+		return newBadRequestError(message, fieldError{field, message})
+	}
+	return newBadRequestError(fmt.Sprintf("invalid data err: %v", err))
+}
+
+// jsonType names a go kind the way a client sending JSON would
+func jsonType(kind string) string {
+	switch kind {
+	case "slice", "array":
+		return "list"
+	case "map", "struct":
+		return "object"
+	case "bool":
+		return "boolean"
+	case "string":
+		return "string"
+	default:
+		return "number"
+	}
+}
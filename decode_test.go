@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	testSamples := []struct {
+		body    string
+		field   string
+		message string
+	}{
+		{`{"friends": ["andy@example.com", "john@example.com"]}`, "", ""},
+		{`{"friends": "andy@example.com"}`, "friends", "friends must be a list"},
+		{`{"friends": ["andy@example.com", "john@example.com"], "query_status": true}`, "query_status", "unknown field query_status"},
+		{`{"friends": [], "subscribers": []}`, "subscribers", "unknown field subscribers"},
+	}
+	for _, testSample := range testSamples {
+		r := httptest.NewRequest("POST", "/api/friends", strings.NewReader(testSample.body))
+		r.Header.Set("Content-Type", "application/json")
+		err := decodeJSON(httptest.NewRecorder(), r, &friendsRequest{})
+		if testSample.message == "" {
+			if err != nil {
+				t.Errorf("expected %v to be decoded, have %v", testSample.body, err)
+			}
+			continue
+		}
+
+		apiErr := toAPIError(err)
+		if apiErr.Message != testSample.message || len(apiErr.Details) != 1 || apiErr.Details[0].Field != testSample.field {
+			t.Errorf("expected %q on %v for %v, have %+v", testSample.message, testSample.field, testSample.body, apiErr)
+		}
+	}
+}
+
+func TestDecodeV1JSON(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/friends", strings.NewReader(`{"friends": ["andy@example.com", "john@example.com"], "query_status": true}`))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request := friendsRequest{}
+	if err := decodeV1JSON(httptest.NewRecorder(), r, &request); err != nil || len(request.Friends) != 2 {
+		t.Errorf("expected the v1 body to be decoded, have %+v %v", request, err)
+	}
+
+	r = httptest.NewRequest("POST", "/api/friends", strings.NewReader(`{"friends": "andy@example.com"}`))
+	if apiErr := toAPIError(decodeV1JSON(httptest.NewRecorder(), r, &friendsRequest{})); apiErr.Message != "friends must be a list" {
+		t.Errorf("expected the wrong type to be reported, have %+v", apiErr)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	deliverImmediately = "immediate"
+	deliverHourly      = "hourly"
+	deliverDaily       = "daily"
+)
+
+var (
+	// digestInterval is how often the scheduler checks for digests that are due
+	digestInterval = time.Minute
+	// digestSchedulerLock is the postgres advisory lock key held while building digests
+	digestSchedulerLock int64 = 20180815103000
+	// digestClaimLease is how long an instance has to notify the digests it claimed
+	digestClaimLease = 5 * time.Minute
+)
+
+type deliveryPreference struct {
+	Email     string `json:"email"`
+	Frequency string `json:"frequency"`
+}
+
+type digest struct {
+	ID         int          `json:"id"`
+	Recipient  string       `json:"recipient"`
+	Frequency  string       `json:"frequency"`
+	PeriodEnd  time.Time    `json:"period_end"`
+	Items      []digestItem `json:"items"`
+	CreatedAt  time.Time    `json:"created_at"`
+	NotifiedAt *time.Time   `json:"notified_at,omitempty"`
+}
+
+type digestItem struct {
+	Sender    string    `json:"sender"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// notifier hands a finished digest to its recipient, it is marked as notified once Notify returns nil
+type notifier interface {
+	Notify(d digest) error
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(d digest) error {
+	slog.Info("digest", "id", d.ID, "recipient", d.Recipient, "messages", len(d.Items))
+	return nil
+}
+
+// fileNotifier appends every digest as a line of JSON to a file
+type fileNotifier struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileNotifier(path string) (*fileNotifier, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileNotifier{file: file}, nil
+}
+
+func (n *fileNotifier) Notify(d digest) error {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return n.file.Sync()
+}
+
+// newDigestNotifier picks the notifier, "log" (default) or "file"
+func newDigestNotifier(c digestConfig) (notifier, error) {
+	switch c.Notifier {
+	case "", "log":
+		return logNotifier{}, nil
+	case "file":
+		return newFileNotifier(c.File)
+	default:
+		return nil, errors.New("unknown digest notifier " + c.Notifier)
+	}
+}
+
+func (p deliveryPreference) save(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "deliveryPreference.save")
+	defer span.End()
+
+	err := validate(
+		check("email", p.Email, validEmail("invalid user")),
+		check("frequency", p.Frequency, oneOf("frequency must be one of immediate, hourly or daily", deliverImmediately, deliverHourly, deliverDaily)),
+	)
+	if err != nil {
+		return err
+	}
+	return saveDeliveryPreference(ctx, p)
+}
+
+func (u *user) getDigests(ctx context.Context) ([]digest, error) {
+	ctx, span := tracer.Start(ctx, "user.getDigests")
+	defer span.End()
+
+	if err := validate(check("email", u.Email, validEmail("invalid user"))); err != nil {
+		return nil, err
+	}
+	return getDigests(ctx, u.Email)
+}
+
+// digestPeriodEnd is the end of the last complete period
+func digestPeriodEnd(frequency string, now time.Time) time.Time {
+	if frequency == deliverDaily {
+		year, month, day := now.Date()
+		return time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	}
+	return now.Truncate(time.Hour)
+}
+
+func startDigestScheduler(n notifier) {
+	workers.every("digests", digestInterval, func(ctx context.Context) error {
+		return runDigestScheduler(ctx, n, time.Now())
+	})
+}
+
+// runDigestScheduler builds the due digests and notifies the ones this instance claims
+func runDigestScheduler(ctx context.Context, n notifier, now time.Time) error {
+	for _, frequency := range []string{deliverHourly, deliverDaily} {
+		if err := buildDigests(ctx, frequency, digestPeriodEnd(frequency, now)); err != nil {
+			return err
+		}
+	}
+
+	digests, err := claimUnnotifiedDigests(ctx, digestClaimLease)
+	if err != nil {
+		return err
+	}
+	for _, d := range digests {
+		if err := n.Notify(d); err != nil {
+			slog.Error("failed to notify digest", "id", d.ID, "err", err)
+			continue
+		}
+		if err := markDigestNotified(ctx, d.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// saveDeliveryPreference stores the preference, going back to immediate flushes the pending items
+func saveDeliveryPreference(ctx context.Context, p deliveryPreference) error {
+	ctx, done := measureQuery(ctx, "save_delivery_preference")
+	defer done()
+	return withTx(ctx, func(tx *txn) error {
+		// waits for the scheduler so an item cannot end up in two digests
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, digestSchedulerLock); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		upsertQuery := `
+			INSERT INTO delivery_preferences (email, frequency, created_at, updated_at)
+			VALUES ($1, $2, $3, $3)
+			ON CONFLICT (email) DO UPDATE SET frequency = $2, updated_at = $3
+		`
+		if _, err := tx.ExecContext(ctx, upsertQuery, p.Email, p.Frequency, now); err != nil {
+			return err
+		}
+		if p.Frequency != deliverImmediately {
+			return nil
+		}
+
+		insertQuery := `
+			INSERT INTO digests (recipient, frequency, period_end, item_count, created_at)
+			SELECT recipient, $2, $3, count(*), $3
+			FROM digest_items
+			WHERE recipient = $1 AND digest_id IS NULL AND created_at < $3
+			GROUP BY recipient
+			RETURNING id
+		`
+		var id int
+		err := tx.QueryRowContext(ctx, insertQuery, p.Email, deliverImmediately, now).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to flush the digest items of %v err %w", p.Email, err)
+		}
+		return assignDigestItems(ctx, tx, map[int]string{id: p.Email}, now)
+	})
+}
+
+// queueDigestItems keeps a copy of the message for every recipient who prefers a digest
+func queueDigestItems(ctx context.Context, q execer, sender, text string, recipients []string) error {
+	ctx, done := measureQuery(ctx, "queue_digest_items")
+	defer done()
+	insertQuery := `
+		INSERT INTO digest_items (recipient, sender, text, created_at)
+		SELECT email, $1, $2, $3 FROM delivery_preferences
+		WHERE email = ANY($4) AND frequency <> $5
+	`
+	if _, err := q.ExecContext(ctx, insertQuery, sender, text, time.Now(), pq.Array(recipients), deliverImmediately); err != nil {
+		return fmt.Errorf("failed to queue digest items of sender %v err %w", sender, err)
+	}
+	return nil
+}
+
+// buildDigests gathers the items received before periodEnd into a digest per recipient
+func buildDigests(ctx context.Context, frequency string, periodEnd time.Time) error {
+	ctx, done := measureQuery(ctx, "build_digests")
+	defer done()
+	return withTx(ctx, func(tx *txn) error {
+		var locked bool
+		if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, digestSchedulerLock).Scan(&locked); err != nil || !locked {
+			return err
+		}
+
+		insertQuery := `
+			INSERT INTO digests (recipient, frequency, period_end, item_count, created_at)
+			SELECT i.recipient, $1, $2, count(*), $3
+			FROM digest_items i
+			INNER JOIN delivery_preferences p ON p.email = i.recipient AND p.frequency = $1
+			WHERE i.digest_id IS NULL AND i.created_at < $2
+			GROUP BY i.recipient
+			RETURNING id, recipient
+		`
+		rows, err := tx.QueryContext(ctx, insertQuery, frequency, periodEnd, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to build %v digests err %w", frequency, err)
+		}
+
+		digests := map[int]string{}
+		for rows.Next() {
+			var id int
+			var recipient string
+			if err := rows.Scan(&id, &recipient); err != nil {
+				rows.Close()
+				return err
+			}
+			digests[id] = recipient
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return assignDigestItems(ctx, tx, digests, periodEnd)
+	})
+}
+
+// assignDigestItems moves the pending items received before periodEnd into the digests
+func assignDigestItems(ctx context.Context, tx *txn, digests map[int]string, periodEnd time.Time) error {
+	updateQuery := `
+		UPDATE digest_items SET digest_id = $1
+		WHERE recipient = $2 AND digest_id IS NULL AND created_at < $3
+	`
+	for id, recipient := range digests {
+		if _, err := tx.ExecContext(ctx, updateQuery, id, recipient, periodEnd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimUnnotifiedDigests leases a batch of digests to this instance until lease has passed
+func claimUnnotifiedDigests(ctx context.Context, lease time.Duration) ([]digest, error) {
+	ctx, done := measureQuery(ctx, "claim_unnotified_digests")
+	defer done()
+	now := time.Now()
+	query := `
+		UPDATE digests SET claimed_until = $1
+		WHERE id IN (
+			SELECT id FROM digests
+			WHERE notified_at IS NULL AND (claimed_until IS NULL OR claimed_until < $2)
+			ORDER BY id
+			LIMIT 100
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, frequency, period_end, created_at, notified_at
+	`
+	return queryDigests(ctx, query, now.Add(lease), now)
+}
+
+func getDigests(ctx context.Context, email string) ([]digest, error) {
+	ctx, done := measureQuery(ctx, "get_digests")
+	defer done()
+	query := `
+		SELECT id, recipient, frequency, period_end, created_at, notified_at FROM digests
+		WHERE recipient = $1
+		ORDER BY id DESC
+	`
+	return queryDigests(ctx, query, email)
+}
+
+func queryDigests(ctx context.Context, query string, args ...interface{}) (digests []digest, err error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		err = fmt.Errorf("failed to list digests err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		row := digest{}
+		var notifiedAt pq.NullTime
+		if err = rows.Scan(&row.ID, &row.Recipient, &row.Frequency, &row.PeriodEnd, &row.CreatedAt, &notifiedAt); err != nil {
+			return
+		}
+		if notifiedAt.Valid {
+			row.NotifiedAt = &notifiedAt.Time
+		}
+		digests = append(digests, row)
+		ids = append(ids, row.ID)
+	}
+	if err = rows.Err(); err != nil || len(ids) == 0 {
+		return
+	}
+
+	items, err := getDigestItems(ctx, ids)
+	if err != nil {
+		return
+	}
+	for i := range digests {
+		digests[i].Items = items[digests[i].ID]
+	}
+	return
+}
+
+func getDigestItems(ctx context.Context, digestIDs []int) (items map[int][]digestItem, err error) {
+	ctx, done := measureQuery(ctx, "get_digest_items")
+	defer done()
+	query := `
+		SELECT digest_id, sender, text, created_at FROM digest_items
+		WHERE digest_id = ANY($1)
+		ORDER BY id
+	`
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(digestIDs))
+	if err != nil {
+		err = fmt.Errorf("failed to list digest items err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	items = map[int][]digestItem{}
+	for rows.Next() {
+		var digestID int
+		row := digestItem{}
+		if err = rows.Scan(&digestID, &row.Sender, &row.Text, &row.CreatedAt); err != nil {
+			return
+		}
+		items[digestID] = append(items[digestID], row)
+	}
+	return items, rows.Err()
+}
+
+func markDigestNotified(ctx context.Context, id int) error {
+	ctx, done := measureQuery(ctx, "mark_digest_notified")
+	defer done()
+	_, err := db.ExecContext(ctx, `UPDATE digests SET notified_at = $1 WHERE id = $2`, time.Now(), id)
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingNotifier counts the digests of each recipient, failing while fail is set
+type countingNotifier struct {
+	mu       sync.Mutex
+	notified map[string]int
+	fail     bool
+}
+
+func (n *countingNotifier) Notify(d digest) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.fail {
+		return errors.New("unavailable")
+	}
+	n.notified[d.Recipient] += len(d.Items)
+	return nil
+}
+
+func resetDigests(t *testing.T, preferences ...deliveryPreference) {
+	for _, table := range []string{"digest_items", "digests", "delivery_preferences"} {
+		db.Exec("DELETE FROM " + table)
+	}
+	for _, p := range preferences {
+		if err := p.save(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildDigests(t *testing.T) {
+	needsDB(t)
+
+	resetDigests(t, deliveryPreference{"kate@example.com", deliverHourly}, deliveryPreference{"lisa@example.com", deliverDaily})
+	ctx := context.Background()
+	recipients := []string{"kate@example.com", "lisa@example.com", "mike@example.com"}
+	for _, text := range []string{"first", "second"} {
+		if err := queueDigestItems(ctx, db, "andy@example.com", text, recipients); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := buildDigests(ctx, deliverHourly, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	digests, err := getDigests(ctx, "kate@example.com")
+	if err != nil || len(digests) != 1 || len(digests[0].Items) != 2 || digests[0].Items[0].Text != "first" {
+		t.Fatalf("expected one digest of both messages, have %+v %v", digests, err)
+	}
+	if digests, _ := getDigests(ctx, "lisa@example.com"); len(digests) != 0 {
+		t.Errorf("expected the daily digest to wait for its period, have %+v", digests)
+	}
+
+	// items are gathered once
+	if err := buildDigests(ctx, deliverHourly, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if digests, _ := getDigests(ctx, "kate@example.com"); len(digests) != 1 {
+		t.Errorf("expected no second digest, have %+v", digests)
+	}
+}
+
+func TestDigestsAreNotifiedOnce(t *testing.T) {
+	needsDB(t)
+
+	resetDigests(t, deliveryPreference{"kate@example.com", deliverHourly})
+	ctx := context.Background()
+	if err := queueDigestItems(ctx, db, "andy@example.com", "hello", []string{"kate@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	n := &countingNotifier{notified: map[string]int{}, fail: true}
+	later := time.Now().Add(2 * time.Hour)
+
+	// a failed notification is retried once the lease ran out, right away without a lease
+	lease := digestClaimLease
+	digestClaimLease = 0
+	err := runDigestScheduler(ctx, n, later)
+	digestClaimLease = lease
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.fail = false
+
+	// instances running at the same time notify the digest once between them
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runDigestScheduler(ctx, n, later); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n.notified["kate@example.com"] != 1 {
+		t.Errorf("expected the digest to be notified once, have %v", n.notified)
+	}
+}
+
+func TestImmediateDeliveryFlushesPendingItems(t *testing.T) {
+	needsDB(t)
+
+	resetDigests(t, deliveryPreference{"kate@example.com", deliverDaily})
+	ctx := context.Background()
+	if err := queueDigestItems(ctx, db, "andy@example.com", "hello", []string{"kate@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (deliveryPreference{"kate@example.com", deliverImmediately}).save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	n := &countingNotifier{notified: map[string]int{}}
+	if err := runDigestScheduler(ctx, n, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n.notified["kate@example.com"] != 1 {
+		t.Errorf("expected the pending item to be notified, have %v", n.notified)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	errorCodeInvalidRequest = "invalid_request"
+	errorCodeValidation     = "validation_failed"
+	errorCodeNotFound       = "not_found"
+	errorCodeBlocked        = "blocked"
+	errorCodeInternal       = "internal_error"
+	errorCodeTooLarge       = "request_too_large"
+	errorCodeMediaType      = "unsupported_media_type"
+	errorCodeUnauthorized   = "unauthorized"
+	errorCodeForbidden      = "forbidden"
+	errorCodeRateLimited    = "rate_limited"
+	errorCodeTimeout        = "timeout"
+	errorCodeConflict       = "conflict"
+
+	// pqUniqueViolation is raised when a concurrent request inserted the same relationship first
+	pqUniqueViolation = "23505"
+)
+
+type errorKind int
+
+const (
+	errorKindInternal errorKind = iota
+	errorKindBadRequest
+	errorKindValidation
+	errorKindNotFound
+	errorKindConflict
+	errorKindBlocked
+	errorKindTooLarge
+	errorKindUnsupportedMediaType
+	errorKindUnauthorized
+	errorKindForbidden
+	errorKindRateLimited
+	errorKindTimeout
+)
+
+var errorStatusCodes = map[errorKind]int{
+	errorKindInternal:   http.StatusInternalServerError,
+	errorKindBadRequest: http.StatusBadRequest,
+	errorKindValidation: http.StatusUnprocessableEntity,
+	errorKindNotFound:   http.StatusNotFound,
+	errorKindConflict:   http.StatusConflict,
+	errorKindBlocked:    http.StatusConflict,
+
+	errorKindTooLarge:             http.StatusRequestEntityTooLarge,
+	errorKindUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	errorKindUnauthorized:         http.StatusUnauthorized,
+	errorKindForbidden:            http.StatusForbidden,
+	errorKindRateLimited:          http.StatusTooManyRequests,
+	errorKindTimeout:              http.StatusGatewayTimeout,
+}
+
+type fieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// apiError is a domain error that knows how it should be reported to the client,
+// Code is stable and meant for machines while Message may change
+type apiError struct {
+	Kind    errorKind
+	Code    string
+	Message string
+	Details []fieldError
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newBadRequestError(message string, details ...fieldError) *apiError {
+	return &apiError{Kind: errorKindBadRequest, Code: errorCodeInvalidRequest, Message: message, Details: details}
+}
+
+func newTooLargeError(message string) *apiError {
+	return &apiError{Kind: errorKindTooLarge, Code: errorCodeTooLarge, Message: message}
+}
+
+func newUnsupportedMediaTypeError(message string) *apiError {
+	return &apiError{Kind: errorKindUnsupportedMediaType, Code: errorCodeMediaType, Message: message}
+}
+
+// newValidationError reports a single invalid field
+func newValidationError(field, message string) *apiError {
+	return &apiError{
+		Kind:    errorKindValidation,
+		Code:    errorCodeValidation,
+		Message: message,
+		Details: []fieldError{{field, message}},
+	}
+}
+
+func newUnauthorizedError(message string) *apiError {
+	return &apiError{Kind: errorKindUnauthorized, Code: errorCodeUnauthorized, Message: message}
+}
+
+func newForbiddenError(message string) *apiError {
+	return &apiError{Kind: errorKindForbidden, Code: errorCodeForbidden, Message: message}
+}
+
+func newRateLimitedError(message string) *apiError {
+	return &apiError{Kind: errorKindRateLimited, Code: errorCodeRateLimited, Message: message}
+}
+
+// newValidationErrors reports every invalid field at once
+func newValidationErrors(details []fieldError) *apiError {
+	messages := make([]string, len(details))
+	for i, detail := range details {
+		messages[i] = detail.Message
+	}
+	return &apiError{
+		Kind:    errorKindValidation,
+		Code:    errorCodeValidation,
+		Message: strings.Join(messages, ", "),
+		Details: details,
+	}
+}
+
+func newNotFoundError(code, message string) *apiError {
+	return &apiError{Kind: errorKindNotFound, Code: code, Message: message}
+}
+
+func newConflictError(code, message string, details ...fieldError) *apiError {
+	return &apiError{Kind: errorKindConflict, Code: code, Message: message, Details: details}
+}
+
+func newBlockedError(message string, details ...fieldError) *apiError {
+	return &apiError{Kind: errorKindBlocked, Code: errorCodeBlocked, Message: message, Details: details}
+}
+
+// toAPIError treats unknown errors as internal except for timeouts and unique violations
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	if isTimeout(err) {
+		return &apiError{Kind: errorKindTimeout, Code: errorCodeTimeout, Message: "request timed out"}
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation {
+		return &apiError{Kind: errorKindConflict, Code: errorCodeConflict, Message: "conflicts with a concurrent change"}
+	}
+	return &apiError{Kind: errorKindInternal, Code: errorCodeInternal, Message: "internal error"}
+}
+
+// isTimeout tells a query cancelled on its deadline, lib/pq reports it as a canceled statement
+func isTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &pqErr) && pqErr.Code.Name() == "query_canceled"
+}
+
+func statusCode(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	return errorStatusCodes[toAPIError(err).Kind]
+}
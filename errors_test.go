@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestToAPIError(t *testing.T) {
+	testSamples := []struct {
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{newConflictError("already_friends", "already friends"), http.StatusConflict, "already_friends", "already friends"},
+		{fmt.Errorf("failed to store err %w", &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}), http.StatusConflict, errorCodeConflict, "conflicts with a concurrent change"},
+		{fmt.Errorf("failed to store err %w", &pq.Error{Code: "42P01", Message: `relation "relationships" does not exist`}), http.StatusInternalServerError, errorCodeInternal, "internal error"},
+		{fmt.Errorf("failed to list err %w", context.DeadlineExceeded), http.StatusGatewayTimeout, errorCodeTimeout, "request timed out"},
+		{errors.New("dial tcp 10.0.0.5:5432: connect: connection refused"), http.StatusInternalServerError, errorCodeInternal, "internal error"},
+	}
+	for _, testSample := range testSamples {
+		apiErr := toAPIError(testSample.err)
+		if status := statusCode(testSample.err); status != testSample.status {
+			t.Errorf("expected status %v for %v, have %v", testSample.status, testSample.err, status)
+		}
+		if apiErr.Code != testSample.code || apiErr.Message != testSample.message {
+			t.Errorf("expected %v %q for %v, have %v %q", testSample.code, testSample.message, testSample.err, apiErr.Code, apiErr.Message)
+		}
+	}
+}
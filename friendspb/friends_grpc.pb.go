@@ -0,0 +1,362 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.23.4
+// source: friends.proto
+
+package friendspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	FriendsService_CreateFriends_FullMethodName     = "/friends.v1.FriendsService/CreateFriends"
+	FriendsService_ListFriends_FullMethodName       = "/friends.v1.FriendsService/ListFriends"
+	FriendsService_ListCommonFriends_FullMethodName = "/friends.v1.FriendsService/ListCommonFriends"
+	FriendsService_Subscribe_FullMethodName         = "/friends.v1.FriendsService/Subscribe"
+	FriendsService_Block_FullMethodName             = "/friends.v1.FriendsService/Block"
+	FriendsService_ListRecipients_FullMethodName    = "/friends.v1.FriendsService/ListRecipients"
+	FriendsService_StreamRecipients_FullMethodName  = "/friends.v1.FriendsService/StreamRecipients"
+)
+
+// FriendsServiceClient is the client API for FriendsService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FriendsServiceClient interface {
+	CreateFriends(ctx context.Context, in *CreateFriendsRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListFriends(ctx context.Context, in *ListFriendsRequest, opts ...grpc.CallOption) (*ListFriendsResponse, error)
+	ListCommonFriends(ctx context.Context, in *ListCommonFriendsRequest, opts ...grpc.CallOption) (*ListFriendsResponse, error)
+	Subscribe(ctx context.Context, in *RelationshipRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Block(ctx context.Context, in *RelationshipRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListRecipients(ctx context.Context, in *ListRecipientsRequest, opts ...grpc.CallOption) (*ListRecipientsResponse, error)
+	// StreamRecipients sends every recipient of the message, the page of the request is ignored
+	StreamRecipients(ctx context.Context, in *ListRecipientsRequest, opts ...grpc.CallOption) (FriendsService_StreamRecipientsClient, error)
+}
+
+type friendsServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFriendsServiceClient(cc grpc.ClientConnInterface) FriendsServiceClient {
+	return &friendsServiceClient{cc}
+}
+
+func (c *friendsServiceClient) CreateFriends(ctx context.Context, in *CreateFriendsRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, FriendsService_CreateFriends_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) ListFriends(ctx context.Context, in *ListFriendsRequest, opts ...grpc.CallOption) (*ListFriendsResponse, error) {
+	out := new(ListFriendsResponse)
+	err := c.cc.Invoke(ctx, FriendsService_ListFriends_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) ListCommonFriends(ctx context.Context, in *ListCommonFriendsRequest, opts ...grpc.CallOption) (*ListFriendsResponse, error) {
+	out := new(ListFriendsResponse)
+	err := c.cc.Invoke(ctx, FriendsService_ListCommonFriends_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) Subscribe(ctx context.Context, in *RelationshipRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, FriendsService_Subscribe_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) Block(ctx context.Context, in *RelationshipRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, FriendsService_Block_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) ListRecipients(ctx context.Context, in *ListRecipientsRequest, opts ...grpc.CallOption) (*ListRecipientsResponse, error) {
+	out := new(ListRecipientsResponse)
+	err := c.cc.Invoke(ctx, FriendsService_ListRecipients_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) StreamRecipients(ctx context.Context, in *ListRecipientsRequest, opts ...grpc.CallOption) (FriendsService_StreamRecipientsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FriendsService_ServiceDesc.Streams[0], FriendsService_StreamRecipients_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &friendsServiceStreamRecipientsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FriendsService_StreamRecipientsClient interface {
+	Recv() (*Recipient, error)
+	grpc.ClientStream
+}
+
+type friendsServiceStreamRecipientsClient struct {
+	grpc.ClientStream
+}
+
+func (x *friendsServiceStreamRecipientsClient) Recv() (*Recipient, error) {
+	m := new(Recipient)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FriendsServiceServer is the server API for FriendsService service.
+// All implementations must embed UnimplementedFriendsServiceServer
+// for forward compatibility
+type FriendsServiceServer interface {
+	CreateFriends(context.Context, *CreateFriendsRequest) (*emptypb.Empty, error)
+	ListFriends(context.Context, *ListFriendsRequest) (*ListFriendsResponse, error)
+	ListCommonFriends(context.Context, *ListCommonFriendsRequest) (*ListFriendsResponse, error)
+	Subscribe(context.Context, *RelationshipRequest) (*emptypb.Empty, error)
+	Block(context.Context, *RelationshipRequest) (*emptypb.Empty, error)
+	ListRecipients(context.Context, *ListRecipientsRequest) (*ListRecipientsResponse, error)
+	// StreamRecipients sends every recipient of the message, the page of the request is ignored
+	StreamRecipients(*ListRecipientsRequest, FriendsService_StreamRecipientsServer) error
+	mustEmbedUnimplementedFriendsServiceServer()
+}
+
+// UnimplementedFriendsServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedFriendsServiceServer struct {
+}
+
+func (UnimplementedFriendsServiceServer) CreateFriends(context.Context, *CreateFriendsRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateFriends not implemented")
+}
+func (UnimplementedFriendsServiceServer) ListFriends(context.Context, *ListFriendsRequest) (*ListFriendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFriends not implemented")
+}
+func (UnimplementedFriendsServiceServer) ListCommonFriends(context.Context, *ListCommonFriendsRequest) (*ListFriendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCommonFriends not implemented")
+}
+func (UnimplementedFriendsServiceServer) Subscribe(context.Context, *RelationshipRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedFriendsServiceServer) Block(context.Context, *RelationshipRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Block not implemented")
+}
+func (UnimplementedFriendsServiceServer) ListRecipients(context.Context, *ListRecipientsRequest) (*ListRecipientsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRecipients not implemented")
+}
+func (UnimplementedFriendsServiceServer) StreamRecipients(*ListRecipientsRequest, FriendsService_StreamRecipientsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamRecipients not implemented")
+}
+func (UnimplementedFriendsServiceServer) mustEmbedUnimplementedFriendsServiceServer() {}
+
+// UnsafeFriendsServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FriendsServiceServer will
+// result in compilation errors.
+type UnsafeFriendsServiceServer interface {
+	mustEmbedUnimplementedFriendsServiceServer()
+}
+
+func RegisterFriendsServiceServer(s grpc.ServiceRegistrar, srv FriendsServiceServer) {
+	s.RegisterService(&FriendsService_ServiceDesc, srv)
+}
+
+func _FriendsService_CreateFriends_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateFriendsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).CreateFriends(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_CreateFriends_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).CreateFriends(ctx, req.(*CreateFriendsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_ListFriends_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFriendsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).ListFriends(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_ListFriends_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).ListFriends(ctx, req.(*ListFriendsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_ListCommonFriends_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCommonFriendsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).ListCommonFriends(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_ListCommonFriends_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).ListCommonFriends(ctx, req.(*ListCommonFriendsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_Subscribe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RelationshipRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).Subscribe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_Subscribe_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).Subscribe(ctx, req.(*RelationshipRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_Block_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RelationshipRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).Block(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_Block_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).Block(ctx, req.(*RelationshipRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_ListRecipients_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRecipientsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).ListRecipients(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_ListRecipients_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).ListRecipients(ctx, req.(*ListRecipientsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_StreamRecipients_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListRecipientsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FriendsServiceServer).StreamRecipients(m, &friendsServiceStreamRecipientsServer{stream})
+}
+
+type FriendsService_StreamRecipientsServer interface {
+	Send(*Recipient) error
+	grpc.ServerStream
+}
+
+type friendsServiceStreamRecipientsServer struct {
+	grpc.ServerStream
+}
+
+func (x *friendsServiceStreamRecipientsServer) Send(m *Recipient) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// FriendsService_ServiceDesc is the grpc.ServiceDesc for FriendsService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FriendsService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "friends.v1.FriendsService",
+	HandlerType: (*FriendsServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateFriends",
+			Handler:    _FriendsService_CreateFriends_Handler,
+		},
+		{
+			MethodName: "ListFriends",
+			Handler:    _FriendsService_ListFriends_Handler,
+		},
+		{
+			MethodName: "ListCommonFriends",
+			Handler:    _FriendsService_ListCommonFriends_Handler,
+		},
+		{
+			MethodName: "Subscribe",
+			Handler:    _FriendsService_Subscribe_Handler,
+		},
+		{
+			MethodName: "Block",
+			Handler:    _FriendsService_Block_Handler,
+		},
+		{
+			MethodName: "ListRecipients",
+			Handler:    _FriendsService_ListRecipients_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamRecipients",
+			Handler:       _FriendsService_StreamRecipients_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "friends.proto",
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+const graphqlSchemaDefinition = `
+	schema {
+		query: Query
+		mutation: Mutation
+	}
+
+	type Query {
+		user(email: String!): User!
+		thread(id: Int!, viewer: String!): [Message!]!
+	}
+
+	type Mutation {
+		createFriends(friends: [String!]!): Boolean!
+		subscribe(requestor: String!, target: String!): Boolean!
+		block(requestor: String!, target: String!): Boolean!
+		sendMessage(sender: String!, text: String!): SentMessage!
+		reply(parentId: Int!, sender: String!, text: String!): Message!
+		addReaction(messageId: Int!, email: String!, emoji: String!): Boolean!
+		removeReaction(messageId: Int!, email: String!, emoji: String!): Boolean!
+	}
+
+	type User {
+		email: String!
+		friends(first: Int, after: String): UserConnection!
+		# users subscribed to this user
+		followers(first: Int, after: String): UserConnection!
+		# users this user has blocked
+		blocked(first: Int, after: String): UserConnection!
+		mutualFriendCount(with: String!): Int!
+		subscribesTo(email: String!): Boolean!
+		relationshipsWith(email: String!): [Relationship!]!
+	}
+
+	type UserConnection {
+		totalCount: Int!
+		edges: [UserEdge!]!
+		pageInfo: PageInfo!
+	}
+
+	type UserEdge {
+		cursor: String!
+		node: User!
+	}
+
+	type PageInfo {
+		hasNextPage: Boolean!
+		endCursor: String
+	}
+
+	type Relationship {
+		requestor: User!
+		target: User!
+		status: String!
+	}
+
+	type Message {
+		id: Int!
+		sender: User!
+		text: String!
+		parentId: Int
+		threadId: Int!
+		createdAt: String!
+		reactions: [Reaction!]!
+	}
+
+	type Reaction {
+		emoji: String!
+		count: Int!
+	}
+
+	type SentMessage {
+		message: Message!
+		recipients: [String!]!
+	}
+`
+
+// maxGraphQLDepth bounds how deeply fields, and so connections, can be nested in a query
+const maxGraphQLDepth = 10
+
+// graphqlSchema resolves the items of a list concurrently, up to a whole page at once,
+// so that the loaders see every key of the page in a single batch
+var graphqlSchema = graphql.MustParseSchema(graphqlSchemaDefinition, &graphqlResolver{},
+	graphql.MaxParallelism(maxPageLimit), graphql.MaxDepth(maxGraphQLDepth))
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func graphqlHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	request := graphqlRequest{}
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx := withLoaders(r.Context(), newGraphQLLoaders(db))
+	response := graphqlSchema.Exec(ctx, request.Query, request.OperationName, request.Variables)
+	body, err := json.Marshal(response)
+	if err != nil {
+		loggerOf(r.Context()).Error("failed to encode the graphql response", "err", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// graphqlHasMutation tells whether a GraphQL document defines a mutation. Only the words
+// outside of selection sets, strings and comments are operation keywords, a document it
+// cannot make sense of fails later and may as well count as a mutation
+func graphqlHasMutation(document string) bool {
+	depth := 0
+	for i := 0; i < len(document); i++ {
+		switch c := document[i]; {
+		case c == '#':
+			for i < len(document) && document[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(document[i:], `"""`):
+			end := strings.Index(document[i+3:], `"""`)
+			if end < 0 {
+				return true
+			}
+			i += end + 5
+		case c == '"':
+			for i++; i < len(document) && document[i] != '"'; i++ {
+				if document[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(document) {
+				return true
+			}
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case depth == 0 && strings.HasPrefix(document[i:], "mutation"):
+			before := i == 0 || !isNameByte(document[i-1])
+			after := i+len("mutation") == len(document) || !isNameByte(document[i+len("mutation")])
+			if before && after {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Extensions adds the error code and details to GraphQL errors
+func (e *apiError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.Code, "details": e.Details}
+}
+
+// graphqlError makes sure resolvers return an apiError so the error code reaches the client,
+// internal errors are logged with the request they failed
+func graphqlError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	apiErr := toAPIError(err)
+	if apiErr.Kind == errorKindInternal {
+		loggerOf(ctx).Error("internal error", "err", err)
+	}
+	return apiErr
+}
+
+type graphqlResolver struct{}
+
+func (*graphqlResolver) User(args struct{ Email string }) (*userResolver, error) {
+	if err := validate(check("email", args.Email, validEmail("invalid user"))); err != nil {
+		return nil, err
+	}
+	return &userResolver{strings.ToLower(args.Email)}, nil
+}
+
+func (*graphqlResolver) Thread(ctx context.Context, args struct {
+	ID     int32
+	Viewer string
+}) ([]*messageResolver, error) {
+	if err := authorize(ctx, args.Viewer); err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	messages, err := getThread(ctx, int(args.ID), args.Viewer)
+	if err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	resolvers := []*messageResolver{}
+	for _, m := range messages {
+		resolvers = append(resolvers, &messageResolver{m})
+	}
+	return resolvers, nil
+}
+
+func (*graphqlResolver) CreateFriends(ctx context.Context, args struct{ Friends []string }) (bool, error) {
+	friends := &user{Friends: args.Friends}
+	if err := authorize(ctx, friends.actor()); err != nil {
+		return false, graphqlError(ctx, err)
+	}
+	return true, graphqlError(ctx, friends.createFriends(ctx, db))
+}
+
+func (*graphqlResolver) Subscribe(ctx context.Context, args struct{ Requestor, Target string }) (bool, error) {
+	if err := authorize(ctx, args.Requestor); err != nil {
+		return false, graphqlError(ctx, err)
+	}
+	userRequest := userRequest{Requestor: args.Requestor, Target: args.Target}
+	return true, graphqlError(ctx, userRequest.subscribeUpdates(ctx, db))
+}
+
+func (*graphqlResolver) Block(ctx context.Context, args struct{ Requestor, Target string }) (bool, error) {
+	if err := authorize(ctx, args.Requestor); err != nil {
+		return false, graphqlError(ctx, err)
+	}
+	userRequest := userRequest{Requestor: args.Requestor, Target: args.Target}
+	return true, graphqlError(ctx, userRequest.blockUpdates(ctx, db))
+}
+
+func (*graphqlResolver) SendMessage(ctx context.Context, args struct{ Sender, Text string }) (*sentMessageResolver, error) {
+	if err := authorize(ctx, args.Sender); err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	stored, recipients, err := message{Sender: args.Sender, Text: args.Text}.post(ctx)
+	if err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	return &sentMessageResolver{&messageResolver{stored}, recipients.listSubscribers()}, nil
+}
+
+func (*graphqlResolver) Reply(ctx context.Context, args struct {
+	ParentID     int32
+	Sender, Text string
+}) (*messageResolver, error) {
+	if err := authorize(ctx, args.Sender); err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	stored, err := reply{ParentID: int(args.ParentID), Sender: args.Sender, Text: args.Text}.post(ctx)
+	if err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	return &messageResolver{stored}, nil
+}
+
+type reactionArgs struct {
+	MessageID    int32
+	Email, Emoji string
+}
+
+func (*graphqlResolver) AddReaction(ctx context.Context, args reactionArgs) (bool, error) {
+	if err := authorize(ctx, args.Email); err != nil {
+		return false, graphqlError(ctx, err)
+	}
+	reaction := reaction{MessageID: int(args.MessageID), Email: args.Email, Emoji: args.Emoji}
+	return true, graphqlError(ctx, reaction.add(ctx))
+}
+
+func (*graphqlResolver) RemoveReaction(ctx context.Context, args reactionArgs) (bool, error) {
+	if err := authorize(ctx, args.Email); err != nil {
+		return false, graphqlError(ctx, err)
+	}
+	reaction := reaction{MessageID: int(args.MessageID), Email: args.Email, Emoji: args.Emoji}
+	return true, graphqlError(ctx, reaction.remove(ctx))
+}
+
+type userResolver struct {
+	email string
+}
+
+type connectionArgs struct {
+	First *int32
+	After *string
+}
+
+func (u *userResolver) Email() string {
+	return u.email
+}
+
+func (u *userResolver) Friends(ctx context.Context, args connectionArgs) (*connectionResolver, error) {
+	if err := u.private(ctx, ""); err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	return u.connection(ctx, connectionOfFriends, args)
+}
+
+func (u *userResolver) Followers(ctx context.Context, args connectionArgs) (*connectionResolver, error) {
+	if err := u.private(ctx, ""); err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	return u.connection(ctx, connectionOfFollowers, args)
+}
+
+func (u *userResolver) Blocked(ctx context.Context, args connectionArgs) (*connectionResolver, error) {
+	if err := u.private(ctx, ""); err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	return u.connection(ctx, connectionOfBlocked, args)
+}
+
+// private lets only the user or an admin see the user's relationships, what two users share
+// can be seen by either of them
+func (u *userResolver) private(ctx context.Context, other string) error {
+	err := authorize(ctx, u.email)
+	if err != nil && other != "" && authorize(ctx, other) == nil {
+		return nil
+	}
+	return err
+}
+
+func (u *userResolver) connection(ctx context.Context, connection string, args connectionArgs) (*connectionResolver, error) {
+	page, err := newConnectionPage(connection, args)
+	if err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	if err := loadersOf(ctx).spend(page.limit); err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	users, err := loadersOf(ctx).connections.Load(ctx, loaderKey(page.key(), u.email))()
+	if err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	return newConnectionResolver(users.(pageResult)), nil
+}
+
+func (u *userResolver) MutualFriendCount(ctx context.Context, args struct{ With string }) (int32, error) {
+	if err := u.private(ctx, strings.ToLower(args.With)); err != nil {
+		return 0, graphqlError(ctx, err)
+	}
+	if err := loadersOf(ctx).spend(1); err != nil {
+		return 0, graphqlError(ctx, err)
+	}
+	count, err := loadersOf(ctx).mutualFriends.Load(ctx, loaderKey(u.email, strings.ToLower(args.With)))()
+	if err != nil {
+		return 0, graphqlError(ctx, err)
+	}
+	return int32(count.(int)), nil
+}
+
+func (u *userResolver) SubscribesTo(ctx context.Context, args struct{ Email string }) (bool, error) {
+	target := strings.ToLower(args.Email)
+	relationships, err := u.relationshipsWith(ctx, target)
+	if err != nil {
+		return false, graphqlError(ctx, err)
+	}
+	for _, r := range relationships {
+		if r.Requestor == u.email && r.Target == target && r.Status == relationshipIsSubscribed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (u *userResolver) RelationshipsWith(ctx context.Context, args struct{ Email string }) ([]*relationshipResolver, error) {
+	relationships, err := u.relationshipsWith(ctx, strings.ToLower(args.Email))
+	if err != nil {
+		return nil, graphqlError(ctx, err)
+	}
+	resolvers := []*relationshipResolver{}
+	for _, r := range relationships {
+		resolvers = append(resolvers, &relationshipResolver{r})
+	}
+	return resolvers, nil
+}
+
+func (u *userResolver) relationshipsWith(ctx context.Context, email string) (relationships, error) {
+	if err := u.private(ctx, email); err != nil {
+		return nil, err
+	}
+	if err := loadersOf(ctx).spend(1); err != nil {
+		return nil, err
+	}
+	loaded, err := loadersOf(ctx).relationships.Load(ctx, loaderKey(u.email, email))()
+	if err != nil {
+		return nil, err
+	}
+	return loaded.(relationships), nil
+}
+
+// connectionPage is the page of a connection a field asks for, the pages of every user in a
+// list share it so they are loaded together
+type connectionPage struct {
+	connection string
+	limit      int
+	after      string
+}
+
+func newConnectionPage(connection string, args connectionArgs) (page connectionPage, err error) {
+	page = connectionPage{connection: connection, limit: defaultPageLimit}
+	if args.First != nil {
+		page.limit = int(*args.First)
+		if page.limit < 1 || page.limit > maxPageLimit {
+			return page, newValidationError("first", fmt.Sprintf("first must be between 1 and %v", maxPageLimit))
+		}
+	}
+	if args.After != nil {
+		after, err := decodeCursor(*args.After)
+		if err != nil {
+			return page, err
+		}
+		if !after.valid(sortByEmail) {
+			return page, newValidationError("cursor", "invalid cursor")
+		}
+		page.after = after.Email
+	}
+	return page, nil
+}
+
+// key identifies the page in a loader key, the cursor goes last as it is the only part that
+// could hold a colon
+func (p connectionPage) key() string {
+	return fmt.Sprintf("%v:%v:%v", p.connection, p.limit, p.after)
+}
+
+func parseConnectionPage(key string) connectionPage {
+	parts := strings.SplitN(key, ":", 3)
+	limit, _ := strconv.Atoi(parts[1])
+	return connectionPage{connection: parts[0], limit: limit, after: parts[2]}
+}
+
+// connectionResolver is a page of a list of users sorted by email, the cursor of an edge is
+// the same opaque cursor the HTTP API hands out
+type connectionResolver struct {
+	users       []string
+	total       int
+	hasNextPage bool
+}
+
+func newConnectionResolver(page pageResult) *connectionResolver {
+	return &connectionResolver{users: page.Items, total: page.Total, hasNextPage: page.NextCursor != ""}
+}
+
+func (c *connectionResolver) TotalCount() int32 {
+	return int32(c.total)
+}
+
+func (c *connectionResolver) Edges() []*edgeResolver {
+	edges := []*edgeResolver{}
+	for _, email := range c.users {
+		edges = append(edges, &edgeResolver{email})
+	}
+	return edges
+}
+
+func (c *connectionResolver) PageInfo() *pageInfoResolver {
+	info := &pageInfoResolver{hasNextPage: c.hasNextPage}
+	if len(c.users) > 0 {
+		cursor := userCursor(c.users[len(c.users)-1])
+		info.endCursor = &cursor
+	}
+	return info
+}
+
+func userCursor(email string) string {
+	return pageCursor{Key: email, Email: email}.encode()
+}
+
+type edgeResolver struct {
+	email string
+}
+
+func (e *edgeResolver) Cursor() string {
+	return userCursor(e.email)
+}
+
+func (e *edgeResolver) Node() *userResolver {
+	return &userResolver{e.email}
+}
+
+type pageInfoResolver struct {
+	hasNextPage bool
+	endCursor   *string
+}
+
+func (p *pageInfoResolver) HasNextPage() bool {
+	return p.hasNextPage
+}
+
+func (p *pageInfoResolver) EndCursor() *string {
+	return p.endCursor
+}
+
+type relationshipResolver struct {
+	relationship relationship
+}
+
+func (r *relationshipResolver) Requestor() *userResolver {
+	return &userResolver{r.relationship.Requestor}
+}
+
+func (r *relationshipResolver) Target() *userResolver {
+	return &userResolver{r.relationship.Target}
+}
+
+func (r *relationshipResolver) Status() string {
+	return r.relationship.Status
+}
+
+type messageResolver struct {
+	message storedMessage
+}
+
+func (m *messageResolver) ID() int32 {
+	return int32(m.message.ID)
+}
+
+func (m *messageResolver) Sender() *userResolver {
+	return &userResolver{m.message.Sender}
+}
+
+func (m *messageResolver) Text() string {
+	return m.message.Text
+}
+
+func (m *messageResolver) ParentID() *int32 {
+	if m.message.ParentID == nil {
+		return nil
+	}
+	id := int32(*m.message.ParentID)
+	return &id
+}
+
+func (m *messageResolver) ThreadID() int32 {
+	return int32(m.message.ThreadID)
+}
+
+func (m *messageResolver) CreatedAt() string {
+	return m.message.CreatedAt.UTC().Format(time.RFC3339)
+}
+
+func (m *messageResolver) Reactions() []*reactionResolver {
+	reactions := []*reactionResolver{}
+	for emoji, count := range m.message.Reactions {
+		reactions = append(reactions, &reactionResolver{emoji, count})
+	}
+	sort.Slice(reactions, func(i, j int) bool { return reactions[i].emoji < reactions[j].emoji })
+	return reactions
+}
+
+type reactionResolver struct {
+	emoji string
+	count int
+}
+
+func (r *reactionResolver) Emoji() string {
+	return r.emoji
+}
+
+func (r *reactionResolver) Count() int32 {
+	return int32(r.count)
+}
+
+type sentMessageResolver struct {
+	message    *messageResolver
+	recipients []string
+}
+
+func (s *sentMessageResolver) Message() *messageResolver {
+	return s.message
+}
+
+func (s *sentMessageResolver) Recipients() []string {
+	if s.recipients == nil {
+		return []string{}
+	}
+	return s.recipients
+}
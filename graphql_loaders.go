@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/graph-gophers/dataloader"
+)
+
+type loadersKey struct{}
+
+// graphqlComplexityBudget is how much a single query may load, a connection costs the size
+// of its page and any other lookup made for a user costs one
+var graphqlComplexityBudget int64 = 10000
+
+var errQueryTooComplex = &apiError{Kind: errorKindValidation, Code: "query_too_complex", Message: "query loads too much at once, ask for smaller pages"}
+
+// graphqlLoaders batch the lookups resolvers make for every user of a list into one query
+// per loader, they live for a single request so nothing is cached across requests and the
+// budget is spent by a single query
+type graphqlLoaders struct {
+	connections   *dataloader.Loader
+	relationships *dataloader.Loader
+	mutualFriends *dataloader.Loader
+	budget        int64
+}
+
+func newGraphQLLoaders(q querier) *graphqlLoaders {
+	return &graphqlLoaders{
+		connections:   dataloader.NewBatchedLoader(loadConnections(q)),
+		relationships: dataloader.NewBatchedLoader(loadRelationships(q)),
+		mutualFriends: dataloader.NewBatchedLoader(loadMutualFriends(q)),
+		budget:        graphqlComplexityBudget,
+	}
+}
+
+// spend takes the cost of a lookup from the budget, resolvers run concurrently so it is atomic
+func (l *graphqlLoaders) spend(cost int) error {
+	if atomic.AddInt64(&l.budget, -int64(cost)) < 0 {
+		return errQueryTooComplex
+	}
+	return nil
+}
+
+func withLoaders(ctx context.Context, loaders *graphqlLoaders) context.Context {
+	return context.WithValue(ctx, loadersKey{}, loaders)
+}
+
+func loadersOf(ctx context.Context) *graphqlLoaders {
+	return ctx.Value(loadersKey{}).(*graphqlLoaders)
+}
+
+// loaderKey joins two values into a single key, \x00 cannot appear in an email
+func loaderKey(a, b string) dataloader.StringKey {
+	return dataloader.StringKey(a + "\x00" + b)
+}
+
+func splitLoaderKey(key dataloader.Key) (string, string) {
+	parts := strings.SplitN(key.String(), "\x00", 2)
+	return parts[0], parts[1]
+}
+
+// loadConnections is keyed by the page of a connection and the owner, it runs one query per page
+func loadConnections(q querier) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		owners := map[string][]string{}
+		for _, key := range keys {
+			page, owner := splitLoaderKey(key)
+			owners[page] = append(owners[page], owner)
+		}
+
+		loaded := map[string]map[string]pageResult{}
+		errs := map[string]error{}
+		for page := range owners {
+			loaded[page], errs[page] = getConnections(ctx, q, parseConnectionPage(page), owners[page])
+		}
+
+		results := make([]*dataloader.Result, len(keys))
+		for i, key := range keys {
+			page, owner := splitLoaderKey(key)
+			results[i] = &dataloader.Result{Data: loaded[page][owner], Error: errs[page]}
+		}
+		return results
+	}
+}
+
+// loadRelationships is keyed by a pair of users
+func loadRelationships(q querier) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		users1, users2 := splitLoaderKeys(keys)
+		pairs, err := getRelationshipsOfPairs(ctx, q, users1, users2)
+
+		results := make([]*dataloader.Result, len(keys))
+		for i := range keys {
+			results[i] = &dataloader.Result{Data: pairs[i], Error: err}
+		}
+		return results
+	}
+}
+
+// loadMutualFriends is keyed by a pair of users
+func loadMutualFriends(q querier) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		users1, users2 := splitLoaderKeys(keys)
+		counts, err := countMutualFriendsOfPairs(ctx, q, users1, users2)
+
+		results := make([]*dataloader.Result, len(keys))
+		for i := range keys {
+			results[i] = &dataloader.Result{Data: counts[i], Error: err}
+		}
+		return results
+	}
+}
+
+func splitLoaderKeys(keys dataloader.Keys) (users1, users2 []string) {
+	for _, key := range keys {
+		user1, user2 := splitLoaderKey(key)
+		users1 = append(users1, user1)
+		users2 = append(users2, user2)
+	}
+	return
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+const (
+	connectionOfFriends   = "friends"
+	connectionOfFollowers = "followers"
+	connectionOfBlocked   = "blocked"
+)
+
+// connectionQueries select the users in a connection of owners.owner, the owner of the row
+// getConnections is at
+var connectionQueries = map[string]string{
+	connectionOfFriends: `
+		SELECT a.target email FROM relationships a
+		INNER JOIN relationships b ON b.requestor = a.target AND b.target = a.requestor AND b.status = $2
+		WHERE a.requestor = owners.owner AND a.status = $2
+	`,
+	connectionOfFollowers: `
+		SELECT requestor email FROM relationships
+		WHERE target = owners.owner AND status = $2
+	`,
+	connectionOfBlocked: `
+		SELECT target email FROM relationships
+		WHERE requestor = owners.owner AND status = $2
+	`,
+}
+
+var connectionStatuses = map[string]string{
+	connectionOfFriends:   relationshipIsFriend,
+	connectionOfFollowers: relationshipIsSubscribed,
+	connectionOfBlocked:   relationshipIsBlocked,
+}
+
+// getConnections loads the same page of a connection for every owner, with the size of the
+// whole connection, one row more than the page tells whether there is a next page. Suspended
+// users are left out like in the other lists
+func getConnections(ctx context.Context, q querier, page connectionPage, owners []string) (connections map[string]pageResult, err error) {
+	ctx, done := measureQuery(ctx, "get_connections")
+	defer done()
+	query := fmt.Sprintf(`
+		SELECT owners.owner, counted.total, page.email
+		FROM unnest($1::varchar[]) AS owners(owner)
+		CROSS JOIN LATERAL (
+			SELECT count(*) total FROM (%[1]v) connection
+			WHERE NOT EXISTS (SELECT 1 FROM suspended_users WHERE email = connection.email)
+		) counted
+		LEFT JOIN LATERAL (
+			SELECT connection.email FROM (%[1]v) connection
+			WHERE connection.email > $3
+				AND NOT EXISTS (SELECT 1 FROM suspended_users WHERE email = connection.email)
+			ORDER BY connection.email
+			LIMIT $4
+		) page ON true
+		ORDER BY owners.owner, page.email
+	`, connectionQueries[page.connection])
+
+	rows, err := q.QueryContext(ctx, query, pq.Array(owners), connectionStatuses[page.connection], page.after, page.limit+1)
+	if err != nil {
+		err = fmt.Errorf("failed to list the %v of users err %w", page.connection, err)
+		return
+	}
+	defer rows.Close()
+
+	connections = map[string]pageResult{}
+	for rows.Next() {
+		var owner string
+		var email sql.NullString
+		result := pageResult{}
+		if err = rows.Scan(&owner, &result.Total, &email); err != nil {
+			return
+		}
+		if loaded, ok := connections[owner]; ok {
+			result = loaded
+		}
+		switch {
+		case !email.Valid:
+		case len(result.Items) == page.limit:
+			result.NextCursor = userCursor(result.Items[page.limit-1])
+		default:
+			result.Items = append(result.Items, email.String)
+		}
+		connections[owner] = result
+	}
+	return connections, rows.Err()
+}
+
+// getRelationshipsOfPairs returns the relationships in either direction between every pair
+// of users, keyed by the index of the pair
+func getRelationshipsOfPairs(ctx context.Context, q querier, users1, users2 []string) (pairs map[int]relationships, err error) {
+	ctx, done := measureQuery(ctx, "get_relationships_of_pairs")
+	defer done()
+	query := `
+		SELECT pairs.i, r.requestor, r.target, r.status
+		FROM unnest($1::varchar[], $2::varchar[]) WITH ORDINALITY AS pairs(a, b, i)
+		INNER JOIN relationships r ON (r.requestor = pairs.a AND r.target = pairs.b)
+			OR (r.requestor = pairs.b AND r.target = pairs.a)
+	`
+
+	rows, err := q.QueryContext(ctx, query, pq.Array(users1), pq.Array(users2))
+	if err != nil {
+		err = fmt.Errorf("failed to check the relationships between users err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	pairs = map[int]relationships{}
+	for rows.Next() {
+		var i int
+		row := relationship{}
+		if err = rows.Scan(&i, &row.Requestor, &row.Target, &row.Status); err != nil {
+			return
+		}
+		pairs[i-1] = append(pairs[i-1], row)
+	}
+	return pairs, rows.Err()
+}
+
+// countMutualFriendsOfPairs counts the friends every pair of users has in common, keyed by
+// the index of the pair
+func countMutualFriendsOfPairs(ctx context.Context, q querier, users1, users2 []string) (counts map[int]int, err error) {
+	ctx, done := measureQuery(ctx, "count_mutual_friends_of_pairs")
+	defer done()
+	query := `
+		/*
+			a and b are the friendships of the first user, c and d those of the second one,
+			a friendship needs the relationship in both directions
+		*/
+
+		SELECT pairs.i, count(DISTINCT d.requestor)
+		FROM unnest($1::varchar[], $2::varchar[]) WITH ORDINALITY AS pairs(first_user, second_user, i)
+		LEFT JOIN relationships a ON a.requestor = pairs.first_user AND a.status = $3
+		LEFT JOIN relationships b ON b.requestor = a.target AND b.target = a.requestor AND b.status = $3
+		LEFT JOIN relationships c ON c.requestor = pairs.second_user AND c.target = b.requestor AND c.status = $3
+		LEFT JOIN relationships d ON d.requestor = c.target AND d.target = c.requestor AND d.status = $3
+		GROUP BY pairs.i
+	`
+
+	rows, err := q.QueryContext(ctx, query, pq.Array(users1), pq.Array(users2), relationshipIsFriend)
+	if err != nil {
+		err = fmt.Errorf("failed to count the mutual friends of users err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	counts = map[int]int{}
+	for rows.Next() {
+		var i, count int
+		if err = rows.Scan(&i, &count); err != nil {
+			return
+		}
+		counts[i-1] = count
+	}
+	return counts, rows.Err()
+}
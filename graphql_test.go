@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingQuerier counts the queries the loaders run
+type countingQuerier struct {
+	querier
+	queries int32
+}
+
+func (c *countingQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	atomic.AddInt32(&c.queries, 1)
+	return c.querier.QueryContext(ctx, query, args...)
+}
+
+type graphqlUser struct {
+	Email             string `json:"email"`
+	MutualFriendCount int    `json:"mutualFriendCount"`
+	SubscribesTo      bool   `json:"subscribesTo"`
+	Friends           struct {
+		TotalCount int `json:"totalCount"`
+	} `json:"friends"`
+}
+
+type graphqlConnection struct {
+	TotalCount int `json:"totalCount"`
+	Edges      []struct {
+		Node graphqlUser `json:"node"`
+	} `json:"edges"`
+	PageInfo struct {
+		HasNextPage bool   `json:"hasNextPage"`
+		EndCursor   string `json:"endCursor"`
+	} `json:"pageInfo"`
+}
+
+func TestGraphQLBatchesRelationshipQueries(t *testing.T) {
+	needsDB(t)
+
+	db.Exec("DELETE FROM relationships")
+	for _, friends := range [][]string{
+		{"andy@example.com", "john@example.com"},
+		{"andy@example.com", "kate@example.com"},
+		{"andy@example.com", "lisa@example.com"},
+		{"john@example.com", "lisa@example.com"},
+		{"kate@example.com", "lisa@example.com"},
+	} {
+		if err := (&user{Friends: friends}).createFriends(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (userRequest{Requestor: "mike@example.com", Target: "andy@example.com"}).subscribeUpdates(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	query := `{
+		user(email: "andy@example.com") {
+			friends {
+				totalCount
+				edges { node { email mutualFriendCount(with: "andy@example.com") subscribesTo(email: "andy@example.com") friends { totalCount } } }
+			}
+			followers(first: 1) {
+				totalCount
+				edges { node { email subscribesTo(email: "andy@example.com") } }
+				pageInfo { hasNextPage endCursor }
+			}
+		}
+	}`
+	counter := &countingQuerier{querier: db}
+	ctx := withIdentity(context.Background(), identity{Email: "admin@example.com", Scopes: []string{scopeAdmin}})
+	response := graphqlSchema.Exec(withLoaders(ctx, newGraphQLLoaders(counter)), query, "", nil)
+	if len(response.Errors) > 0 {
+		t.Fatal(response.Errors)
+	}
+
+	result := struct {
+		User struct {
+			Friends   graphqlConnection `json:"friends"`
+			Followers graphqlConnection `json:"followers"`
+		} `json:"user"`
+	}{}
+	if err := json.Unmarshal(response.Data, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]graphqlUser{
+		"john@example.com": newGraphQLUser("john@example.com", 1, 2),
+		"kate@example.com": newGraphQLUser("kate@example.com", 1, 2),
+		"lisa@example.com": newGraphQLUser("lisa@example.com", 2, 3),
+	}
+
+	friends := result.User.Friends
+	if friends.TotalCount != len(expected) || len(friends.Edges) != len(expected) {
+		t.Fatalf("expecting %v friends but have %v", len(expected), friends.TotalCount)
+	}
+	for _, edge := range friends.Edges {
+		if edge.Node != expected[edge.Node.Email] {
+			t.Errorf("expecting %+v but have %+v", expected[edge.Node.Email], edge.Node)
+		}
+	}
+
+	followers := result.User.Followers
+	if followers.TotalCount != 1 || followers.PageInfo.HasNextPage || len(followers.Edges) != 1 || !followers.Edges[0].Node.SubscribesTo {
+		t.Errorf("expecting mike@example.com to follow andy@example.com but have %+v", followers)
+	}
+
+	// one query per connection kind, then one each for the mutual friends, the relationships and
+	// the friends of friends, however many friends there are
+	if counter.queries > 6 {
+		t.Errorf("expecting at most 6 queries but have %v", counter.queries)
+	}
+}
+
+func newGraphQLUser(email string, mutualFriends, friends int) graphqlUser {
+	u := graphqlUser{Email: email, MutualFriendCount: mutualFriends}
+	u.Friends.TotalCount = friends
+	return u
+}
+
+func TestGraphQLLimitsQueries(t *testing.T) {
+	needsDB(t)
+
+	budget := graphqlComplexityBudget
+	graphqlComplexityBudget = 150
+	defer func() { graphqlComplexityBudget = budget }()
+
+	testSamples := []map[string]interface{}{
+		{ // a page of 200 users is over the budget
+			"query": `{ user(email: "andy@example.com") { friends(first: 200) { totalCount } } }`,
+			"error": "query loads too much at once, ask for smaller pages",
+		},
+		{ // nested deeper than the schema allows
+			"query": `{ user(email: "andy@example.com") { friends { edges { node { friends { edges { node { friends { edges { node { email } } } } } } } } } } }`,
+			"error": "exceeds max depth",
+		},
+	}
+	for _, testSample := range testSamples {
+		response := graphqlSchema.Exec(withLoaders(context.Background(), newGraphQLLoaders(db)), testSample["query"].(string), "", nil)
+		if len(response.Errors) == 0 || !strings.Contains(response.Errors[0].Message, testSample["error"].(string)) {
+			t.Errorf("expecting %v but have %v", testSample["error"], response.Errors)
+		}
+	}
+}
+
+func TestGraphQLHidesPrivateFields(t *testing.T) {
+	needsDB(t)
+
+	ctx := withIdentity(context.Background(), identity{Email: "andy@example.com"})
+	for _, query := range []string{
+		`{ user(email: "john@example.com") { friends { totalCount } } }`,
+		`{ user(email: "john@example.com") { mutualFriendCount(with: "lisa@example.com") } }`,
+		`{ user(email: "john@example.com") { followers { totalCount } } }`,
+		`{ user(email: "john@example.com") { blocked { totalCount } } }`,
+		`{ user(email: "john@example.com") { relationshipsWith(email: "lisa@example.com") { status } } }`,
+	} {
+		response := graphqlSchema.Exec(withLoaders(ctx, newGraphQLLoaders(db)), query, "", nil)
+		if len(response.Errors) == 0 || response.Errors[0].Message != "cannot act on behalf of john@example.com" {
+			t.Errorf("expecting %v to be forbidden but have %v", query, response.Errors)
+		}
+	}
+}
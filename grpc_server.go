@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"app/friendspb"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const grpcErrorDomain = "friends"
+
+var grpcStatusCodes = map[errorKind]codes.Code{
+	errorKindInternal:   codes.Internal,
+	errorKindBadRequest: codes.InvalidArgument,
+	errorKindValidation: codes.InvalidArgument,
+	errorKindNotFound:   codes.NotFound,
+	errorKindConflict:   codes.AlreadyExists,
+	errorKindBlocked:    codes.FailedPrecondition,
+
+	errorKindTooLarge:             codes.ResourceExhausted,
+	errorKindUnsupportedMediaType: codes.InvalidArgument,
+	errorKindUnauthorized:         codes.Unauthenticated,
+	errorKindForbidden:            codes.PermissionDenied,
+	errorKindRateLimited:          codes.ResourceExhausted,
+	errorKindTimeout:              codes.DeadlineExceeded,
+}
+
+// friendsServer serves the FriendsService with the same domain methods as the HTTP handlers
+type friendsServer struct {
+	friendspb.UnimplementedFriendsServiceServer
+}
+
+// grpcReadMethods are limited as reads, every other method as a write
+var grpcReadMethods = map[string]bool{
+	friendspb.FriendsService_ListFriends_FullMethodName:       true,
+	friendspb.FriendsService_ListCommonFriends_FullMethodName: true,
+	friendspb.FriendsService_ListRecipients_FullMethodName:    true,
+	friendspb.FriendsService_StreamRecipients_FullMethodName:  true,
+}
+
+// newGRPCServer limits the calls with the buckets of the HTTP API, by peer IP before they are
+// authenticated and by user after
+func newGRPCServer(store rateLimitStore, options ...grpc.ServerOption) *grpc.Server {
+	options = append(options,
+		grpc.ChainUnaryInterceptor(grpcTraceUnary, grpcRateLimitUnary(store, grpcRateLimitByIP), grpcAuthUnary, grpcRateLimitUnary(store, grpcRateLimitByUser)),
+		grpc.ChainStreamInterceptor(grpcTraceStream, grpcRateLimitStream(store, grpcRateLimitByIP), grpcAuthStream, grpcRateLimitStream(store, grpcRateLimitByUser)),
+	)
+	server := grpc.NewServer(options...)
+	friendspb.RegisterFriendsServiceServer(server, friendsServer{})
+	return server
+}
+
+func startGRPCServer(server *grpc.Server, port string) {
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		fatal("failed to listen for grpc", err)
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			fatal("grpc server failed", err)
+		}
+	}()
+}
+
+// grpcAuthenticate reads the same credentials as the HTTP API from the x-api-key and
+// authorization metadata
+func grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	id, err := authenticateCredentials(ctx, first(strings.ToLower(apiKeyHeader)), strings.TrimPrefix(first("authorization"), "Bearer "))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return withCaller(withIdentity(ctx, id), id.Email), nil
+}
+
+// grpcTraceUnary starts the span of a call, the trace context is read from the metadata, and
+// gives the call a logger that carries its method
+func grpcTraceUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx, span := startGRPCSpan(withLogger(ctx, loggerOf(ctx).With("method", info.FullMethod)), info.FullMethod)
+	defer func() { endSpan(span, err) }()
+	return handler(ctx, req)
+}
+
+func grpcTraceStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, span := startGRPCSpan(withLogger(stream.Context(), loggerOf(stream.Context()).With("method", info.FullMethod)), info.FullMethod)
+	defer func() { endSpan(span, err) }()
+	return handler(srv, authenticatedStream{stream, ctx})
+}
+
+func grpcAuthUnary(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authenticatedStream hands the context holding the identity and the span to streaming methods
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcAuthStream(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, authenticatedStream{stream, ctx})
+}
+
+// grpcLimitRate spends a token of the bucket keyOf returns for the call
+func grpcLimitRate(ctx context.Context, store rateLimitStore, keyOf func(ctx context.Context) string, method string) error {
+	class := rateLimitWrite
+	if grpcReadMethods[method] {
+		class = rateLimitRead
+	}
+	decision, _ := spendRateToken(store, class, keyOf(ctx))
+	if decision != nil && !decision.Allowed {
+		return grpcError(ctx, rateLimitedError(class, *decision))
+	}
+	return nil
+}
+
+func grpcRateLimitUnary(store rateLimitStore, keyOf func(ctx context.Context) string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := grpcLimitRate(ctx, store, keyOf, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func grpcRateLimitStream(store rateLimitStore, keyOf func(ctx context.Context) string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := grpcLimitRate(stream.Context(), store, keyOf, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// grpcRateLimitByIP keys the buckets by the IP of the peer, the same buckets as rateLimitByIP
+func grpcRateLimitByIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return "ip:" + host
+}
+
+func grpcRateLimitByUser(ctx context.Context) string {
+	if id, ok := identityOf(ctx); ok {
+		return "user:" + id.Email
+	}
+	return ""
+}
+
+func (friendsServer) CreateFriends(ctx context.Context, req *friendspb.CreateFriendsRequest) (*emptypb.Empty, error) {
+	friends := &user{Friends: req.Friends}
+	if err := authorize(ctx, friends.actor()); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	if err := friends.createFriends(ctx, db); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (friendsServer) ListFriends(ctx context.Context, req *friendspb.ListFriendsRequest) (*friendspb.ListFriendsResponse, error) {
+	if err := authorize(ctx, req.Email); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	page, err := grpcPageRequest(req.Page)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	user := &user{Email: req.Email, Page: page}
+	if err := user.getFriends(ctx); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return listFriendsResponse(user), nil
+}
+
+func (friendsServer) ListCommonFriends(ctx context.Context, req *friendspb.ListCommonFriendsRequest) (*friendspb.ListFriendsResponse, error) {
+	if err := authorizeAny(ctx, req.Friends...); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	page, err := grpcPageRequest(req.Page)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	friends := &user{Friends: req.Friends, Page: page}
+	if err := friends.getCommonFriends(ctx); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return listFriendsResponse(friends), nil
+}
+
+func (friendsServer) Subscribe(ctx context.Context, req *friendspb.RelationshipRequest) (*emptypb.Empty, error) {
+	if err := authorize(ctx, req.Requestor); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	userRequest := userRequest{Requestor: req.Requestor, Target: req.Target}
+	if err := userRequest.subscribeUpdates(ctx, db); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (friendsServer) Block(ctx context.Context, req *friendspb.RelationshipRequest) (*emptypb.Empty, error) {
+	if err := authorize(ctx, req.Requestor); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	userRequest := userRequest{Requestor: req.Requestor, Target: req.Target}
+	if err := userRequest.blockUpdates(ctx, db); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (friendsServer) ListRecipients(ctx context.Context, req *friendspb.ListRecipientsRequest) (*friendspb.ListRecipientsResponse, error) {
+	if err := authorize(ctx, req.Sender); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	page, err := grpcPageRequest(req.Page)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	message := message{Sender: req.Sender, Text: req.Text, Page: page}
+	user, err := message.getRecipients(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &friendspb.ListRecipientsResponse{
+		Recipients: user.listSubscribers(),
+		Total:      int32(user.getTotal()),
+		NextCursor: user.getNextCursor(),
+	}, nil
+}
+
+func (friendsServer) StreamRecipients(req *friendspb.ListRecipientsRequest, stream friendspb.FriendsService_StreamRecipientsServer) error {
+	if err := authorize(stream.Context(), req.Sender); err != nil {
+		return grpcError(stream.Context(), err)
+	}
+	message := message{Sender: req.Sender, Text: req.Text}
+	err := message.eachRecipient(stream.Context(), func(recipient string) error {
+		return stream.Send(&friendspb.Recipient{Email: recipient})
+	})
+	if err != nil {
+		return grpcError(stream.Context(), err)
+	}
+	return nil
+}
+
+func grpcPageRequest(page *friendspb.PageRequest) (pageRequest, error) {
+	if page == nil {
+		return defaultPage, nil
+	}
+	return newPageRequest(int(page.Limit), page.Cursor, page.Sort, page.Order)
+}
+
+func listFriendsResponse(u *user) *friendspb.ListFriendsResponse {
+	return &friendspb.ListFriendsResponse{
+		Friends:    u.listFriends(),
+		Count:      int32(u.getCount()),
+		Total:      int32(u.getTotal()),
+		NextCursor: u.getNextCursor(),
+	}
+}
+
+// grpcError turns a domain error into a status with the error code of the HTTP API as the reason
+// of its ErrorInfo, errors that are already a status are returned as is
+func grpcError(ctx context.Context, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	apiErr := toAPIError(err)
+	if apiErr.Kind == errorKindInternal {
+		loggerOf(ctx).Error("internal error", "err", err)
+	}
+	st := status.New(grpcStatusCodes[apiErr.Kind], apiErr.Message)
+	detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{Reason: apiErr.Code, Domain: grpcErrorDomain})
+	if detailErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"app/friendspb"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func dialFriendsService(t *testing.T) friendspb.FriendsServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer(newMemoryRateLimitStore())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}
+	conn, err := grpc.DialContext(context.Background(), "bufnet", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return friendspb.NewFriendsServiceClient(conn)
+}
+
+// errorReason returns the status code and the error code of the HTTP API carried by err
+func errorReason(err error) (codes.Code, string) {
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return st.Code(), info.Reason
+		}
+	}
+	return st.Code(), ""
+}
+
+func TestFriendsService(t *testing.T) {
+	needsDB(t)
+
+	db.Exec("DELETE FROM relationships")
+	db.Exec("DELETE FROM api_keys")
+	if err := ensureAPIKey(context.Background(), "admin@example.com", hashAPIKey("grpc-admin-key"), []string{scopeAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureAPIKey(context.Background(), "andy@example.com", hashAPIKey("grpc-andy-key"), []string{}); err != nil {
+		t.Fatal(err)
+	}
+	client := dialFriendsService(t)
+
+	_, err := client.Subscribe(context.Background(), &friendspb.RelationshipRequest{Requestor: "andy@example.com", Target: "kate@example.com"})
+	if code, _ := errorReason(err); code != codes.Unauthenticated {
+		t.Errorf("expecting %v without credentials but have %v", codes.Unauthenticated, code)
+	}
+	andy := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "grpc-andy-key")
+	_, err = client.Subscribe(andy, &friendspb.RelationshipRequest{Requestor: "kate@example.com", Target: "andy@example.com"})
+	if code, reason := errorReason(err); code != codes.PermissionDenied || reason != "forbidden" {
+		t.Errorf("expecting %v forbidden but have %v %v", codes.PermissionDenied, code, reason)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "grpc-admin-key")
+
+	if _, err := client.CreateFriends(ctx, &friendspb.CreateFriendsRequest{Friends: []string{"andy@example.com", "john@example.com"}}); err != nil {
+		t.Fatalf("failed to create friends %v", err)
+	}
+	_, err = client.CreateFriends(ctx, &friendspb.CreateFriendsRequest{Friends: []string{"john@example.com", "andy@example.com"}})
+	if code, reason := errorReason(err); code != codes.AlreadyExists || reason != "already_friends" {
+		t.Errorf("expecting %v already_friends but have %v %v", codes.AlreadyExists, code, reason)
+	}
+	_, err = client.CreateFriends(ctx, &friendspb.CreateFriendsRequest{Friends: []string{"andy@example.com"}})
+	if code, reason := errorReason(err); code != codes.InvalidArgument || reason != "validation_failed" {
+		t.Errorf("expecting %v validation_failed but have %v %v", codes.InvalidArgument, code, reason)
+	}
+
+	if _, err := client.Subscribe(ctx, &friendspb.RelationshipRequest{Requestor: "lisa@example.com", Target: "andy@example.com"}); err != nil {
+		t.Fatalf("failed to subscribe %v", err)
+	}
+	if _, err := client.Block(ctx, &friendspb.RelationshipRequest{Requestor: "sean@example.com", Target: "andy@example.com"}); err != nil {
+		t.Fatalf("failed to block %v", err)
+	}
+
+	friends, err := client.ListFriends(ctx, &friendspb.ListFriendsRequest{Email: "andy@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(friends.Friends, ",") != "john@example.com" || friends.Total != 1 {
+		t.Errorf("expecting [john@example.com] but have %v", friends.Friends)
+	}
+
+	_, err = client.ListFriends(ctx, &friendspb.ListFriendsRequest{Email: "andy@example.com", Page: &friendspb.PageRequest{Sort: "name"}})
+	if code, _ := errorReason(err); code != codes.InvalidArgument {
+		t.Errorf("expecting %v for an invalid sort but have %v", codes.InvalidArgument, code)
+	}
+
+	expected := "john@example.com,kate@example.com,lisa@example.com"
+	recipients, err := client.ListRecipients(ctx, &friendspb.ListRecipientsRequest{Sender: "andy@example.com", Text: "hello kate@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(recipients.Recipients)
+	if strings.Join(recipients.Recipients, ",") != expected {
+		t.Errorf("expecting %v but have %v", expected, recipients.Recipients)
+	}
+
+	stream, err := client.StreamRecipients(ctx, &friendspb.ListRecipientsRequest{Sender: "andy@example.com", Text: "hello kate@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed := []string{}
+	for {
+		recipient, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed = append(streamed, recipient.Email)
+	}
+	sort.Strings(streamed)
+	if strings.Join(streamed, ",") != expected {
+		t.Errorf("expecting %v streamed but have %v", expected, streamed)
+	}
+}
@@ -1,92 +1,348 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"net/http"
+	"strconv"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 func createFriendsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	bodyBytes, _ := ioutil.ReadAll(r.Body)
-	friends := &user{}
-	if err := json.Unmarshal(bodyBytes, friends); err != nil {
-		w.Write(makeSimpleResponse(fmt.Sprintf("invalid data err: %v", err)))
+	request := friendsRequest{}
+	if err := decodeV1JSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	friends := &user{Friends: request.Friends}
+	if err := authorize(r.Context(), friends.actor()); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	err := friends.createFriends()
-	w.Write(makeNewResponse(friends, err))
+	err := friends.createFriends(r.Context(), db)
+	writeResponse(w, makeNewResponse(friends, err), err)
 }
 
 func getFriendsListHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	bodyBytes, _ := ioutil.ReadAll(r.Body)
-	user := &user{}
-	if err := json.Unmarshal(bodyBytes, &user); err != nil {
-		w.Write(makeSimpleResponse(fmt.Sprintf("invalid data err: %v", err)))
+	request := emailRequest{}
+	if err := decodeV1JSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	user := &user{Email: request.Email}
+	if err := authorize(r.Context(), user.Email); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, err := parseListRequest(r)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+	user.Page = page
 
-	err := user.getFriends()
-	w.Write(makeNewResponse(user, err))
+	err = user.getFriends(r.Context())
+	writeResponse(w, makeNewResponse(user, err), err)
 }
 
 func getCommonFriendsListHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	bodyBytes, _ := ioutil.ReadAll(r.Body)
-	friends := &user{}
-	if err := json.Unmarshal(bodyBytes, &friends); err != nil {
-		w.Write(makeSimpleResponse(fmt.Sprintf("invalid data err: %v", err)))
+	request := friendsRequest{}
+	if err := decodeV1JSON(w, r, &request); err != nil {
+		writeError(w, err)
 		return
 	}
+	friends := &user{Friends: request.Friends}
+	if err := authorizeAny(r.Context(), friends.Friends...); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, err := parseListRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	friends.Page = page
 
-	err := friends.getCommonFriends()
-	w.Write(makeNewResponse(friends, err))
+	err = friends.getCommonFriends(r.Context())
+	writeResponse(w, makeNewResponse(friends, err), err)
 }
 
 func subscribeUpdatesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	bodyBytes, _ := ioutil.ReadAll(r.Body)
 	userRequest := &userRequest{}
-	if err := json.Unmarshal(bodyBytes, &userRequest); err != nil {
-		w.Write(makeSimpleResponse(fmt.Sprintf("invalid data err: %v", err)))
+	if err := decodeV1JSON(w, r, userRequest); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorize(r.Context(), userRequest.Requestor); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	err := userRequest.subscribeUpdates()
+	err := userRequest.subscribeUpdates(r.Context(), db)
 	if err != nil {
-		w.Write(makeSimpleResponse(err.Error()))
+		writeError(w, err)
 		return
 	}
 
-	w.Write(makeSimpleResponse(""))
+	writeResponse(w, makeSimpleResponse(nil), nil)
 }
 
 func blockUpdatesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	bodyBytes, _ := ioutil.ReadAll(r.Body)
 	userRequest := &userRequest{}
-	if err := json.Unmarshal(bodyBytes, &userRequest); err != nil {
-		w.Write(makeSimpleResponse(fmt.Sprintf("invalid data err: %v", err)))
+	if err := decodeV1JSON(w, r, userRequest); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorize(r.Context(), userRequest.Requestor); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	err := userRequest.blockUpdates()
+	err := userRequest.blockUpdates(r.Context(), db)
 	if err != nil {
-		w.Write(makeSimpleResponse(err.Error()))
+		writeError(w, err)
 		return
 	}
 
-	w.Write(makeSimpleResponse(""))
+	writeResponse(w, makeSimpleResponse(nil), nil)
 }
 
 func getSubscribedListHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	bodyBytes, _ := ioutil.ReadAll(r.Body)
 	message := message{}
-	if err := json.Unmarshal(bodyBytes, &message); err != nil {
-		w.Write(makeSimpleResponse(fmt.Sprintf("invalid data err: %v", err)))
+	if err := decodeV1JSON(w, r, &message); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorize(r.Context(), message.Sender); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, err := parseListRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	message.Page = page
+
+	user, err := message.getRecipients(r.Context())
+	writeResponse(w, makeNewResponse(&user, err), err)
+}
+
+func registerWebhookHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	request := webhookRequest{}
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	newWebhook := webhook{URL: request.URL, Events: request.Events, Secret: request.Secret}
+
+	if err := newWebhook.register(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeWebhookResponse([]webhook{newWebhook}, nil, nil), nil)
+}
+
+func getWebhooksHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	webhooks, err := getWebhooks(r.Context())
+	writeResponse(w, makeWebhookResponse(webhooks, nil, err), err)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	if err := deleteWebhook(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeSimpleResponse(nil), nil)
+}
+
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	webhook := webhook{ID: id}
+	deliveries, err := webhook.listDeliveries(r.Context())
+	writeResponse(w, makeWebhookResponse(nil, deliveries, err), err)
+}
+
+func retryWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	deliveryID, _ := strconv.Atoi(ps.ByName("delivery"))
+	webhook := webhook{ID: id}
+	if err := webhook.retryDelivery(r.Context(), deliveryID); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeSimpleResponse(nil), nil)
+}
+
+func saveDeliveryPreferenceHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	preference := deliveryPreference{}
+	if err := decodeJSON(w, r, &preference); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorize(r.Context(), preference.Email); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := preference.save(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeSimpleResponse(nil), nil)
+}
+
+func getDigestsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user := &user{Email: r.URL.Query().Get("email")}
+	if err := authorize(r.Context(), user.Email); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	digests, err := user.getDigests(r.Context())
+	writeResponse(w, makeDigestResponse(digests, err), err)
+}
+
+func previewMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	request := previewRequest{}
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorize(r.Context(), request.Sender); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	preview, err := request.message.preview(r.Context(), request.SecondDegree)
+	writeResponse(w, makePreviewResponse(preview, err), err)
+}
+
+func postMessageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	message := message{}
+	if err := decodeJSON(w, r, &message); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorize(r.Context(), message.Sender); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	stored, recipients, err := message.post(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeMessageResponse([]storedMessage{stored}, recipients.listSubscribers(), nil), nil)
+}
+
+func postReplyHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	reply := reply{}
+	if err := decodeJSON(w, r, &reply); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorize(r.Context(), reply.Sender); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	stored, err := reply.post(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeMessageResponse([]storedMessage{stored}, nil, nil), nil)
+}
+
+func getThreadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	viewer := r.URL.Query().Get("email")
+	if err := authorize(r.Context(), viewer); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	messages, err := getThread(r.Context(), id, viewer)
+	writeResponse(w, makeMessageResponse(messages, nil, err), err)
+}
+
+func addReactionHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	reaction := reaction{}
+	if err := decodeJSON(w, r, &reaction); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorize(r.Context(), reaction.Email); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := reaction.add(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeSimpleResponse(nil), nil)
+}
+
+func removeReactionHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	reaction := reaction{}
+	if err := decodeJSON(w, r, &reaction); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorize(r.Context(), reaction.Email); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	user, err := message.getSubscribers()
-	w.Write(makeNewResponse(&user, err))
+	if err := reaction.remove(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeSimpleResponse(nil), nil)
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	batch := batch{}
+	if err := decodeJSON(w, r, &batch); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	for _, op := range batch.Operations {
+		if err := authorize(r.Context(), op.Requestor); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	results, err := batch.run(r.Context())
+	writeResponse(w, makeBatchResponse(results, err), err)
+}
+
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	request := apiKeyRequest{}
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	key := apiKey{Email: request.Email, Scopes: request.Scopes}
+
+	err := key.create(r.Context())
+	writeResponse(w, makeAPIKeyResponse(key, err), err)
+}
+
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	if err := revokeAPIKey(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeSimpleResponse(nil), nil)
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// the admin handlers serve trust and safety, every action they take is audited
+
+func getRelationshipRowsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rows, err := listRelationshipRows(r.Context(), r.URL.Query().Get("email"))
+	writeResponse(w, makeAdminResponse(&handlerResponse{Relationships: rows, Count: len(rows)}, err), err)
+}
+
+// exportTrailer ends an export and tells the client whether it got every row
+type exportTrailer struct {
+	End   bool   `json:"end"`
+	Count int    `json:"count"`
+	Error string `json:"error,omitempty"`
+}
+
+// exportRelationshipsHandler streams the relationships as JSON lines and ends them with the trailer
+func exportRelationshipsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	trailer := exportTrailer{End: true}
+	encoder := json.NewEncoder(w)
+	err := exportRelationshipRows(r.Context(), func(row relationshipRow) error {
+		trailer.Count++
+		return encoder.Encode(row)
+	})
+	if err != nil && trailer.Count == 0 {
+		writeError(w, err)
+		return
+	}
+	if err != nil {
+		noteError(w, err)
+		trailer.Error = toAPIError(err).Message
+	}
+	encoder.Encode(trailer)
+}
+
+func removeRelationshipsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := removeRelationships(r.Context(), []string{ps.ByName("email"), ps.ByName("other")})
+	writeResponse(w, makeSimpleResponse(err), err)
+}
+
+func suspendUserHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	request := suspendRequest{}
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	suspension := suspension{Email: ps.ByName("email"), Reason: request.Reason}
+	err := suspension.suspend(r.Context())
+	writeResponse(w, makeAdminResponse(&handlerResponse{Suspension: &suspension}, err), err)
+}
+
+func unsuspendUserHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := unsuspend(r.Context(), ps.ByName("email"))
+	writeResponse(w, makeSimpleResponse(err), err)
+}
+
+func unblockHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	request := unblockRequest{}
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	removed, err := request.unblock(r.Context())
+	writeResponse(w, makeAdminResponse(&handlerResponse{Count: removed}, err), err)
+}
+
+func getAuditLogHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	limit := defaultAuditLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxPageLimit {
+			writeError(w, newValidationError("limit", fmt.Sprintf("limit must be between 1 and %v", maxPageLimit)))
+			return
+		}
+	}
+
+	entries, err := getAuditLog(r.Context(), limit)
+	writeResponse(w, makeAdminResponse(&handlerResponse{AuditLog: entries, Count: len(entries)}, err), err)
+}
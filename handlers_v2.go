@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// the v2 handlers take their input from the path and query string instead of the body of
+// GET requests, they share the domain methods and responses with their v1 counterparts
+
+func getFriendsListV2Handler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := authorize(r.Context(), ps.ByName("email")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, err := parsePageRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user := &user{Email: ps.ByName("email"), Page: page}
+	err = user.getFriends(r.Context())
+	writeResponse(w, makeNewResponse(user, err), err)
+}
+
+func getCommonFriendsListV2Handler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := authorizeAny(r.Context(), ps.ByName("email"), ps.ByName("other")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, err := parsePageRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	friends := &user{Friends: []string{ps.ByName("email"), ps.ByName("other")}, Page: page}
+	err = friends.getCommonFriends(r.Context())
+	writeResponse(w, makeNewResponse(friends, err), err)
+}
+
+func getRecipientsV2Handler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := authorize(r.Context(), ps.ByName("email")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, err := parsePageRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	message := message{Sender: ps.ByName("email"), Text: r.URL.Query().Get("text"), Page: page}
+	user, err := message.getRecipients(r.Context())
+	writeResponse(w, makeNewResponse(&user, err), err)
+}
+
+func createFriendsV2Handler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := authorize(r.Context(), ps.ByName("email")); err != nil {
+		writeError(w, err)
+		return
+	}
+	friends := &user{Friends: []string{ps.ByName("email"), ps.ByName("friend")}}
+	err := friends.createFriends(r.Context(), db)
+	writeResponse(w, makeNewResponse(friends, err), err)
+}
+
+func subscribeUpdatesV2Handler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := authorize(r.Context(), ps.ByName("email")); err != nil {
+		writeError(w, err)
+		return
+	}
+	userRequest := userRequest{Requestor: ps.ByName("email"), Target: ps.ByName("target")}
+	if err := userRequest.subscribeUpdates(r.Context(), db); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeSimpleResponse(nil), nil)
+}
+
+func blockUpdatesV2Handler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := authorize(r.Context(), ps.ByName("email")); err != nil {
+		writeError(w, err)
+		return
+	}
+	userRequest := userRequest{Requestor: ps.ByName("email"), Target: ps.ByName("target")}
+	if err := userRequest.blockUpdates(r.Context(), db); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, makeSimpleResponse(nil), nil)
+}
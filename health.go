@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// schemaVersion is the latest migration, the server is not ready until the database is migrated
+	// to it or past it, a newer schema is left by a rollout that is not over yet
+	schemaVersion int64 = 20180921100000
+
+	// readinessTimeout bounds each database query of a readiness check
+	readinessTimeout = 2 * time.Second
+)
+
+// healthStatus is all /healthz and /readyz tell, they are served without credentials
+type healthStatus struct {
+	Status string `json:"status"`
+}
+
+// readiness tells whether the server can take traffic and which check failed otherwise
+type readiness struct {
+	Status     string          `json:"status"`
+	Database   databaseHealth  `json:"database"`
+	Migrations migrationHealth `json:"migrations"`
+	Workers    []workerHealth  `json:"workers"`
+}
+
+type databaseHealth struct {
+	OK        bool   `json:"ok"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type migrationHealth struct {
+	OK       bool   `json:"ok"`
+	Version  int64  `json:"version"`
+	Expected int64  `json:"expected"`
+	Dirty    bool   `json:"dirty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type workerHealth struct {
+	workerStatus
+	OK bool `json:"ok"`
+}
+
+// checkReadiness pings the database, compares its schema version and looks for stopped
+// or stuck workers
+func checkReadiness(ctx context.Context) readiness {
+	r := readiness{Status: "ready", Workers: []workerHealth{}}
+
+	started := time.Now()
+	pingCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	err := db.PingContext(pingCtx)
+	cancel()
+	r.Database = databaseHealth{OK: err == nil, LatencyMS: time.Since(started).Milliseconds()}
+	if err != nil {
+		r.Database.Error = err.Error()
+	}
+
+	r.Migrations = migrationHealth{Expected: schemaVersion}
+	queryCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	err = db.QueryRowContext(queryCtx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&r.Migrations.Version, &r.Migrations.Dirty)
+	cancel()
+	switch {
+	case err == sql.ErrNoRows:
+		r.Migrations.Error = "database is not migrated"
+	case err != nil:
+		r.Migrations.Error = err.Error()
+	case r.Migrations.Dirty:
+		r.Migrations.Error = "last migration failed"
+	case r.Migrations.Version < schemaVersion:
+		r.Migrations.Error = "database is behind the expected version"
+	default:
+		r.Migrations.OK = true
+	}
+
+	now := time.Now()
+	workersOK := true
+	for _, status := range workers.status() {
+		ok := !status.Stopped && !status.stale(now)
+		workersOK = workersOK && ok
+		r.Workers = append(r.Workers, workerHealth{status, ok})
+	}
+
+	if !r.Database.OK || !r.Migrations.OK || !workersOK {
+		r.Status = "not_ready"
+	}
+	return r
+}
+
+// healthzHandler tells that the process is up, it does not look at its dependencies
+func healthzHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeHealth(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// readyzHandler only answers ready or not_ready, the failed checks are logged as their
+// errors would tell the database and worker setup to anyone
+func readyzHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	readiness := checkReadiness(r.Context())
+	status := http.StatusOK
+	if readiness.Status != "ready" {
+		status = http.StatusServiceUnavailable
+		loggerOf(r.Context()).Warn("server is not ready", "database", readiness.Database, "migrations", readiness.Migrations, "workers", readiness.Workers)
+	}
+	writeHealth(w, status, healthStatus{Status: readiness.Status})
+}
+
+func writeHealth(w http.ResponseWriter, status int, body interface{}) {
+	out, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(out)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSchemaVersion fails when a migration is added without bumping schemaVersion
+func TestSchemaVersion(t *testing.T) {
+	files, err := filepath.Glob("migrations/*.up.sql")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no migrations found err %v", err)
+	}
+	latest := int64(0)
+	for _, file := range files {
+		version, err := strconv.ParseInt(strings.SplitN(filepath.Base(file), "_", 2)[0], 10, 64)
+		if err != nil {
+			t.Fatalf("migration %v has no version", file)
+		}
+		if version > latest {
+			latest = version
+		}
+	}
+	if latest != schemaVersion {
+		t.Errorf("expecting schemaVersion %v to be the latest migration %v", schemaVersion, latest)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	needsDB(t)
+
+	if r := checkReadiness(context.Background()); r.Status != "ready" || !r.Database.OK || !r.Migrations.OK {
+		t.Fatalf("expected the test database to be ready, got %+v", r)
+	}
+
+	defer func(w *workerGroup) { workers = w }(workers)
+	workers = newWorkerGroup()
+	release := make(chan struct{})
+	workers.every("stuck", time.Millisecond, func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	defer workers.shutdown(context.Background())
+	defer close(release)
+	workers.mu.Lock()
+	workers.statuses["stuck"].LastRun = time.Now().Add(-time.Hour)
+	workers.mu.Unlock()
+
+	r := checkReadiness(context.Background())
+	if r.Status != "not_ready" || len(r.Workers) != 1 || r.Workers[0].OK {
+		t.Errorf("expected a stuck worker to fail readiness, got %+v", r)
+	}
+
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil), nil)
+	if w.Code != http.StatusServiceUnavailable || strings.TrimSpace(w.Body.String()) != `{"status":"not_ready"}` {
+		t.Errorf("expected the public answer to leave out the failed checks, got %v %v", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	idempotencyKeyInFlight    = 0
+	idempotencyKeyPurgePeriod = time.Hour
+)
+
+var (
+	// idempotencyKeyTTL is how long a response is replayed for, set with IDEMPOTENCY_KEY_TTL
+	idempotencyKeyTTL = 24 * time.Hour
+	// idempotencyKeyLease is how long a key is held while its first request runs
+	idempotencyKeyLease = 2 * time.Minute
+
+	errIdempotencyKeyReused   = &apiError{Kind: errorKindValidation, Code: "idempotency_key_reused", Message: "idempotency key was already used with a different request"}
+	errIdempotencyKeyInFlight = newConflictError("idempotency_key_in_flight", "a request with this idempotency key is still in progress")
+)
+
+// idempotentResponse is the response stored for a key, StatusCode is idempotencyKeyInFlight until it is stored
+type idempotentResponse struct {
+	RequestHash string
+	StatusCode  int
+	Body        []byte
+}
+
+// responseRecorder keeps a copy of what the handler writes so it can be stored
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// idempotent replays the first response to a request carrying an Idempotency-Key header
+func idempotent(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			h(w, r, ps)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, newValidationError(idempotencyKeyHeader, "idempotency key is too long"))
+			return
+		}
+
+		bodyBytes, err := readBody(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+		hash := hashRequest(r, bodyBytes)
+		caller := callerOf(r)
+
+		reserved, err := reserveIdempotencyKey(r.Context(), caller, key, hash, idempotencyKeyLease)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !reserved {
+			replayIdempotentResponse(r.Context(), w, caller, key, hash)
+			return
+		}
+
+		// the key is released even when the request ran out of time or the handler panicked
+		ctx := context.WithoutCancel(r.Context())
+		returned := false
+		defer func() {
+			if !returned {
+				if err := releaseIdempotencyKey(ctx, caller, key); err != nil {
+					loggerOf(ctx).Error("failed to release idempotency key", "key", key, "err", err)
+				}
+			}
+		}()
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		h(recorder, r, ps)
+		returned = true
+
+		// server errors are not stored so that a retry gets another chance
+		if recorder.statusCode >= http.StatusInternalServerError {
+			err = releaseIdempotencyKey(ctx, caller, key)
+		} else {
+			err = saveIdempotentResponse(ctx, caller, key, recorder.statusCode, recorder.body.Bytes(), idempotencyKeyTTL)
+		}
+		if err != nil {
+			loggerOf(r.Context()).Error("failed to store the response for idempotency key", "key", key, "err", err)
+		}
+	}
+}
+
+func replayIdempotentResponse(ctx context.Context, w http.ResponseWriter, caller, key, hash string) {
+	stored, err := getIdempotentResponse(ctx, caller, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if stored.RequestHash != hash {
+		writeError(w, errIdempotencyKeyReused)
+		return
+	}
+	if stored.StatusCode == idempotencyKeyInFlight {
+		writeError(w, errIdempotencyKeyInFlight)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(stored.StatusCode)
+	w.Write(stored.Body)
+}
+
+// hashRequest identifies a request by its method, path and body
+func hashRequest(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// callerOf is the authenticated user, or the remote host of anonymous requests
+func callerOf(r *http.Request) string {
+	if id, ok := identityOf(r.Context()); ok {
+		return id.Email
+	}
+	return clientIP(r)
+}
+
+func startIdempotencyKeyPurge() {
+	workers.every("idempotency_keys", idempotencyKeyPurgePeriod, func(ctx context.Context) error {
+		return deleteExpiredIdempotencyKeys(ctx, time.Now())
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// reserveIdempotencyKey claims the key until the lease runs out, false means an earlier request holds it
+func reserveIdempotencyKey(ctx context.Context, caller, key, hash string, lease time.Duration) (bool, error) {
+	ctx, done := measureQuery(ctx, "reserve_idempotency_key")
+	defer done()
+	reserveQuery := `
+		INSERT INTO idempotency_keys (caller, key, request_hash, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (caller, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status_code = NULL, response_body = NULL,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= EXCLUDED.created_at
+	`
+	now := time.Now()
+	result, err := db.ExecContext(ctx, reserveQuery, caller, key, hash, now, now.Add(lease))
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve idempotency key %v err %w", key, err)
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func getIdempotentResponse(ctx context.Context, caller, key string) (stored idempotentResponse, err error) {
+	ctx, done := measureQuery(ctx, "get_idempotent_response")
+	defer done()
+	query := `SELECT request_hash, status_code, response_body FROM idempotency_keys WHERE caller = $1 AND key = $2`
+
+	var statusCode sql.NullInt64
+	err = db.QueryRowContext(ctx, query, caller, key).Scan(&stored.RequestHash, &statusCode, &stored.Body)
+	if err != nil {
+		err = fmt.Errorf("failed to get the response for idempotency key %v err %w", key, err)
+		return
+	}
+	stored.StatusCode = int(statusCode.Int64)
+	return
+}
+
+// saveIdempotentResponse stores the response of the request holding the key and keeps it for ttl
+func saveIdempotentResponse(ctx context.Context, caller, key string, statusCode int, body []byte, ttl time.Duration) error {
+	ctx, done := measureQuery(ctx, "save_idempotent_response")
+	defer done()
+	updateQuery := `
+		UPDATE idempotency_keys SET status_code = $1, response_body = $2, expires_at = $3
+		WHERE caller = $4 AND key = $5
+	`
+	_, err := db.ExecContext(ctx, updateQuery, statusCode, body, time.Now().Add(ttl), caller, key)
+	return err
+}
+
+func releaseIdempotencyKey(ctx context.Context, caller, key string) error {
+	ctx, done := measureQuery(ctx, "release_idempotency_key")
+	defer done()
+	_, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE caller = $1 AND key = $2`, caller, key)
+	return err
+}
+
+func deleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) error {
+	ctx, done := measureQuery(ctx, "delete_expired_idempotency_keys")
+	defer done()
+	if _, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, now); err != nil {
+		return fmt.Errorf("failed to delete expired idempotency keys err %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestIdempotentReleasesTheKeyOnPanic(t *testing.T) {
+	needsDB(t)
+
+	key := "panic-" + time.Now().Format(time.RFC3339Nano)
+	defer db.Exec("DELETE FROM idempotency_keys WHERE key = $1", key)
+	handler := idempotent(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		panic("handler failed")
+	})
+
+	func() {
+		defer func() { recover() }()
+		r := httptest.NewRequest("POST", "/api/friends", strings.NewReader(`{}`))
+		r.RemoteAddr = "192.0.2.1:1000"
+		r.Header.Set(idempotencyKeyHeader, key)
+		handler(httptest.NewRecorder(), r, nil)
+	}()
+
+	reserved, err := reserveIdempotencyKey(context.Background(), "192.0.2.1", key, "hash", time.Minute)
+	if err != nil || !reserved {
+		t.Errorf("expected the key to be released after the panic, have %v %v", reserved, err)
+	}
+}
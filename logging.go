@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// logLevel is set from the config, the logs are JSON lines on stderr
+var logLevel = new(slog.LevelVar)
+
+func init() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+}
+
+// validRequestID keeps the request IDs of clients that are safe to log and echo
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type loggerKey struct{}
+
+// accessEntry collects what the handlers learn about a request for its access line
+type accessEntry struct {
+	logger *slog.Logger
+	caller string
+	err    error
+}
+
+type accessEntryKey struct{}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerOf returns the logger of the request, it carries the request ID, route and caller
+func loggerOf(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// withCaller adds the authenticated caller to the logger of the request and to its access line
+func withCaller(ctx context.Context, caller string) context.Context {
+	if entry, ok := ctx.Value(accessEntryKey{}).(*accessEntry); ok {
+		entry.caller = caller
+	}
+	return withLogger(ctx, loggerOf(ctx).With("caller", caller))
+}
+
+// logWriter hands the error a handler responded with to the access line
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	entry  *accessEntry
+}
+
+func (w *logWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *logWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// noteError keeps the error of a response for the access line and the span of the request,
+// w may be wrapped by other middlewares as long as they implement Unwrap
+func noteError(w http.ResponseWriter, err error) {
+	for {
+		switch writer := w.(type) {
+		case *logWriter:
+			writer.entry.err = err
+		case *spanWriter:
+			writer.span.RecordError(err)
+		}
+		wrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = wrapper.Unwrap()
+	}
+}
+
+// fatal logs the error and exits, it is only used while the server starts
+func fatal(message string, err error) {
+	slog.Error(message, "err", err)
+	os.Exit(1)
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// logRequests reads or generates the request ID, puts the logger of the request in its
+// context and writes one access line per request, server errors are logged as errors.
+// The lines of a traced request carry its trace ID
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := slog.Default().With("request_id", id, "route", routeOf(r))
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			logger = logger.With("trace_id", span.TraceID().String())
+		}
+		entry := &accessEntry{logger: logger}
+		ctx := context.WithValue(withLogger(r.Context(), entry.logger), accessEntryKey{}, entry)
+		writer := &logWriter{ResponseWriter: w, status: http.StatusOK, entry: entry}
+		h.ServeHTTP(writer, r.WithContext(ctx))
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", writer.status,
+			"bytes", writer.bytes,
+			"duration_ms", time.Since(started).Milliseconds(),
+			"remote_ip", clientIP(r),
+		}
+		if entry.caller != "" {
+			attrs = append(attrs, "caller", entry.caller)
+		}
+		level := slog.LevelInfo
+		if entry.err != nil {
+			attrs = append(attrs, "err", entry.err.Error())
+			if writer.status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+		}
+		entry.logger.Log(r.Context(), level, "request", attrs...)
+	})
+}
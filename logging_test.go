@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// captureLogs sends the logs of the test to a buffer, one JSON object a line
+func captureLogs(t *testing.T) *bytes.Buffer {
+	logs := &bytes.Buffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func TestLogRequests(t *testing.T) {
+	logs := captureLogs(t)
+	handler := logRequests(measureRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withCaller(r.Context(), "andy@example.com")
+		loggerOf(ctx).Info("from the handler")
+		writeError(w, errors.New("connection refused"))
+	})))
+
+	r := httptest.NewRequest("GET", "/api/webhooks/3/deliveries", nil)
+	r.Header.Set(requestIDHeader, "req-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Header().Get(requestIDHeader) != "req-123" {
+		t.Errorf("expected the request ID to be echoed, have %q", w.Header().Get(requestIDHeader))
+	}
+	lines := bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected a handler line and an access line, have %s", logs)
+	}
+
+	handlerLine, accessLine := map[string]interface{}{}, map[string]interface{}{}
+	json.Unmarshal(lines[0], &handlerLine)
+	json.Unmarshal(lines[1], &accessLine)
+	if handlerLine["request_id"] != "req-123" || handlerLine["route"] != "/api/webhooks/:id/deliveries" || handlerLine["caller"] != "andy@example.com" {
+		t.Errorf("expected the handler logger to carry the request, have %s", lines[0])
+	}
+	if accessLine["level"] != "ERROR" || accessLine["status"] != float64(500) || accessLine["err"] != "connection refused" || accessLine["caller"] != "andy@example.com" {
+		t.Errorf("expected the server error in the access line, have %s", lines[1])
+	}
+}
+
+func TestLogRequestsGeneratesRequestID(t *testing.T) {
+	captureLogs(t)
+	handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, id := range []string{"", "has spaces", string(bytes.Repeat([]byte("a"), 200))} {
+		r := httptest.NewRequest("GET", "/healthz", nil)
+		r.Header.Set(requestIDHeader, id)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if generated := w.Header().Get(requestIDHeader); len(generated) != 32 {
+			t.Errorf("expected a generated request ID for %q, have %q", id, generated)
+		}
+	}
+}
+
+func TestInternalErrorsAreLoggedWithTheRequest(t *testing.T) {
+	logs := captureLogs(t)
+	ctx := withCaller(withLogger(context.Background(), slog.Default().With("request_id", "req-123")), "andy@example.com")
+	graphqlError(ctx, errors.New("connection refused"))
+	grpcError(ctx, errors.New("connection refused"))
+
+	lines := bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected a line for each internal error, have %s", logs)
+	}
+	for _, line := range lines {
+		logged := map[string]interface{}{}
+		json.Unmarshal(line, &logged)
+		if logged["request_id"] != "req-123" || logged["caller"] != "andy@example.com" || logged["err"] != "connection refused" {
+			t.Errorf("expected the error to be logged with the request, have %s", line)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain connects to the database of DATABASE_DSN, without it the tests that need the
+// database are skipped and the others still run
+func TestMain(m *testing.M) {
+	if os.Getenv("DATABASE_DSN") != "" {
+		c, err := loadConfig(nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if db, err = connectDB(c.Database); err != nil {
+			log.Fatal(err)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// needsDB skips tests that read or write the database when TestMain did not connect to one
+func needsDB(t *testing.T) {
+	t.Helper()
+	if db == nil {
+		t.Skip("DATABASE_DSN is not set")
+	}
+}
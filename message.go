@@ -1,7 +1,7 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"regexp"
 	"strings"
 )
@@ -9,19 +9,135 @@ import (
 type message struct {
 	Sender string
 	Text   string
+	Page   pageRequest `json:"-"`
 }
 
-func (m message) getSubscribers() (user user, err error) {
-	if m.Sender == "" {
-		err = errors.New("invalid message")
+type messagePreview struct {
+	Recipients        []string `json:"recipients"`
+	Mentioned         []string `json:"mentioned"`
+	Blocked           []string `json:"blocked"`
+	SecondDegreeCount *int     `json:"second_degree_count,omitempty"`
+}
+
+type previewRequest struct {
+	message
+	SecondDegree bool `json:"second_degree"`
+}
+
+type messageEvent struct {
+	ID         int      `json:"id"`
+	ParentID   *int     `json:"parent_id,omitempty"`
+	ThreadID   int      `json:"thread_id"`
+	Sender     string   `json:"sender"`
+	Text       string   `json:"text"`
+	Recipients []string `json:"recipients"`
+}
+
+func newMessageEvent(m storedMessage, recipients []string) messageEvent {
+	return messageEvent{m.ID, m.ParentID, m.ThreadID, m.Sender, m.Text, recipients}
+}
+
+// eachRecipient hands every recipient to fn a page at a time without recording the message as sent
+func (m message) eachRecipient(ctx context.Context, fn func(recipient string) error) error {
+	ctx, span := tracer.Start(ctx, "message.eachRecipient")
+	defer span.End()
+
+	m.Page = defaultPage
+	for {
+		user, err := m.getRecipients(ctx)
+		if err != nil {
+			return err
+		}
+		for _, recipient := range user.Subscribers {
+			if err := fn(recipient); err != nil {
+				return err
+			}
+		}
+
+		if user.NextCursor == "" {
+			break
+		}
+		if m.Page.after, err = decodeCursor(user.NextCursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRecipients resolves who would receive the message without recording that it was sent
+func (m message) getRecipients(ctx context.Context) (user user, err error) {
+	ctx, span := tracer.Start(ctx, "message.getRecipients")
+	defer span.End()
+
+	if err = validate(check("sender", m.Sender, required("invalid message"))); err != nil {
 		return
 	}
 
 	sender := strings.ToLower(m.Sender)
+	blocked, err := getBlockedSet(ctx, sender)
+	if err != nil {
+		return
+	}
+	active, err := withoutSuspendedUsers(ctx, m.getMentionedUsers())
+	if err != nil {
+		return
+	}
+	var mentioned []string
+	for _, mentionedUser := range active {
+		if !blocked[mentionedUser] {
+			mentioned = append(mentioned, mentionedUser)
+		}
+	}
 
-	// extract all the mentioned users in the text, if any
+	// the mentioned users are listed ahead of the subscribers and count towards the limit,
+	// the cursor of a page that ends among them holds how many were listed
+	limit, after := m.Page.Limit, m.Page.after
+	subscriberPage := m.Page
+	start := len(mentioned)
+	switch {
+	case after == nil:
+		start = 0
+	case after.Email == "" && after.Mentioned < len(mentioned):
+		start = after.Mentioned
+	}
+	if after == nil || after.Email == "" {
+		subscriberPage.after = nil
+	}
+	listed := mentioned[start:]
+	if limit > 0 && len(listed) > limit {
+		listed = listed[:limit]
+	}
+	user.Subscribers = append([]string{}, listed...)
+
+	// a page filled by mentioned users still counts the subscribers for the total
+	filled := limit > 0 && len(listed) == limit
+	if limit > 0 {
+		subscriberPage.Limit = limit - len(listed)
+		if filled {
+			subscriberPage.Limit = 1
+		}
+	}
+	subscribers, err := getSubscribedList(ctx, sender, mentioned, subscriberPage)
+	if err != nil {
+		return
+	}
+	user.Total = len(mentioned) + subscribers.Total
+	if !filled {
+		user.Subscribers = append(user.Subscribers, subscribers.Items...)
+		user.NextCursor = subscribers.NextCursor
+		return
+	}
+	if next := start + len(listed); next < len(mentioned) || subscribers.Total > 0 {
+		user.NextCursor = pageCursor{Mentioned: next}.encode()
+	}
+	return
+}
+
+// getMentionedUsers extracts all the valid emails mentioned in the text, if any, once each
+func (m message) getMentionedUsers() (mentioned []string) {
 	emailFilter := regexp.MustCompile(`\S*@\S*`)
 	mentionedUsers := emailFilter.FindAllString(m.Text, -1)
+	seen := map[string]bool{}
 	for _, mentionedUser := range mentionedUsers {
 		mentionedUser = strings.ToLower(mentionedUser)
 
@@ -29,15 +145,63 @@ func (m message) getSubscribers() (user user, err error) {
 			mentionedUser = strings.Replace(mentionedUser, ",", "", -1)
 		}
 
-		if isEmailValid(mentionedUser) {
-			user.Subscribers = append(user.Subscribers, mentionedUser)
+		if isEmailValid(mentionedUser) && !seen[mentionedUser] {
+			seen[mentionedUser] = true
+			mentioned = append(mentioned, mentionedUser)
+		}
+	}
+	return
+}
+
+// preview shows how far the message would spread without sending it. Its audience, the
+// mentioned users and the subscribers, is split into the recipients and the users a block
+// drops. The second degree audience is the friends of the recipients who would not receive
+// the message themselves
+func (m message) preview(ctx context.Context, secondDegree bool) (preview messagePreview, err error) {
+	ctx, span := tracer.Start(ctx, "message.preview")
+	defer span.End()
+
+	if err = validate(check("sender", m.Sender, required("invalid message"))); err != nil {
+		return
+	}
+
+	sender := strings.ToLower(m.Sender)
+	mentioned, err := withoutSuspendedUsers(ctx, m.getMentionedUsers())
+	if err != nil {
+		return
+	}
+	subscribers, err := getAudience(ctx, sender)
+	if err != nil {
+		return
+	}
+	blocked, err := getBlockedSet(ctx, sender)
+	if err != nil {
+		return
+	}
+
+	preview.Mentioned = append([]string{}, mentioned...)
+	preview.Recipients, preview.Blocked = []string{}, []string{}
+	seen := map[string]bool{}
+	for _, email := range append(mentioned, subscribers...) {
+		switch {
+		case seen[email]:
+		case blocked[email]:
+			preview.Blocked = append(preview.Blocked, email)
+		default:
+			preview.Recipients = append(preview.Recipients, email)
 		}
+		seen[email] = true
 	}
 
-	subscribers, err := getSubscribedList(sender)
-	if err != nil && user.Subscribers == nil {
+	if !secondDegree {
+		return
+	}
+	excluded := append([]string{sender}, preview.Recipients...)
+	excluded = append(excluded, preview.Blocked...)
+	count, err := countFriendsOfUsers(ctx, preview.Recipients, excluded)
+	if err != nil {
 		return
 	}
-	user.Subscribers = append(user.Subscribers, subscribers...)
+	preview.SecondDegreeCount = &count
 	return
 }
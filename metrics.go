@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "friends"
+
+	// unmatchedRoute labels requests to paths that are not in routes.go, keeping the number of series bounded
+	unmatchedRoute = "unmatched"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route as registered in routes.go and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to serve HTTP requests by route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Time spent in the queries of the services files.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"query"})
+
+	friendshipsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "friendships_created_total",
+		Help:      "Friendships committed to the database.",
+	})
+
+	blocksCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocks_total",
+		Help:      "Blocks committed to the database.",
+	})
+
+	subscriptionsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "subscriptions_total",
+		Help:      "Subscriptions committed to the database.",
+	})
+
+	messagesFannedOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_fanned_out_total",
+		Help:      "Messages sent to their recipients.",
+	})
+
+	messageRecipients = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "message_recipients",
+		Help:      "Recipients per message sent.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	})
+
+	// eventCounters count the relationship changes by the outbox event recording them
+	eventCounters = map[string]prometheus.Counter{
+		eventFriendCreated:       friendshipsCreated,
+		eventBlockCreated:        blocksCreated,
+		eventSubscriptionCreated: subscriptionsCreated,
+	}
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpRequestDuration, dbQueryDuration,
+		friendshipsCreated, blocksCreated, subscriptionsCreated, messagesFannedOut, messageRecipients)
+}
+
+// registerDBMetrics exports the pool stats of the database once it is open
+func registerDBMetrics(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "friends_management"))
+}
+
+var promHandler = promhttp.Handler()
+
+func metricsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	promHandler.ServeHTTP(w, r)
+}
+
+// measureQuery times a query of the services files and starts its span, the returned ctx
+// holds the span for the statements of the query, call the returned func once it is done
+func measureQuery(ctx context.Context, name string) (context.Context, func()) {
+	started := time.Now()
+	ctx, span := startQuerySpan(ctx, name)
+	return ctx, func() {
+		dbQueryDuration.WithLabelValues(name).Observe(time.Since(started).Seconds())
+		span.End()
+	}
+}
+
+// countEvent counts the relationship change recorded by the event once tx is committed
+func countEvent(tx *txn, event string) {
+	if counter, ok := eventCounters[event]; ok {
+		tx.onCommit(counter.Inc)
+	}
+}
+
+// countMessageSent counts a message handed to its recipients
+func countMessageSent(recipients int) {
+	messagesFannedOut.Inc()
+	messageRecipients.Observe(float64(recipients))
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// measureRequests counts and times every request, it wraps the whole chain so that requests
+// refused by authentication or rate limiting are measured too
+func measureRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		writer := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(writer, r)
+
+		method, route := r.Method, routeOf(r)
+		if route == unmatchedRoute {
+			method = unmatchedRoute
+		}
+		labels := prometheus.Labels{"method": method, "route": route, "status": strconv.Itoa(writer.status)}
+		httpRequests.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(started).Seconds())
+	})
+}
+
+// routeOf finds the path of routes.go the request matches, e.g. /api/webhooks/:id,
+// by putting the names of the path parameters back in place of their values
+func routeOf(r *http.Request) string {
+	handle, params, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return unmatchedRoute
+	}
+	segments := strings.Split(r.URL.Path, "/")
+	i := 0
+	for _, param := range params {
+		for ; i < len(segments); i++ {
+			if segments[i] == param.Value {
+				segments[i] = ":" + param.Key
+				i++
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
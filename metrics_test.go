@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRouteOf(t *testing.T) {
+	cases := map[string]string{
+		"GET /api/friends":                                             "/api/friends",
+		"GET /api/webhooks/12/deliveries":                              "/api/webhooks/:id/deliveries",
+		"POST /api/v2/users/andy@example.com/friends/john@example.com": "/api/v2/users/:email/friends/:friend",
+		"GET /api/nothing/here":                                        unmatchedRoute,
+		"PUT /api/friends":                                             unmatchedRoute,
+	}
+	for request, expected := range cases {
+		parts := strings.SplitN(request, " ", 2)
+		if route := routeOf(httptest.NewRequest(parts[0], parts[1], nil)); route != expected {
+			t.Errorf("expected %v to match %v but have %v", request, expected, route)
+		}
+	}
+}
+
+func TestMeasureRequests(t *testing.T) {
+	handler := measureRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	counter := httpRequests.WithLabelValues("DELETE", "/api/keys/:id", "418")
+	before := testutil.ToFloat64(counter)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/api/keys/7", nil))
+	if after := testutil.ToFloat64(counter); after != before+1 {
+		t.Errorf("expected the request to be counted once, have %v then %v", before, after)
+	}
+}
+
+func TestOnCommit(t *testing.T) {
+	needsDB(t)
+
+	committed := 0
+	withTx(context.Background(), func(tx *txn) error {
+		tx.onCommit(func() { committed++ })
+		return nil
+	})
+	withTx(context.Background(), func(tx *txn) error {
+		tx.onCommit(func() { committed++ })
+		return errors.New("rolled back")
+	})
+	if committed != 1 {
+		t.Errorf("expected the hook of the committed transaction only to run, ran %v times", committed)
+	}
+}
@@ -0,0 +1,24 @@
+CREATE TABLE webhooks (
+	id serial primary key,
+	url varchar not null,
+	events varchar[] not null,
+	secret varchar not null,
+	created_at timestamp not null,
+	updated_at timestamp not null
+);
+
+CREATE TABLE webhook_deliveries (
+	id serial primary key,
+	webhook_id integer not null references webhooks(id) on delete cascade,
+	event varchar not null,
+	payload text not null,
+	status varchar not null,
+	attempts integer not null default 0,
+	last_error varchar,
+	next_attempt_at timestamp not null,
+	delivered_at timestamp,
+	created_at timestamp not null,
+	updated_at timestamp not null
+);
+
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
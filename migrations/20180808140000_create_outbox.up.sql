@@ -0,0 +1,10 @@
+CREATE TABLE outbox (
+	id bigserial primary key,
+	pair_key varchar not null,
+	event varchar not null,
+	payload text not null,
+	created_at timestamp not null,
+	published_at timestamp
+);
+
+CREATE INDEX outbox_unpublished_idx ON outbox (id) WHERE published_at IS NULL;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS digest_items;
+DROP TABLE IF EXISTS digests;
+DROP TABLE IF EXISTS delivery_preferences;
@@ -0,0 +1,28 @@
+CREATE TABLE delivery_preferences (
+	email varchar primary key,
+	frequency varchar not null,
+	created_at timestamp not null,
+	updated_at timestamp not null
+);
+
+CREATE TABLE digests (
+	id serial primary key,
+	recipient varchar not null,
+	frequency varchar not null,
+	period_end timestamp not null,
+	item_count integer not null,
+	notified_at timestamp,
+	created_at timestamp not null
+);
+
+CREATE TABLE digest_items (
+	id serial primary key,
+	recipient varchar not null,
+	sender varchar not null,
+	text text not null,
+	digest_id integer references digests(id) on delete cascade,
+	created_at timestamp not null
+);
+
+CREATE INDEX digest_items_pending_idx ON digest_items (recipient, created_at) WHERE digest_id IS NULL;
+CREATE INDEX digests_recipient_idx ON digests (recipient);
@@ -0,0 +1,18 @@
+CREATE TABLE messages (
+	id serial primary key,
+	sender varchar not null,
+	text text not null,
+	parent_id integer references messages(id) on delete cascade,
+	thread_id integer references messages(id) on delete cascade,
+	created_at timestamp not null
+);
+
+CREATE INDEX messages_thread_idx ON messages (thread_id, id);
+
+CREATE TABLE message_reactions (
+	message_id integer not null references messages(id) on delete cascade,
+	email varchar not null,
+	emoji varchar not null,
+	created_at timestamp not null,
+	primary key (message_id, email, emoji)
+);
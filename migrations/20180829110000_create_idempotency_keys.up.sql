@@ -0,0 +1,12 @@
+CREATE TABLE idempotency_keys (
+	caller varchar not null,
+	key varchar not null,
+	request_hash varchar not null,
+	status_code integer,
+	response_body bytea,
+	created_at timestamp not null,
+	expires_at timestamp not null,
+	primary key (caller, key)
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
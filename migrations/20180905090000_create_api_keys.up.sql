@@ -0,0 +1,8 @@
+CREATE TABLE api_keys (
+	id serial primary key,
+	email varchar not null,
+	key_hash varchar not null unique,
+	scopes varchar[] not null default '{}',
+	created_at timestamp not null,
+	revoked_at timestamp
+);
@@ -0,0 +1,16 @@
+CREATE TABLE suspended_users (
+	email varchar primary key,
+	reason varchar not null,
+	suspended_by varchar not null,
+	suspended_at timestamp not null
+);
+
+CREATE TABLE admin_audit_log (
+	id serial primary key,
+	actor varchar not null,
+	action varchar not null,
+	details jsonb not null,
+	created_at timestamp not null
+);
+
+CREATE INDEX admin_audit_log_created_at_idx ON admin_audit_log (created_at);
@@ -0,0 +1 @@
+ALTER TABLE digests DROP COLUMN IF EXISTS claimed_until;
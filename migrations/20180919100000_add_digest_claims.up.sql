@@ -0,0 +1 @@
+ALTER TABLE digests ADD COLUMN claimed_until timestamp;
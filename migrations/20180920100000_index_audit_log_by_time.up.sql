@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS admin_audit_log_created_at_idx;
+CREATE INDEX admin_audit_log_created_at_id_idx ON admin_audit_log (created_at, id);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS relationships_requestor_target_key;
@@ -0,0 +1,3 @@
+DELETE FROM relationships duplicate USING relationships kept
+WHERE duplicate.requestor = kept.requestor AND duplicate.target = kept.target AND duplicate.id > kept.id;
+CREATE UNIQUE INDEX relationships_requestor_target_key ON relationships (requestor, target);
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiOperation documents a single route of routes.go, the path parameters are taken from the path
+type apiOperation struct {
+	Method   string
+	Path     string
+	Summary  string
+	Query    []apiParameter
+	Body     interface{}
+	Response interface{}
+	// Idempotent routes accept an Idempotency-Key header
+	Idempotent bool
+}
+
+type apiParameter struct {
+	Name        string
+	Description string
+}
+
+var (
+	pageParameters = []apiParameter{
+		{"limit", "number of users per page, at most 1000"},
+		{"cursor", "next_cursor of the previous page"},
+		{"sort", "email (default) or created_at"},
+		{"order", "asc (default) or desc"},
+	}
+
+	// apiOperations is the source of the OpenAPI document, every route registered in routes.go needs an entry
+	apiOperations = []apiOperation{
+		{Method: "POST", Path: "/api/friends", Summary: "Connect two users as friends", Body: friendsRequest{}, Response: handlerResponse{}, Idempotent: true},
+		{Method: "GET", Path: "/api/friends", Summary: "List the friends of a user", Query: pageParameters, Body: emailRequest{}, Response: handlerResponse{}},
+		{Method: "GET", Path: "/api/friends/common", Summary: "List the friends two users have in common", Query: pageParameters, Body: friendsRequest{}, Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/friends/subscribe", Summary: "Subscribe the requestor to updates of the target", Body: userRequest{}, Response: handlerResponse{}, Idempotent: true},
+		{Method: "POST", Path: "/api/friends/block", Summary: "Block updates from the target", Body: userRequest{}, Response: handlerResponse{}, Idempotent: true},
+		{Method: "GET", Path: "/api/friends/subscribe", Summary: "List the recipients of a message without sending it", Query: pageParameters, Body: message{}, Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/batch", Summary: "Apply many friend, unfriend, subscribe and block operations at once", Body: batch{}, Response: handlerResponse{}, Idempotent: true},
+		{Method: "POST", Path: "/api/webhooks", Summary: "Register a webhook", Body: webhookRequest{}, Response: handlerResponse{}},
+		{Method: "GET", Path: "/api/webhooks", Summary: "List the registered webhooks", Response: handlerResponse{}},
+		{Method: "DELETE", Path: "/api/webhooks/:id", Summary: "Delete a webhook", Response: handlerResponse{}},
+		{Method: "GET", Path: "/api/webhooks/:id/deliveries", Summary: "List the deliveries of a webhook", Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/webhooks/:id/deliveries/:delivery/retry", Summary: "Retry a dead delivery", Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/digests/preferences", Summary: "Set how often a user receives messages", Body: deliveryPreference{}, Response: handlerResponse{}},
+		{Method: "GET", Path: "/api/digests", Summary: "List the digests of a user", Query: []apiParameter{{"email", "user whose digests are listed"}}, Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/messages/preview", Summary: "Show who a message would reach without sending it", Body: previewRequest{}, Response: previewResponse{}},
+		{Method: "POST", Path: "/api/messages", Summary: "Store a message and send it to its recipients", Body: message{}, Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/messages/replies", Summary: "Reply to a message", Body: reply{}, Response: handlerResponse{}},
+		{Method: "GET", Path: "/api/messages/:id/thread", Summary: "Show the thread of a message", Query: []apiParameter{{"email", "user viewing the thread"}}, Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/messages/reactions", Summary: "React to a message", Body: reaction{}, Response: handlerResponse{}},
+		{Method: "DELETE", Path: "/api/messages/reactions", Summary: "Remove a reaction", Body: reaction{}, Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/keys", Summary: "Issue an API key, the key is only shown in this response", Body: apiKeyRequest{}, Response: handlerResponse{}},
+		{Method: "DELETE", Path: "/api/keys/:id", Summary: "Revoke an API key", Response: handlerResponse{}},
+		{Method: "GET", Path: "/api/openapi.json", Summary: "This document"},
+		{Method: "GET", Path: "/api/docs", Summary: "Browsable documentation of the API"},
+		{Method: "POST", Path: "/graphql", Summary: "GraphQL queries and mutations of users, relationships and messages", Body: graphqlRequest{}, Response: graphql.Response{}, Idempotent: true},
+		{Method: "GET", Path: "/healthz", Summary: "Liveness, the process is up", Response: healthStatus{}},
+		{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics, admins only"},
+		{Method: "GET", Path: "/readyz", Summary: "Readiness, the database is reachable and migrated and the workers run, 503 otherwise", Response: healthStatus{}},
+
+		{Method: "GET", Path: "/api/admin/relationships", Summary: "List the stored relationships of a user, moderators only", Query: []apiParameter{{"email", "user whose relationships are listed"}}, Response: handlerResponse{}},
+		{Method: "GET", Path: "/api/admin/relationships/export", Summary: "Export every stored relationship as JSON lines ending with a trailer of the count, admins only", Response: exportTrailer{}},
+		{Method: "DELETE", Path: "/api/admin/users/:email/relationships/:other", Summary: "Remove every relationship between two users, moderators only", Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/admin/users/:email/suspension", Summary: "Suspend a user, moderators only", Body: suspendRequest{}, Response: handlerResponse{}},
+		{Method: "DELETE", Path: "/api/admin/users/:email/suspension", Summary: "Lift the suspension of a user, moderators only", Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/admin/unblocks", Summary: "Lift many blocks at once, moderators only", Body: unblockRequest{}, Response: handlerResponse{}},
+		{Method: "GET", Path: "/api/admin/audit", Summary: "List the latest admin actions, admins only", Query: []apiParameter{{"limit", "number of entries, at most 1000"}}, Response: handlerResponse{}},
+
+		{Method: "GET", Path: "/api/v2/users/:email/friends", Summary: "List the friends of a user", Query: pageParameters, Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/v2/users/:email/friends/:friend", Summary: "Connect two users as friends", Response: handlerResponse{}, Idempotent: true},
+		{Method: "GET", Path: "/api/v2/users/:email/common/:other", Summary: "List the friends two users have in common", Query: pageParameters, Response: handlerResponse{}},
+		{Method: "GET", Path: "/api/v2/users/:email/recipients", Summary: "List the recipients of a message without sending it", Query: append([]apiParameter{{"text", "text of the message"}}, pageParameters...), Response: handlerResponse{}},
+		{Method: "POST", Path: "/api/v2/users/:email/subscriptions/:target", Summary: "Subscribe the user to updates of the target", Response: handlerResponse{}, Idempotent: true},
+		{Method: "POST", Path: "/api/v2/users/:email/blocks/:target", Summary: "Block updates from the target", Response: handlerResponse{}, Idempotent: true},
+	}
+
+	// apiErrorCodes lists the codes a failed request may respond with for every status code
+	apiErrorCodes = map[int][]string{
+		http.StatusBadRequest:            {errorCodeInvalidRequest},
+		http.StatusUnauthorized:          {errorCodeUnauthorized},
+		http.StatusForbidden:             {errorCodeForbidden},
+		http.StatusNotFound:              {errorCodeNotFound, "no_friends", "no_common_friends", "not_friends", "message_not_found", "reaction_not_found", "webhook_not_found", "dead_delivery_not_found", "api_key_not_found", "relationship_not_found", "suspension_not_found"},
+		http.StatusConflict:              {"already_friends", "already_subscribed", errorCodeBlocked, "idempotency_key_in_flight", "already_suspended", errorCodeConflict},
+		http.StatusRequestEntityTooLarge: {errorCodeTooLarge},
+		http.StatusUnsupportedMediaType:  {errorCodeMediaType},
+		http.StatusUnprocessableEntity:   {errorCodeValidation, "idempotency_key_reused"},
+		http.StatusTooManyRequests:       {errorCodeRateLimited},
+		http.StatusInternalServerError:   {errorCodeInternal},
+		http.StatusGatewayTimeout:        {errorCodeTimeout},
+	}
+
+	openAPIOnce     sync.Once
+	openAPIDocument []byte
+)
+
+// buildOpenAPIDocument describes apiOperations as an OpenAPI 3 document, the schemas are generated
+// from the Go types so they follow the json tags the handlers decode and encode with
+func buildOpenAPIDocument() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+
+	for _, op := range apiOperations {
+		path, parameters := openAPIPath(op.Path)
+		for _, param := range op.Query {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        param.Name,
+				"in":          "query",
+				"description": param.Description,
+				"schema":      map[string]string{"type": "string"},
+			})
+		}
+		if op.Idempotent {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        idempotencyKeyHeader,
+				"in":          "header",
+				"description": "retries with the same key and body replay the first response",
+				"schema":      map[string]interface{}{"type": "string", "maxLength": maxIdempotencyKeyLength},
+			})
+		}
+
+		success := map[string]interface{}{"description": "OK"}
+		if op.Response != nil {
+			success["content"] = jsonContent(schemaOf(reflect.TypeOf(op.Response), schemas))
+		}
+		responses := map[string]interface{}{"200": success}
+		for status := range apiErrorCodes {
+			responses[strconv.Itoa(status)] = map[string]interface{}{"$ref": "#/components/responses/" + strconv.Itoa(status)}
+		}
+
+		operation := map[string]interface{}{
+			"summary":    op.Summary,
+			"parameters": parameters,
+			"responses":  responses,
+		}
+		if publicPaths[op.Path] {
+			operation["security"] = []interface{}{}
+		}
+		if op.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(schemaOf(reflect.TypeOf(op.Body), schemas)),
+			}
+		}
+
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(op.Method)] = operation
+	}
+
+	errorSchema := schemaOf(reflect.TypeOf(responseStatus{}), schemas)
+	errorResponses := map[string]interface{}{}
+	for status, codes := range apiErrorCodes {
+		errorResponses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": http.StatusText(status) + ", code is one of " + strings.Join(codes, ", "),
+			"content":     jsonContent(errorSchema),
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "Friends management API",
+			"version": "2",
+		},
+		"paths":    paths,
+		"security": []interface{}{map[string][]string{"apiKey": {}}, map[string][]string{"bearer": {}}},
+		"components": map[string]interface{}{
+			"schemas":   schemas,
+			"responses": errorResponses,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+				"bearer": map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// openAPIPath turns the httprouter path into an OpenAPI path, ":id" becomes "{id}"
+func openAPIPath(routerPath string) (string, []interface{}) {
+	parameters := []interface{}{}
+	segments := strings.Split(routerPath, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := segment[1:]
+			segments[i] = "{" + name + "}"
+			parameters = append(parameters, map[string]interface{}{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]string{"type": "string"},
+			})
+		}
+	}
+	return strings.Join(segments, "/"), parameters
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// schemaOf returns the schema of t, named structs are added to schemas and referenced
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			properties := map[string]interface{}{}
+			// reserve the name first so recursive types terminate
+			schemas[t.Name()] = nil
+			addProperties(t, properties, schemas)
+			schemas[t.Name()] = map[string]interface{}{"type": "object", "properties": properties}
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// addProperties adds the exported fields of t the way encoding/json sees them, embedded structs
+// are flattened and untagged fields are documented in lower case as decoding ignores case
+func addProperties(t reflect.Type, properties, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addProperties(field.Type, properties, schemas)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		properties[name] = schemaOf(field.Type, schemas)
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	openAPIOnce.Do(func() {
+		openAPIDocument, _ = json.Marshal(buildOpenAPIDocument())
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+const apiDocsPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>Friends management API</title>
+<meta charset="utf-8">
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="docs"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/api/openapi.json", dom_id: "#docs"})</script>
+</body>
+</html>
+`
+
+func apiDocsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(apiDocsPage))
+}
@@ -0,0 +1,58 @@
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type openAPIDocument struct {
+	OpenAPI string                                `json:"openapi"`
+	Paths   map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+var registeredRoute = regexp.MustCompile(`router\.(GET|POST|PUT|PATCH|DELETE)\("([^"]+)"`)
+var pathParameter = regexp.MustCompile(`:([^/]+)`)
+
+// TestOpenAPICoversRoutes fails when a route in routes.go is missing from the served document
+func TestOpenAPICoversRoutes(t *testing.T) {
+	source, err := ioutil.ReadFile("routes.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := registeredRoute.FindAllStringSubmatch(string(source), -1)
+	if len(routes) == 0 {
+		t.Fatal("no routes found in routes.go")
+	}
+
+	res, err := http.Get(baseAPI + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	document := openAPIDocument{}
+	if err := json.Unmarshal(bodyBytes, &document); err != nil {
+		t.Fatalf("failed to unmarshal openapi document %v", err)
+	}
+	if !strings.HasPrefix(document.OpenAPI, "3.") {
+		t.Errorf("expecting an OpenAPI 3 document but have version %v", document.OpenAPI)
+	}
+
+	documented := 0
+	for _, operations := range document.Paths {
+		documented += len(operations)
+	}
+	if documented != len(routes) {
+		t.Errorf("expecting %v documented operations but have %v", len(routes), documented)
+	}
+
+	for _, route := range routes {
+		method, path := strings.ToLower(route[1]), pathParameter.ReplaceAllString(route[2], "{$1}")
+		if _, ok := document.Paths[path][method]; !ok {
+			t.Errorf("route %v %v has no entry in the openapi document", route[1], route[2])
+		}
+	}
+}
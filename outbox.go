@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// outboxPollInterval is how often the relay looks for unpublished events
+	outboxPollInterval = time.Second
+	outboxBatchSize    = 100
+	// outboxRelayLock is the postgres advisory lock key held while relaying,
+	// only one relay publishes at a time so events of a user pair stay in order
+	outboxRelayLock int64 = 20180808140000
+)
+
+type outboxEvent struct {
+	ID        int64           `json:"id"`
+	Event     string          `json:"event"`
+	PairKey   string          `json:"pair_key"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// publisher hands outbox events over to whatever is listening downstream.
+// The relay calls Publish at least once per event, an event is only marked as
+// published after Publish returned nil so implementations must tolerate duplicates
+type publisher interface {
+	Publish(event outboxEvent) error
+}
+
+// errOutboxChannelFull makes the relay hold the event back until its next run
+var errOutboxChannelFull = errors.New("outbox channel is full")
+
+// channelPublisher hands events to in-process consumers reading from events
+type channelPublisher struct {
+	events chan outboxEvent
+}
+
+func newChannelPublisher(size int) *channelPublisher {
+	return &channelPublisher{events: make(chan outboxEvent, size)}
+}
+
+// Publish never waits on a slow consumer, it fails when the buffer is full
+func (p *channelPublisher) Publish(event outboxEvent) error {
+	select {
+	case p.events <- event:
+		return nil
+	default:
+		return errOutboxChannelFull
+	}
+}
+
+// ndjsonPublisher appends every event as a line of JSON to a file
+type ndjsonPublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newNDJSONPublisher(path string) (*ndjsonPublisher, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonPublisher{file: file}, nil
+}
+
+func (p *ndjsonPublisher) Publish(event outboxEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return p.file.Sync()
+}
+
+// newOutboxPublisher picks the publisher, "ndjson" (default) or "channel"
+func newOutboxPublisher(c outboxConfig) (publisher, error) {
+	switch c.Publisher {
+	case "", "ndjson":
+		return newNDJSONPublisher(c.File)
+	case "channel":
+		p := newChannelPublisher(outboxBatchSize)
+		go func() {
+			for event := range p.events {
+				slog.Info("outbox event", "id", event.ID, "event", event.Event, "payload", string(event.Payload))
+			}
+		}()
+		return p, nil
+	default:
+		return nil, errors.New("unknown outbox publisher " + c.Publisher)
+	}
+}
+
+// pairKey identifies a relationship regardless of who requested it
+func pairKey(user1, user2 string) string {
+	users := []string{strings.ToLower(user1), strings.ToLower(user2)}
+	sort.Strings(users)
+	return strings.Join(users, ":")
+}
+
+// threadKey keeps the events of the messages of a thread in order, like pairKey for relationships
+func threadKey(threadID int) string {
+	return "thread:" + strconv.Itoa(threadID)
+}
+
+// recordEvent writes the event to the outbox and queues its webhook deliveries,
+// q must be the transaction of the change the event describes. The transactions of a
+// pair take turns from here to their commit, so the ids of its events follow commit order
+func recordEvent(ctx context.Context, q execer, event, pair string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := lockOutboxPair(ctx, q, pair); err != nil {
+		return err
+	}
+	if err := insertOutboxEvent(ctx, q, event, pair, string(payload)); err != nil {
+		return err
+	}
+	if tx, ok := q.(*txn); ok {
+		countEvent(tx, event)
+	}
+	return fireWebhookEvent(ctx, q, event, data)
+}
+
+func startOutboxRelay(p publisher) {
+	workers.every("outbox", outboxPollInterval, func(ctx context.Context) error {
+		return relayOutboxEvents(ctx, p)
+	})
+}
+
+// relayOutboxEvents publishes a batch of unpublished events in insertion order.
+// Once an event of a pair fails, the remaining events of that pair are held back
+// until the next run so a pair never sees its events out of order.
+// No transaction is open while publishing, the relay lock is held by the session of a
+// dedicated connection and every event is marked as soon as it was published
+func relayOutboxEvents(ctx context.Context, p publisher) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	locked, err := tryOutboxRelayLock(ctx, conn)
+	if err != nil || !locked {
+		return err
+	}
+	defer releaseOutboxRelayLock(conn)
+
+	events, err := getUnpublishedOutboxEvents(ctx, conn, outboxBatchSize)
+	if err != nil {
+		return err
+	}
+
+	failedPairs := map[string]bool{}
+	for _, event := range events {
+		if failedPairs[event.PairKey] {
+			continue
+		}
+		if err := p.Publish(event); err != nil {
+			slog.Error("failed to publish outbox event", "id", event.ID, "err", err)
+			failedPairs[event.PairKey] = true
+			continue
+		}
+		// an event published but not marked is published again by the next run
+		if err := markOutboxEventPublished(ctx, conn, event.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+func insertOutboxEvent(ctx context.Context, q execer, event, pair, payload string) error {
+	ctx, done := measureQuery(ctx, "insert_outbox_event")
+	defer done()
+	insertQuery := `
+		INSERT INTO outbox (pair_key, event, payload, created_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	if _, err := q.ExecContext(ctx, insertQuery, pair, event, payload, time.Now()); err != nil {
+		return fmt.Errorf("failed to write %v to the outbox err %w", event, err)
+	}
+	return nil
+}
+
+// lockOutboxPair waits for the other transactions writing events of the pair to finish
+func lockOutboxPair(ctx context.Context, q execer, pair string) error {
+	ctx, done := measureQuery(ctx, "lock_outbox_pair")
+	defer done()
+	if _, err := q.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, pair); err != nil {
+		return fmt.Errorf("failed to lock the outbox of %v err %w", pair, err)
+	}
+	return nil
+}
+
+func tryOutboxRelayLock(ctx context.Context, conn *sql.Conn) (locked bool, err error) {
+	ctx, done := measureQuery(ctx, "try_outbox_relay_lock")
+	defer done()
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, outboxRelayLock).Scan(&locked)
+	return
+}
+
+// releaseOutboxRelayLock unlocks the session of conn, a connection that cannot be unlocked
+// is closed instead of going back to the pool with the lock
+func releaseOutboxRelayLock(conn *sql.Conn) {
+	ctx, done := measureQuery(context.Background(), "release_outbox_relay_lock")
+	defer done()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, outboxRelayLock); err != nil {
+		slog.Error("failed to release the outbox relay lock", "err", err)
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+}
+
+func getUnpublishedOutboxEvents(ctx context.Context, q querier, limit int) (events []outboxEvent, err error) {
+	ctx, done := measureQuery(ctx, "get_unpublished_outbox_events")
+	defer done()
+	query := `
+		SELECT id, event, pair_key, payload, created_at FROM outbox
+		WHERE published_at IS NULL
+		ORDER BY id
+		LIMIT $1
+	`
+
+	rows, err := q.QueryContext(ctx, query, limit)
+	if err != nil {
+		err = fmt.Errorf("failed to read the outbox err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := outboxEvent{}
+		var payload string
+		if err = rows.Scan(&row.ID, &row.Event, &row.PairKey, &payload, &row.CreatedAt); err != nil {
+			return
+		}
+		row.Payload = []byte(payload)
+		events = append(events, row)
+	}
+	return events, rows.Err()
+}
+
+func markOutboxEventPublished(ctx context.Context, q execer, id int64) error {
+	ctx, done := measureQuery(ctx, "mark_outbox_event_published")
+	defer done()
+	updateQuery := `UPDATE outbox SET published_at = $1 WHERE id = $2`
+	if _, err := q.ExecContext(ctx, updateQuery, time.Now(), id); err != nil {
+		return fmt.Errorf("failed to mark outbox event %v as published err %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// recordingPublisher keeps the events it was handed, failing those fail returns an error for
+type recordingPublisher struct {
+	published []string
+	fail      func(event outboxEvent) error
+}
+
+func (p *recordingPublisher) Publish(event outboxEvent) error {
+	if p.fail != nil {
+		if err := p.fail(event); err != nil {
+			return err
+		}
+	}
+	p.published = append(p.published, string(event.Payload))
+	return nil
+}
+
+func insertTestOutboxEvents(t *testing.T, events ...[2]string) {
+	db.Exec("DELETE FROM outbox")
+	for _, event := range events {
+		if err := insertOutboxEvent(context.Background(), db, "friend.created", event[0], event[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOutboxRelayHoldsBackFailedPairs(t *testing.T) {
+	needsDB(t)
+
+	insertTestOutboxEvents(t, [2]string{"a", `"a1"`}, [2]string{"b", `"b1"`}, [2]string{"a", `"a2"`}, [2]string{"b", `"b2"`})
+
+	attempts := 0
+	p := &recordingPublisher{fail: func(event outboxEvent) error {
+		if string(event.Payload) == `"a1"` {
+			if attempts++; attempts == 1 {
+				return errors.New("unavailable")
+			}
+		}
+		return nil
+	}}
+	if err := relayOutboxEvents(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if err := relayOutboxEvents(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{`"b1"`, `"b2"`, `"a1"`, `"a2"`}
+	if len(p.published) != len(expected) {
+		t.Fatalf("expected %v to be published, have %v", expected, p.published)
+	}
+	for i := range expected {
+		if p.published[i] != expected[i] {
+			t.Errorf("expected %v to be published, have %v", expected, p.published)
+		}
+	}
+}
+
+func TestOutboxRelayPublishesUnmarkedEventsAgain(t *testing.T) {
+	needsDB(t)
+
+	insertTestOutboxEvents(t, [2]string{"a", `"a1"`}, [2]string{"a", `"a2"`})
+
+	// the relay stops after publishing a1, before it could be marked
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &recordingPublisher{fail: func(event outboxEvent) error {
+		cancel()
+		return nil
+	}}
+	if err := relayOutboxEvents(ctx, p); err == nil {
+		t.Error("expected the relay to fail to mark the event")
+	}
+
+	p.fail = nil
+	if err := relayOutboxEvents(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.published) != 3 || p.published[1] != `"a1"` || p.published[2] != `"a2"` {
+		t.Errorf("expected a1 to be published again before a2, have %v", p.published)
+	}
+	if err := relayOutboxEvents(context.Background(), p); err != nil || len(p.published) != 3 {
+		t.Errorf("expected nothing left to publish, have %v %v", p.published, err)
+	}
+}
+
+func TestChannelPublisherFailsWhenFull(t *testing.T) {
+	p := newChannelPublisher(1)
+	if err := p.Publish(outboxEvent{ID: 1}); err != nil {
+		t.Fatalf("expected the first event to be buffered, got %v", err)
+	}
+	if err := p.Publish(outboxEvent{ID: 2}); err != errOutboxChannelFull {
+		t.Errorf("expected a full channel to fail the publish, got %v", err)
+	}
+	if event := <-p.events; event.ID != 1 {
+		t.Errorf("expected the buffered event, got %v", event.ID)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	sortByEmail     = "email"
+	sortByCreatedAt = "created_at"
+
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+
+	// cursorTimeLayout matches the microsecond precision of postgres timestamps
+	cursorTimeLayout = "2006-01-02T15:04:05.999999"
+)
+
+// pageRequest selects a page of a list, Limit 0 means the whole list
+type pageRequest struct {
+	Limit      int
+	Sort       string
+	Descending bool
+	after      *pageCursor
+}
+
+// pageCursor is the position of the last item of a page, it is handed to clients base64 encoded
+// so they treat it as opaque. A list of recipients starts with the mentioned users, a page
+// ending among them has a cursor with the number of them listed and no email
+type pageCursor struct {
+	Key       string `json:"k"`
+	Email     string `json:"e"`
+	Mentioned int    `json:"m,omitempty"`
+}
+
+type pageResult struct {
+	Items      []string
+	Total      int
+	NextCursor string
+}
+
+var defaultPage = pageRequest{Limit: defaultPageLimit, Sort: sortByEmail}
+
+// parsePageRequest reads limit, cursor, sort (email or created_at) and order (asc or desc)
+// from the query string
+func parsePageRequest(r *http.Request) (page pageRequest, err error) {
+	query := r.URL.Query()
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			err = newValidationError("limit", fmt.Sprintf("limit must be between 1 and %v", maxPageLimit))
+			return
+		}
+	}
+	return newPageRequest(limit, query.Get("cursor"), query.Get("sort"), query.Get("order"))
+}
+
+// newPageRequest validates the page, a limit of 0 picks the default limit
+func newPageRequest(limit int, cursor, sort, order string) (page pageRequest, err error) {
+	page = defaultPage
+
+	if limit != 0 {
+		if limit < 1 || limit > maxPageLimit {
+			err = newValidationError("limit", fmt.Sprintf("limit must be between 1 and %v", maxPageLimit))
+			return
+		}
+		page.Limit = limit
+	}
+
+	switch sort {
+	case "":
+	case sortByEmail, sortByCreatedAt:
+		page.Sort = sort
+	default:
+		err = newValidationError("sort", "sort must be either email or created_at")
+		return
+	}
+
+	switch order {
+	case "", "asc":
+	case "desc":
+		page.Descending = true
+	default:
+		err = newValidationError("order", "order must be either asc or desc")
+		return
+	}
+
+	if cursor != "" {
+		if page.after, err = decodeCursor(cursor); err == nil && !page.after.valid(page.Sort) {
+			page.after, err = nil, newValidationError("cursor", "invalid cursor")
+		}
+	}
+	return
+}
+
+// parseListRequest is parsePageRequest for the v1 routes, they list every user unless a limit is given
+func parseListRequest(r *http.Request) (page pageRequest, err error) {
+	page, err = parsePageRequest(r)
+	if err == nil && r.URL.Query().Get("limit") == "" {
+		page.Limit = 0
+	}
+	return
+}
+
+func decodeCursor(cursor string) (*pageCursor, error) {
+	invalid := newValidationError("cursor", "invalid cursor")
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalid
+	}
+	after := &pageCursor{}
+	if err := json.Unmarshal(decoded, after); err != nil || (after.Email == "" && after.Mentioned < 1) {
+		return nil, invalid
+	}
+	return after, nil
+}
+
+// valid tells whether the cursor can point into a list sorted by sort, the key is compared
+// with a column of that type so a forged key would fail the query
+func (c pageCursor) valid(sort string) bool {
+	if c.Email == "" {
+		return c.Key == "" && c.Mentioned > 0
+	}
+	if !isEmailValid(c.Email) || c.Mentioned != 0 {
+		return false
+	}
+	if sort == sortByCreatedAt {
+		_, err := time.Parse(cursorTimeLayout, c.Key)
+		return err == nil
+	}
+	return c.Key == c.Email
+}
+
+func (c pageCursor) encode() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// listedUsers is the condition on the users of every paged list, suspended users are left out
+const listedUsers = `list.email IS NOT NULL AND NOT EXISTS (SELECT 1 FROM suspended_users WHERE email = list.email)`
+
+// queryPage pages through a query selecting an email and a created_at column, sorting by either
+// of them with the email breaking ties so the cursor points at a single row
+func queryPage(ctx context.Context, query string, page pageRequest, args ...interface{}) (result pageResult, err error) {
+	countQuery := `SELECT count(*) FROM (` + query + `) list WHERE ` + listedUsers
+	span := traceStatement(ctx, "count", countQuery)
+	err = db.QueryRowContext(ctx, countQuery, args...).Scan(&result.Total)
+	span.End()
+	if err != nil {
+		return
+	}
+
+	column := "list.email"
+	if page.Sort == sortByCreatedAt {
+		column = "list.created_at"
+	}
+	direction, comparison := "ASC", ">"
+	if page.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	pageQuery := `SELECT list.email, list.created_at FROM (` + query + `) list WHERE ` + listedUsers
+	if page.after != nil && page.after.Email != "" {
+		pageQuery += fmt.Sprintf(" AND (%v, list.email) %v ($%v, $%v)", column, comparison, len(args)+1, len(args)+2)
+		args = append(args, page.after.Key, page.after.Email)
+	}
+	pageQuery += fmt.Sprintf(" ORDER BY %v %v, list.email %v", column, direction, direction)
+	if page.Limit > 0 {
+		// one extra row tells whether there is a next page
+		pageQuery += fmt.Sprintf(" LIMIT %v", page.Limit+1)
+	}
+
+	span = traceStatement(ctx, "page", pageQuery)
+	defer span.End()
+	rows, err := db.QueryContext(ctx, pageQuery, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var last pageCursor
+	for rows.Next() {
+		var email string
+		var createdAt time.Time
+		if err = rows.Scan(&email, &createdAt); err != nil {
+			return
+		}
+		if page.Limit > 0 && len(result.Items) == page.Limit {
+			result.NextCursor = last.encode()
+			break
+		}
+		result.Items = append(result.Items, email)
+		last = pageCursor{Key: email, Email: email}
+		if page.Sort == sortByCreatedAt {
+			last.Key = createdAt.Format(cursorTimeLayout)
+		}
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitRead  = "read"
+	rateLimitWrite = "write"
+)
+
+// rateLimit lets Burst requests through at once and refills them evenly over Per,
+// a zero Burst turns the limit off
+type rateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// rateLimits are the budgets of every client IP and of every authenticated user
+var rateLimits = map[string]rateLimit{
+	rateLimitRead:  {Burst: 600, Per: time.Minute},
+	rateLimitWrite: {Burst: 60, Per: time.Minute},
+}
+
+// parseRateLimit reads a limit such as "60/1m", "0" turns the limit off
+func parseRateLimit(value string) (rateLimit, error) {
+	if value == "0" {
+		return rateLimit{}, nil
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return rateLimit{}, fmt.Errorf("rate limit %q is not requests/duration", value)
+	}
+	burst, err := strconv.Atoi(parts[0])
+	if err != nil || burst < 0 {
+		return rateLimit{}, fmt.Errorf("rate limit %q has an invalid number of requests", value)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return rateLimit{}, fmt.Errorf("rate limit %q has an invalid duration", value)
+	}
+	return rateLimit{Burst: burst, Per: per}, nil
+}
+
+// rateDecision tells whether a request may go through and what is left of the budget,
+// Reset is how long until the bucket is full again
+type rateDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// rateLimitStore keeps the token buckets, Take spends a token of the bucket of key
+type rateLimitStore interface {
+	Take(key string, limit rateLimit, now time.Time) (rateDecision, error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	per    time.Duration
+}
+
+// memoryRateLimitStore keeps the buckets of a single instance, idle buckets are swept
+// once they would be full again
+type memoryRateLimitStore struct {
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	lastSweep  time.Time
+	sweepEvery time.Duration
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}, sweepEvery: time.Minute}
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit rateLimit, now time.Time) (rateDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	rate := float64(limit.Burst) / limit.Per.Seconds()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now, per: limit.Per}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+
+	decision := rateDecision{Limit: limit.Burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = secondsToDuration((1 - bucket.tokens) / rate)
+	}
+	decision.Remaining = int(bucket.tokens)
+	decision.Reset = secondsToDuration((float64(limit.Burst) - bucket.tokens) / rate)
+	return decision, nil
+}
+
+// sweep forgets the buckets that refilled since they were last used
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.sweepEvery {
+		return
+	}
+	s.lastSweep = now
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.last) > bucket.per {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+func newRateLimitStore(name string) (rateLimitStore, error) {
+	switch name {
+	case "", "memory":
+		return newMemoryRateLimitStore(), nil
+	default:
+		return nil, errors.New("unknown rate limit store " + name)
+	}
+}
+
+// rateLimitClass puts reads and writes in separate budgets, a GraphQL request is a write when
+// its document holds a mutation. The body is read to find out and put back for the handler
+func rateLimitClass(w http.ResponseWriter, r *http.Request) (string, error) {
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions:
+		return rateLimitRead, nil
+	case r.Method == http.MethodPost && r.URL.Path == "/graphql":
+		bodyBytes, err := readBody(w, r)
+		if err != nil {
+			return "", err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+		request := graphqlRequest{}
+		if err := json.Unmarshal(bodyBytes, &request); err != nil || graphqlHasMutation(request.Query) {
+			return rateLimitWrite, nil
+		}
+		return rateLimitRead, nil
+	default:
+		return rateLimitWrite, nil
+	}
+}
+
+// spendRateToken takes a token of the class bucket of key, a nil decision means the request
+// is not limited
+func spendRateToken(store rateLimitStore, class, key string) (*rateDecision, rateLimit) {
+	limit := rateLimits[class]
+	if key == "" || limit.Burst == 0 {
+		return nil, limit
+	}
+	decision, err := store.Take(class+":"+key, limit, time.Now())
+	if err != nil {
+		// a broken store should not take the API down with it
+		return nil, limit
+	}
+	return &decision, limit
+}
+
+func rateLimitedError(class string, decision rateDecision) error {
+	return newRateLimitedError(fmt.Sprintf("too many %v requests, retry in %v", class, decision.RetryAfter.Round(time.Second)))
+}
+
+// limitRate spends a token of the bucket keyOf returns for the request, requests keyOf has
+// no key for are let through. The headers of the most restrictive bucket are kept when
+// requests go through more than one limiter
+func limitRate(store rateLimitStore, keyOf func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyOf(r)
+			if key == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			class, err := rateLimitClass(w, r)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			decision, limit := spendRateToken(store, class, key)
+			if decision == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+			setRateLimitHeaders(w, limit, *decision)
+			if !decision.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(decision.RetryAfter.Seconds()))))
+				writeError(w, rateLimitedError(class, *decision))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limit rateLimit, decision rateDecision) {
+	if current, err := strconv.Atoi(w.Header().Get("RateLimit-Remaining")); err == nil && current <= decision.Remaining {
+		return
+	}
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%v;w=%v", limit.Burst, int(limit.Per.Seconds())))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(decision.Reset.Seconds()))))
+}
+
+// rateLimitByIP keys the buckets by client IP, it runs before authentication so that
+// requests with bad credentials are limited too. Behind a trusted proxy the client IP is
+// the one the proxy forwarded the request for
+func rateLimitByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+func rateLimitByUser(r *http.Request) string {
+	if id, ok := identityOf(r.Context()); ok {
+		return "user:" + id.Email
+	}
+	return ""
+}
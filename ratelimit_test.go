@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"app/friendspb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("60/1m")
+	if err != nil || limit != (rateLimit{Burst: 60, Per: time.Minute}) {
+		t.Fatalf("expected 60 per minute, got %+v err %v", limit, err)
+	}
+	if limit, err := parseRateLimit("0"); err != nil || limit.Burst != 0 {
+		t.Fatalf("expected the limit to be off, got %+v err %v", limit, err)
+	}
+	for _, value := range []string{"60", "x/1m", "-1/1m", "60/x", "60/0s"} {
+		if _, err := parseRateLimit(value); err == nil {
+			t.Errorf("expected %q to be refused", value)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	limit := rateLimit{Burst: 2, Per: 2 * time.Second}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if decision, _ := store.Take("key", limit, now); !decision.Allowed || decision.Remaining != 1-i {
+			t.Fatalf("expected request %v to go through, got %+v", i, decision)
+		}
+	}
+	decision, _ := store.Take("key", limit, now)
+	if decision.Allowed || decision.RetryAfter != time.Second {
+		t.Fatalf("expected the third request to wait a second, got %+v", decision)
+	}
+	if decision, _ := store.Take("other", limit, now); !decision.Allowed {
+		t.Fatalf("expected buckets to be separate, got %+v", decision)
+	}
+	if decision, _ := store.Take("key", limit, now.Add(time.Second)); !decision.Allowed {
+		t.Fatalf("expected a token to be back after a second, got %+v", decision)
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	defer func(limits map[string]rateLimit) { rateLimits = limits }(rateLimits)
+	rateLimits = map[string]rateLimit{
+		rateLimitRead:  {Burst: 2, Per: time.Minute},
+		rateLimitWrite: {Burst: 1, Per: time.Minute},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := limitRate(newMemoryRateLimitStore(), rateLimitByIP)(ok)
+
+	serve := func(method, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/friends", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(http.MethodPost, "10.0.0.1:1000"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("expected the first write to go through, got %v %v", w.Code, w.Header())
+	}
+	w := serve(http.MethodPost, "10.0.0.1:2000")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second write from the same IP to be limited, got %v", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" || w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Policy") != "1;w=60" {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+	if w := serve(http.MethodGet, "10.0.0.1:3000"); w.Code != http.StatusOK {
+		t.Errorf("expected reads to have their own budget, got %v", w.Code)
+	}
+	if w := serve(http.MethodPost, "10.0.0.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("expected another IP to have its own budget, got %v", w.Code)
+	}
+}
+
+func TestLimitRateByUser(t *testing.T) {
+	defer func(limits map[string]rateLimit) { rateLimits = limits }(rateLimits)
+	rateLimits = map[string]rateLimit{rateLimitWrite: {Burst: 1, Per: time.Minute}}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := limitRate(newMemoryRateLimitStore(), rateLimitByUser)(ok)
+
+	serve := func(email string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/friends", nil)
+		if email != "" {
+			r = r.WithContext(withIdentity(r.Context(), identity{Email: email}))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve("andy@example.com"); code != http.StatusOK {
+		t.Fatalf("expected the first write to go through, got %v", code)
+	}
+	if code := serve("andy@example.com"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the second write of the user to be limited, got %v", code)
+	}
+	if code := serve("john@example.com"); code != http.StatusOK {
+		t.Errorf("expected another user to have its own budget, got %v", code)
+	}
+	if code := serve(""); code != http.StatusOK {
+		t.Errorf("expected anonymous requests to be left to the IP limit, got %v", code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(proxies []netip.Prefix) { trustedProxies = proxies }(trustedProxies)
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		remoteAddr, forwardedFor, expected string
+	}{
+		{"203.0.113.7:1000", "198.51.100.1", "203.0.113.7"},
+		{"10.0.0.1:1000", "", "10.0.0.1"},
+		{"10.0.0.1:1000", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1000", "1.2.3.4, 198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		{"10.0.0.1:1000", "198.51.100.1, not-an-ip", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/friends", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		if ip := clientIP(r); ip != c.expected {
+			t.Errorf("expected %v from %v forwarded for %q, got %v", c.expected, c.remoteAddr, c.forwardedFor, ip)
+		}
+	}
+
+	for _, value := range []string{"10.0.0.0/33", "proxy.local"} {
+		if _, err := parseTrustedProxies(value); err == nil {
+			t.Errorf("expected %q to be refused", value)
+		}
+	}
+}
+
+func TestGraphQLHasMutation(t *testing.T) {
+	for document, expected := range map[string]bool{
+		`{ user(email: "andy@example.com") { email } }`:                    false,
+		`query Friends { user(email: "a") { friends { totalCount } } }`:    false,
+		`mutation { createFriends(friends: ["a", "b"]) { success } }`:      true,
+		"# mutation in a comment\nquery { user(email: \"a\") { email } }":  false,
+		`query { user(email: "mutation { }") { email } } mutation M { x }`: true,
+		`query { user(email: """ mutation """) { email } }`:                false,
+		`{ user(email: "\" mutation") { email } }`:                         false,
+		`query { user(email: "a") { mutationCount } }`:                     false,
+		`{ user(email: "unterminated`:                                      true,
+	} {
+		if graphqlHasMutation(document) != expected {
+			t.Errorf("expected %q to be a mutation %v", document, expected)
+		}
+	}
+}
+
+func TestLimitRateGraphQL(t *testing.T) {
+	defer func(limits map[string]rateLimit) { rateLimits = limits }(rateLimits)
+	rateLimits = map[string]rateLimit{rateLimitWrite: {Burst: 1, Per: time.Minute}}
+	var body string
+	handler := limitRate(newMemoryRateLimitStore(), rateLimitByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, _ := ioutil.ReadAll(r.Body)
+		body = string(read)
+	}))
+
+	serve := func(query string) int {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(query))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	query := `{"query": "{ user(email: \"andy@example.com\") { email } }"}`
+	for i := 0; i < 2; i++ {
+		if code := serve(query); code != http.StatusOK {
+			t.Fatalf("expected queries to be left to the read limit, got %v", code)
+		}
+	}
+	if body != query {
+		t.Errorf("expected the handler to get the body back, got %q", body)
+	}
+	mutation := `{"query": "mutation { createFriends(friends: [\"a@example.com\", \"b@example.com\"]) { success } }"}`
+	if code := serve(mutation); code != http.StatusOK {
+		t.Fatalf("expected the first mutation to go through, got %v", code)
+	}
+	if code := serve(mutation); code != http.StatusTooManyRequests {
+		t.Errorf("expected the second mutation to be limited as a write, got %v", code)
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	defer func(limits map[string]rateLimit) { rateLimits = limits }(rateLimits)
+	rateLimits = map[string]rateLimit{rateLimitWrite: {Burst: 1, Per: time.Minute}}
+	interceptor := grpcRateLimitUnary(newMemoryRateLimitStore(), grpcRateLimitByIP)
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+
+	call := func(method, addr string) error {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 1000}})
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, ok)
+		return err
+	}
+
+	if err := call(friendspb.FriendsService_CreateFriends_FullMethodName, "10.0.0.1"); err != nil {
+		t.Fatalf("expected the first write to go through, got %v", err)
+	}
+	if err := call(friendspb.FriendsService_CreateFriends_FullMethodName, "10.0.0.1"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected the second write of the peer to be limited, got %v", err)
+	}
+	if err := call(friendspb.FriendsService_ListFriends_FullMethodName, "10.0.0.1"); err != nil {
+		t.Errorf("expected reads to have their own budget, got %v", err)
+	}
+	if err := call(friendspb.FriendsService_CreateFriends_FullMethodName, "10.0.0.2"); err != nil {
+		t.Errorf("expected another peer to have its own budget, got %v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"strings"
 )
 
@@ -14,34 +13,34 @@ type relationship struct {
 type relationships []relationship
 
 func (r relationships) isBlocked() (isBlocked bool, err error) {
-	messages := []string{}
-	for _, relationship := range r {
-		if relationship.Status == relationshipIsBlocked {
-			messages = append(messages, relationship.Requestor+" has blocked "+relationship.Target)
-			isBlocked = true
-		}
-	}
-	return isBlocked, errors.New(strings.Join(messages, ","))
+	details := r.describe(relationshipIsBlocked, " has blocked ")
+	return len(details) > 0, newBlockedError(joinDetails(details), details...)
 }
 
 func (r relationships) isFriend() (isFriend bool, err error) {
-	messages := []string{}
+	details := r.describe(relationshipIsFriend, " is already a friend of ")
+	return len(details) > 0, newConflictError("already_friends", joinDetails(details), details...)
+}
+
+func (r relationships) isSubscribed() (isSubscribed bool, err error) {
+	details := r.describe(relationshipIsSubscribed, " has already subscribed to ")
+	return len(details) > 0, newConflictError("already_subscribed", joinDetails(details), details...)
+}
+
+// describe explains every relationship with the given status, one detail per relationship
+func (r relationships) describe(status, verb string) (details []fieldError) {
 	for _, relationship := range r {
-		if relationship.Status == relationshipIsFriend {
-			messages = append(messages, relationship.Requestor+" is already a friend of "+relationship.Target)
-			isFriend = true
+		if relationship.Status == status {
+			details = append(details, fieldError{Message: relationship.Requestor + verb + relationship.Target})
 		}
 	}
-	return isFriend, errors.New(strings.Join(messages, ","))
+	return
 }
 
-func (r relationships) isSubscribed() (isSubscribed bool, err error) {
+func joinDetails(details []fieldError) string {
 	messages := []string{}
-	for _, relationship := range r {
-		if relationship.Status == relationshipIsSubscribed {
-			messages = append(messages, relationship.Requestor+" has already subscribed to "+relationship.Target)
-			isSubscribed = true
-		}
+	for _, detail := range details {
+		messages = append(messages, detail.Message)
 	}
-	return isSubscribed, errors.New(strings.Join(messages, ","))
+	return strings.Join(messages, ",")
 }
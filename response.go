@@ -2,53 +2,170 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"net/http"
 )
 
+// responseStatus is shared by every response, Errors keeps the human readable message
+// while Code and Details describe the error for machines
+type responseStatus struct {
+	Success bool         `json:"success"`
+	Errors  string       `json:"errors,omitempty"`
+	Code    string       `json:"code,omitempty"`
+	Details []fieldError `json:"details,omitempty"`
+}
+
 type handlerResponse struct {
-	Success    bool     `json:"success"`
-	Errors     string   `json:"errors,omitempty"`
-	Friends    []string `json:"friends,omitempty"`
-	Count      int      `json:"count,omitempty"`
-	Recipients []string `json:"recipients,omitempty"`
+	responseStatus
+	Friends    []string          `json:"friends,omitempty"`
+	Count      int               `json:"count,omitempty"`
+	Total      int               `json:"total,omitempty"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+	Recipients []string          `json:"recipients,omitempty"`
+	Webhooks   []webhook         `json:"webhooks,omitempty"`
+	Deliveries []webhookDelivery `json:"deliveries,omitempty"`
+	Digests    []digest          `json:"digests,omitempty"`
+	Messages   []storedMessage   `json:"messages,omitempty"`
+	Results    []batchResult     `json:"results,omitempty"`
+	APIKey     *apiKey           `json:"api_key,omitempty"`
+
+	Relationships []relationshipRow `json:"relationships,omitempty"`
+	Suspension    *suspension       `json:"suspension,omitempty"`
+	AuditLog      []auditEntry      `json:"audit_log,omitempty"`
+}
+
+type previewResponse struct {
+	responseStatus
+	messagePreview
 }
 
 type response interface {
 	listFriends() []string
 	getCount() int
 	listSubscribers() []string
+	getTotal() int
+	getNextCursor() string
 }
 
-func makeNewResponse(r response, err error) json.RawMessage {
-	success := true
-	var errString string
+func (s *responseStatus) setError(err error) {
+	s.Success = err == nil
+	if err == nil {
+		return
+	}
+	apiErr := toAPIError(err)
+	s.Errors = apiErr.Message
+	s.Code = apiErr.Code
+	s.Details = apiErr.Details
+}
+
+// writeResponse writes the body with the status code matching err
+func writeResponse(w http.ResponseWriter, body json.RawMessage, err error) {
 	if err != nil {
-		success = false
-		errString = err.Error()
+		noteError(w, err)
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode(err))
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeResponse(w, makeSimpleResponse(err), err)
+}
+
+func makeNewResponse(r response, err error) json.RawMessage {
 	res := handlerResponse{
-		Success:    success,
-		Errors:     errString,
 		Friends:    r.listFriends(),
 		Count:      r.getCount(),
 		Recipients: r.listSubscribers(),
+		Total:      r.getTotal(),
+		NextCursor: r.getNextCursor(),
+	}
+	res.setError(err)
+	json, err := json.Marshal(res)
+	if err != nil {
+		slog.Error("failed to encode the response", "err", err)
+	}
+	return json
+}
+
+func makeSimpleResponse(err error) json.RawMessage {
+	handlerResponse := &handlerResponse{}
+	handlerResponse.setError(err)
+	json, err := json.Marshal(handlerResponse)
+	if err != nil {
+		slog.Error("failed to encode the response", "err", err)
+	}
+	return json
+}
+
+func makeWebhookResponse(webhooks []webhook, deliveries []webhookDelivery, err error) json.RawMessage {
+	handlerResponse := &handlerResponse{Webhooks: webhooks, Deliveries: deliveries}
+	handlerResponse.setError(err)
+	json, err := json.Marshal(handlerResponse)
+	if err != nil {
+		slog.Error("failed to encode the response", "err", err)
+	}
+	return json
+}
+
+func makeDigestResponse(digests []digest, err error) json.RawMessage {
+	handlerResponse := &handlerResponse{Digests: digests, Count: len(digests)}
+	handlerResponse.setError(err)
+	json, err := json.Marshal(handlerResponse)
+	if err != nil {
+		slog.Error("failed to encode the response", "err", err)
 	}
+	return json
+}
+
+func makePreviewResponse(preview messagePreview, err error) json.RawMessage {
+	res := previewResponse{messagePreview: preview}
+	res.setError(err)
 	json, err := json.Marshal(res)
 	if err != nil {
-		log.Println(err)
+		slog.Error("failed to encode the response", "err", err)
+	}
+	return json
+}
+
+func makeMessageResponse(messages []storedMessage, recipients []string, err error) json.RawMessage {
+	handlerResponse := &handlerResponse{Messages: messages, Recipients: recipients}
+	handlerResponse.setError(err)
+	json, err := json.Marshal(handlerResponse)
+	if err != nil {
+		slog.Error("failed to encode the response", "err", err)
+	}
+	return json
+}
+
+func makeBatchResponse(results []batchResult, err error) json.RawMessage {
+	handlerResponse := &handlerResponse{Results: results}
+	handlerResponse.setError(err)
+	json, err := json.Marshal(handlerResponse)
+	if err != nil {
+		slog.Error("failed to encode the response", "err", err)
 	}
 	return json
 }
 
-func makeSimpleResponse(errMessage string) json.RawMessage {
-	handlerResponse := &handlerResponse{Success: true}
-	if errMessage != "" {
-		handlerResponse.Success = false
-		handlerResponse.Errors = errMessage
+func makeAPIKeyResponse(key apiKey, err error) json.RawMessage {
+	handlerResponse := &handlerResponse{}
+	if err == nil {
+		handlerResponse.APIKey = &key
+	}
+	handlerResponse.setError(err)
+	json, err := json.Marshal(handlerResponse)
+	if err != nil {
+		slog.Error("failed to encode the response", "err", err)
 	}
+	return json
+}
+
+func makeAdminResponse(handlerResponse *handlerResponse, err error) json.RawMessage {
+	handlerResponse.setError(err)
 	json, err := json.Marshal(handlerResponse)
 	if err != nil {
-		log.Println(err)
+		slog.Error("failed to encode the response", "err", err)
 	}
 	return json
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"net/http"
+
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -8,10 +10,54 @@ var router *httprouter.Router
 
 func init() {
 	router = httprouter.New()
-	router.POST("/api/friends", createFriendsHandler)
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, newNotFoundError(errorCodeNotFound, "route does not exist"))
+	})
+
+	// v1, kept for compatibility
+	router.POST("/api/friends", idempotent(createFriendsHandler))
 	router.GET("/api/friends", getFriendsListHandler)
 	router.GET("/api/friends/common", getCommonFriendsListHandler)
-	router.POST("/api/friends/subscribe", subscribeUpdatesHandler)
-	router.POST("/api/friends/block", blockUpdatesHandler)
+	router.POST("/api/friends/subscribe", idempotent(subscribeUpdatesHandler))
+	router.POST("/api/friends/block", idempotent(blockUpdatesHandler))
 	router.GET("/api/friends/subscribe", getSubscribedListHandler)
+	router.POST("/api/batch", idempotent(batchHandler))
+	router.POST("/api/webhooks", adminOnly(registerWebhookHandler))
+	router.GET("/api/webhooks", adminOnly(getWebhooksHandler))
+	router.DELETE("/api/webhooks/:id", adminOnly(deleteWebhookHandler))
+	router.GET("/api/webhooks/:id/deliveries", adminOnly(getWebhookDeliveriesHandler))
+	router.POST("/api/webhooks/:id/deliveries/:delivery/retry", adminOnly(retryWebhookDeliveryHandler))
+	router.POST("/api/digests/preferences", saveDeliveryPreferenceHandler)
+	router.GET("/api/digests", getDigestsHandler)
+	router.POST("/api/messages/preview", previewMessageHandler)
+	router.POST("/api/messages", postMessageHandler)
+	router.POST("/api/messages/replies", postReplyHandler)
+	router.GET("/api/messages/:id/thread", getThreadHandler)
+	router.POST("/api/messages/reactions", addReactionHandler)
+	router.DELETE("/api/messages/reactions", removeReactionHandler)
+	router.POST("/api/keys", adminOnly(createAPIKeyHandler))
+	router.DELETE("/api/keys/:id", adminOnly(revokeAPIKeyHandler))
+	router.GET("/api/openapi.json", openAPIHandler)
+	router.GET("/api/docs", apiDocsHandler)
+	router.POST("/graphql", idempotent(graphqlHandler))
+	router.GET("/healthz", healthzHandler)
+	router.GET("/readyz", readyzHandler)
+	router.GET("/metrics", adminOnly(metricsHandler))
+
+	// admin, the handlers audit every action
+	router.GET("/api/admin/relationships", moderatorOnly(getRelationshipRowsHandler))
+	router.GET("/api/admin/relationships/export", adminOnly(exportRelationshipsHandler))
+	router.DELETE("/api/admin/users/:email/relationships/:other", moderatorOnly(removeRelationshipsHandler))
+	router.POST("/api/admin/users/:email/suspension", moderatorOnly(suspendUserHandler))
+	router.DELETE("/api/admin/users/:email/suspension", moderatorOnly(unsuspendUserHandler))
+	router.POST("/api/admin/unblocks", moderatorOnly(unblockHandler))
+	router.GET("/api/admin/audit", adminOnly(getAuditLogHandler))
+
+	// v2
+	router.GET("/api/v2/users/:email/friends", getFriendsListV2Handler)
+	router.POST("/api/v2/users/:email/friends/:friend", idempotent(createFriendsV2Handler))
+	router.GET("/api/v2/users/:email/common/:other", getCommonFriendsListV2Handler)
+	router.GET("/api/v2/users/:email/recipients", getRecipientsV2Handler)
+	router.POST("/api/v2/users/:email/subscriptions/:target", idempotent(subscribeUpdatesV2Handler))
+	router.POST("/api/v2/users/:email/blocks/:target", idempotent(blockUpdatesV2Handler))
 }
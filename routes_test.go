@@ -1,7 +1,10 @@
 package test
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"log"
@@ -9,27 +12,84 @@ import (
 	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
 )
 
 var (
 	baseAPI = "http://localhost:3000/api"
 )
 
+// testAdminKey is stored by resetDB, the admin scope lets the tests act as any user
+const testAdminKey = "test-admin-key"
+
+// apiKeyTransport sends testAdminKey with every request that has no credentials of its own
+type apiKeyTransport struct{}
+
+func (apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-API-Key") == "" && req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-API-Key", testAdminKey)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 type testStruct struct {
 	arrayRequestBody  url.Values
 	stringRequestBody string
+	statusCode        int
+	code              string
+	details           []errorDetail
 	expectedResult
 }
 
+// errorResult is the error part of a response
+type errorResult struct {
+	Code    string        `json:"code"`
+	Details []errorDetail `json:"details"`
+}
+
+type errorDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// checkError compares the code and the details of a response in any order of the details
+func checkError(t *testing.T, body []byte, code string, details []errorDetail) {
+	t.Helper()
+	actual := errorResult{}
+	if err := json.Unmarshal(body, &actual); err != nil {
+		t.Errorf("failed to unmarshal test result %v", err)
+	}
+	if actual.Code != code {
+		t.Errorf("expecting code %q but have %q", code, actual.Code)
+	}
+	sorted := func(details []errorDetail) string {
+		lines := []string{}
+		for _, detail := range details {
+			lines = append(lines, detail.Field+": "+detail.Message)
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	}
+	if sorted(actual.Details) != sorted(details) {
+		t.Errorf("expecting details %v but have %v", details, actual.Details)
+	}
+}
+
+// expectedResult also builds request bodies, omitempty keeps the fields a request does not know about out of it
 type expectedResult struct {
-	Success    bool     `json:"success"`
-	Friends    []string `json:"friends"`
-	Count      int      `json:"count"`
-	Recipients []string `json:"recipients"`
+	Success    bool     `json:"success,omitempty"`
+	Friends    []string `json:"friends,omitempty"`
+	Count      int      `json:"count,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	Total      int      `json:"total,omitempty"`
+	NextCursor string   `json:"next_cursor,omitempty"`
 }
 
 type user struct {
@@ -37,16 +97,17 @@ type user struct {
 }
 
 type userActions struct {
-	Requestor string `json:"requestor"`
-	Target    string `json:"target"`
-	Sender    string `json:"sender"`
-	Text      string `json:"text"`
+	Requestor string `json:"requestor,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Sender    string `json:"sender,omitempty"`
+	Text      string `json:"text,omitempty"`
 }
 
 func init() {
 	if os.Getenv("GO_ENV") == "test" {
 		baseAPI = "http://localhost:3001/api"
 	}
+	http.DefaultClient.Transport = apiKeyTransport{}
 }
 
 func TestCreateFriends(t *testing.T) {
@@ -55,22 +116,38 @@ func TestCreateFriends(t *testing.T) {
 		{
 			"friends": []string{"andy@example.com", "john@example.com"},
 			"success": true,
+			"status":  200,
 		},
 		{ // duplicate request
 			"friends": []string{"andy@example.com", "john@example.com"},
 			"success": false,
+			"status":  409,
+			"code":    "already_friends",
+			"details": []errorDetail{
+				{Message: "andy@example.com is already a friend of john@example.com"},
+				{Message: "john@example.com is already a friend of andy@example.com"},
+			},
 		},
 		{ // same user
 			"friends": []string{"andy@example.com", "andy@example.com"},
 			"success": false,
+			"status":  422,
+			"code":    "validation_failed",
+			"details": []errorDetail{{"friends", "cannot be friends with oneself"}},
 		},
 		{ // insufficient user
 			"friends": []string{"andy@example.com"},
 			"success": false,
+			"status":  422,
+			"code":    "validation_failed",
+			"details": []errorDetail{{"friends", "incorrect number of friends"}},
 		},
 		{ // invalid user format
 			"friends": []string{"andy", "john"},
 			"success": false,
+			"status":  422,
+			"code":    "validation_failed",
+			"details": []errorDetail{{"friends", "invalid email being submitted"}},
 		},
 	}
 
@@ -81,8 +158,13 @@ func TestCreateFriends(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
+		code, _ := testSample["code"].(string)
+		details, _ := testSample["details"].([]errorDetail)
 		testCases = append(testCases, testStruct{
 			stringRequestBody: string(jsonTestUser),
+			statusCode:        testSample["status"].(int),
+			code:              code,
+			details:           details,
 			expectedResult: expectedResult{
 				Success: testSample["success"].(bool),
 			},
@@ -100,8 +182,8 @@ func TestCreateFriends(t *testing.T) {
 			t.Error(err)
 		}
 
-		if res.StatusCode != 200 {
-			t.Errorf("expecting status code of 200 but have %v", res.StatusCode)
+		if res.StatusCode != testCase.statusCode {
+			t.Errorf("expecting status code of %v but have %v", testCase.statusCode, res.StatusCode)
 		}
 
 		bodyBytes, _ := ioutil.ReadAll(res.Body)
@@ -112,6 +194,7 @@ func TestCreateFriends(t *testing.T) {
 		if actualResult.Success != testCase.expectedResult.Success {
 			t.Errorf("expecting %v but have %v", testCase.expectedResult.Success, actualResult.Success)
 		}
+		checkError(t, bodyBytes, testCase.code, testCase.details)
 	}
 }
 
@@ -147,6 +230,7 @@ func TestGetFriendsList(t *testing.T) {
 		}
 		testCases = append(testCases, testStruct{
 			stringRequestBody: string(jsonTestUser),
+			statusCode:        map[bool]int{true: 200, false: 404}[testUser["count"].(int) > 0],
 			expectedResult: expectedResult{
 				Success: testUser["count"].(int) > 0,
 				Friends: testUser["friends"].([]string),
@@ -167,8 +251,8 @@ func TestGetFriendsList(t *testing.T) {
 			t.Error(err)
 		}
 
-		if res.StatusCode != 200 {
-			t.Errorf("expecting status code of 200 but have %v", res.StatusCode)
+		if res.StatusCode != testCase.statusCode {
+			t.Errorf("expecting status code of %v but have %v", testCase.statusCode, res.StatusCode)
 		}
 
 		bodyBytes, _ := ioutil.ReadAll(res.Body)
@@ -326,6 +410,7 @@ func TestGetCommonFriendsList(t *testing.T) {
 		}
 		testCases = append(testCases, testStruct{
 			stringRequestBody: string(jsonTestUser),
+			statusCode:        map[bool]int{true: 200, false: 404}[testUser["count"].(int) > 0],
 			expectedResult: expectedResult{
 				Success: testUser["count"].(int) > 0,
 				Friends: testUser["commonFriends"].([]string),
@@ -345,8 +430,8 @@ func TestGetCommonFriendsList(t *testing.T) {
 			t.Error(err)
 		}
 
-		if res.StatusCode != 200 {
-			t.Errorf("expecting status code of 200 but have %v", res.StatusCode)
+		if res.StatusCode != testCase.statusCode {
+			t.Errorf("expecting status code of %v but have %v", testCase.statusCode, res.StatusCode)
 		}
 
 		bodyBytes, _ := ioutil.ReadAll(res.Body)
@@ -372,11 +457,15 @@ func TestGetCommonFriendsList(t *testing.T) {
 func TestSubScribeUpdates(t *testing.T) {
 	resetDB()
 	testSubscribeSamples := []map[string]interface{}{
-		{"json": userActions{Requestor: "lisa@example.com", Target: "john@example.com"}, "expectedResult": true},
-		{"json": userActions{Requestor: "lisa@example.com", Target: "john@example.com"}, "expectedResult": false},
-		{"json": userActions{Requestor: "lisa@example.com"}, "expectedResult": false},
-		{"json": userActions{Target: "john@example.com"}, "expectedResult": false},
-		{"json": userActions{}, "expectedResult": false},
+		{"json": userActions{Requestor: "lisa@example.com", Target: "john@example.com"}, "expectedResult": true, "status": 200},
+		{"json": userActions{Requestor: "lisa@example.com", Target: "john@example.com"}, "expectedResult": false, "status": 409,
+			"code": "already_subscribed", "details": []errorDetail{{Message: "lisa@example.com has already subscribed to john@example.com"}}},
+		{"json": userActions{Requestor: "lisa@example.com"}, "expectedResult": false, "status": 422,
+			"code": "validation_failed", "details": []errorDetail{{"target", "no target was provided"}}},
+		{"json": userActions{Target: "john@example.com"}, "expectedResult": false, "status": 422,
+			"code": "validation_failed", "details": []errorDetail{{"requestor", "no requestor was provided"}}},
+		{"json": userActions{}, "expectedResult": false, "status": 422,
+			"code": "validation_failed", "details": []errorDetail{{"requestor", "no requestor was provided"}, {"target", "no target was provided"}}},
 	}
 	testCases := []testStruct{}
 	for _, testSubscribeSample := range testSubscribeSamples {
@@ -384,8 +473,13 @@ func TestSubScribeUpdates(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
+		code, _ := testSubscribeSample["code"].(string)
+		details, _ := testSubscribeSample["details"].([]errorDetail)
 		testCases = append(testCases, testStruct{
 			stringRequestBody: string(json),
+			statusCode:        testSubscribeSample["status"].(int),
+			code:              code,
+			details:           details,
 			expectedResult: expectedResult{
 				Success: testSubscribeSample["expectedResult"].(bool),
 			},
@@ -404,8 +498,8 @@ func TestSubScribeUpdates(t *testing.T) {
 			t.Error(err)
 		}
 
-		if res.StatusCode != 200 {
-			t.Errorf("expecting status code of 200 but have %v", res.StatusCode)
+		if res.StatusCode != testCase.statusCode {
+			t.Errorf("expecting status code of %v but have %v", testCase.statusCode, res.StatusCode)
 		}
 
 		bodyBytes, _ := ioutil.ReadAll(res.Body)
@@ -416,6 +510,7 @@ func TestSubScribeUpdates(t *testing.T) {
 		if actualResult.Success != testCase.expectedResult.Success {
 			t.Errorf("expecting %v but have %v", testCase.expectedResult.Success, actualResult.Success)
 		}
+		checkError(t, bodyBytes, testCase.code, testCase.details)
 	}
 
 	// ensure no friends are created
@@ -433,6 +528,7 @@ func TestSubScribeUpdates(t *testing.T) {
 		}
 		testCases = append(testCases, testStruct{
 			stringRequestBody: string(jsonTestUser),
+			statusCode:        map[bool]int{true: 200, false: 404}[testUser["count"].(int) > 0],
 			expectedResult: expectedResult{
 				Success: testUser["count"].(int) > 0,
 				Friends: testUser["friends"].([]string),
@@ -452,8 +548,8 @@ func TestSubScribeUpdates(t *testing.T) {
 			t.Error(err)
 		}
 
-		if res.StatusCode != 200 {
-			t.Errorf("expecting status code of 200 but have %v", res.StatusCode)
+		if res.StatusCode != testCase.statusCode {
+			t.Errorf("expecting status code of %v but have %v", testCase.statusCode, res.StatusCode)
 		}
 
 		bodyBytes, _ := ioutil.ReadAll(res.Body)
@@ -477,11 +573,11 @@ func TestBlockUpdates(t *testing.T) {
 	resetDB()
 	// block not connected users
 	testSubscribeSamples := []map[string]interface{}{
-		{"json": userActions{Requestor: "andy@example.com", Target: "john@example.com"}, "expectedResult": true},
-		{"json": userActions{Requestor: "andy@example.com", Target: "john@example.com"}, "expectedResult": false},
-		{"json": userActions{Requestor: "andy@example.com"}, "expectedResult": false},
-		{"json": userActions{Target: "john@example.com"}, "expectedResult": false},
-		{"json": userActions{}, "expectedResult": false},
+		{"json": userActions{Requestor: "andy@example.com", Target: "john@example.com"}, "expectedResult": true, "status": 200},
+		{"json": userActions{Requestor: "andy@example.com", Target: "john@example.com"}, "expectedResult": false, "status": 409},
+		{"json": userActions{Requestor: "andy@example.com"}, "expectedResult": false, "status": 422},
+		{"json": userActions{Target: "john@example.com"}, "expectedResult": false, "status": 422},
+		{"json": userActions{}, "expectedResult": false, "status": 422},
 	}
 
 	testCases := []testStruct{}
@@ -492,6 +588,7 @@ func TestBlockUpdates(t *testing.T) {
 		}
 		testCases = append(testCases, testStruct{
 			stringRequestBody: string(json),
+			statusCode:        testSubscribeSample["status"].(int),
 			expectedResult: expectedResult{
 				Success: testSubscribeSample["expectedResult"].(bool),
 			},
@@ -509,8 +606,8 @@ func TestBlockUpdates(t *testing.T) {
 			t.Error(err)
 		}
 
-		if res.StatusCode != 200 {
-			t.Errorf("expecting status code of 200 but have %v", res.StatusCode)
+		if res.StatusCode != testCase.statusCode {
+			t.Errorf("expecting status code of %v but have %v", testCase.statusCode, res.StatusCode)
 		}
 
 		bodyBytes, _ := ioutil.ReadAll(res.Body)
@@ -673,6 +770,11 @@ func TestGetSubscribersList(t *testing.T) {
 			"success":    true,
 			"recipients": []string{"andy@example.com", "lisa@example.com", "sean@example.com", "kate@example.com", "cathy@example.com", "someone@example.com"},
 		},
+		{ // with a subscriber mentioned in message
+			"test":       userActions{Sender: "john@example.com", Text: "Hello World! andy@example.com"},
+			"success":    true,
+			"recipients": []string{"andy@example.com", "lisa@example.com", "sean@example.com"},
+		},
 		{ // with invalid mention in message
 			"test":       userActions{Sender: "john@example.com", Text: "Hello World! kate@exam@ple.com"},
 			"success":    true,
@@ -703,6 +805,7 @@ func TestGetSubscribersList(t *testing.T) {
 		}
 		testCases = append(testCases, testStruct{
 			stringRequestBody: string(jsonTest),
+			statusCode:        map[bool]int{true: 200, false: 422}[testSample["success"].(bool)],
 			expectedResult: expectedResult{
 				Success:    testSample["success"].(bool),
 				Recipients: testSample["recipients"].([]string),
@@ -721,8 +824,8 @@ func TestGetSubscribersList(t *testing.T) {
 			t.Error(err)
 		}
 
-		if res.StatusCode != 200 {
-			t.Errorf("expecting status code of 200 but have %v", res.StatusCode)
+		if res.StatusCode != testCase.statusCode {
+			t.Errorf("expecting status code of %v but have %v", testCase.statusCode, res.StatusCode)
 		}
 
 		bodyBytes, _ := ioutil.ReadAll(res.Body)
@@ -740,6 +843,692 @@ func TestGetSubscribersList(t *testing.T) {
 			t.Errorf("expecting %v but have %v", testCase.expectedResult.Recipients, actualResult.Recipients)
 		}
 	}
+
+	// the mentioned users come first and count towards the limit and the total once
+	pages := [][]string{{"kate@example.com", "andy@example.com"}, {"lisa@example.com", "sean@example.com"}}
+	cursor := ""
+	for i, expected := range pages {
+		req, _ := http.NewRequest("GET", baseAPI+"/friends/subscribe?limit=2&cursor="+cursor,
+			strings.NewReader(`{"sender": "john@example.com", "text": "kate@example.com andy@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		actualResult := expectedResult{}
+		if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+		if strings.Join(actualResult.Recipients, ",") != strings.Join(expected, ",") || actualResult.Total != 4 {
+			t.Errorf("expecting %v of 4 but have %v of %v for page %v", expected, actualResult.Recipients, actualResult.Total, i+1)
+		}
+		cursor = actualResult.NextCursor
+	}
+	if cursor != "" {
+		t.Errorf("expecting no cursor after the last page but have %v", cursor)
+	}
+}
+
+func TestPreviewMessage(t *testing.T) {
+	resetDB()
+	// add connections, a subscriber and a block
+	// err and result checks are omitted intentionally
+	newFriends := [][]string{
+		{"andy@example.com", "john@example.com"},
+		{"lisa@example.com", "john@example.com"},
+		{"kate@example.com", "andy@example.com"},
+	}
+	for _, newFriend := range newFriends {
+		json, _ := json.Marshal(expectedResult{Friends: newFriend})
+		req, _ := http.NewRequest("POST", baseAPI+"/friends", strings.NewReader(string(json)))
+		req.Header.Set("Content-Type", "application/json")
+		http.DefaultClient.Do(req)
+	}
+	// mike is blocked without being part of the audience, so is not listed as dropped from it
+	userActionSamples := []struct {
+		path   string
+		action userActions
+	}{
+		{"/friends/subscribe", userActions{Requestor: "sean@example.com", Target: "john@example.com"}},
+		{"/friends/block", userActions{Requestor: "john@example.com", Target: "lisa@example.com"}},
+		{"/friends/block", userActions{Requestor: "john@example.com", Target: "mike@example.com"}},
+	}
+	for _, userAction := range userActionSamples {
+		json, _ := json.Marshal(userAction.action)
+		req, _ := http.NewRequest("POST", baseAPI+userAction.path, strings.NewReader(string(json)))
+		req.Header.Set("Content-Type", "application/json")
+		http.DefaultClient.Do(req)
+	}
+
+	preview := `{"sender": "john@example.com", "text": "Hello World! cathy@example.com, lisa@example.com and cathy@example.com", "second_degree": true}`
+	req, err := http.NewRequest("POST", baseAPI+"/messages/preview", strings.NewReader(preview))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	actualResult := struct {
+		expectedResult
+		Mentioned         []string `json:"mentioned"`
+		Blocked           []string `json:"blocked"`
+		SecondDegreeCount int      `json:"second_degree_count"`
+	}{}
+	if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+		t.Errorf("failed to unmarshal test result %v", err)
+	}
+	if actualResult.Success != true {
+		t.Errorf("expecting %v but have %v %v", true, actualResult.Success, string(bodyBytes))
+	}
+
+	sort.Strings(actualResult.Recipients)
+	expectedRecipients := []string{"andy@example.com", "cathy@example.com", "sean@example.com"}
+	if strings.Join(actualResult.Recipients, ",") != strings.Join(expectedRecipients, ",") {
+		t.Errorf("expecting %v but have %v", expectedRecipients, actualResult.Recipients)
+	}
+	if strings.Join(actualResult.Mentioned, ",") != "cathy@example.com,lisa@example.com" {
+		t.Errorf("expecting %v but have %v", []string{"cathy@example.com", "lisa@example.com"}, actualResult.Mentioned)
+	}
+	if strings.Join(actualResult.Blocked, ",") != "lisa@example.com" {
+		t.Errorf("expecting %v but have %v", []string{"lisa@example.com"}, actualResult.Blocked)
+	}
+	if actualResult.SecondDegreeCount != 1 {
+		t.Errorf("expecting %v but have %v", 1, actualResult.SecondDegreeCount)
+	}
+}
+
+type threadResult struct {
+	Success  bool `json:"success"`
+	Messages []struct {
+		ID        int            `json:"id"`
+		Sender    string         `json:"sender"`
+		Reactions map[string]int `json:"reactions"`
+	} `json:"messages"`
+}
+
+func TestMessageThreads(t *testing.T) {
+	resetDB()
+	postJSON := func(method, path, body string) threadResult {
+		req, err := http.NewRequest(method, baseAPI+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		result := threadResult{}
+		if err := json.Unmarshal(bodyBytes, &result); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+		return result
+	}
+
+	// andy blocks lisa before starting the thread
+	postJSON("POST", "/friends/block", `{"requestor": "andy@example.com", "target": "lisa@example.com"}`)
+
+	root := postJSON("POST", "/messages", `{"sender": "andy@example.com", "text": "Hello World!"}`)
+	if !root.Success || len(root.Messages) != 1 {
+		t.Fatalf("expecting the message to be stored but have %v", root)
+	}
+	rootID := strconv.Itoa(root.Messages[0].ID)
+	if result := postJSON("POST", "/messages", `{"sender": "andy@example.com", "text": ""}`); result.Success {
+		t.Errorf("expecting a message without text to be refused but have %v", result)
+	}
+
+	testSamples := []map[string]interface{}{
+		{"body": `{"parent_id": ` + rootID + `, "sender": "john@example.com", "text": "Hi andy"}`, "success": true},
+		{"body": `{"parent_id": ` + rootID + `, "sender": "lisa@example.com", "text": "Hi andy"}`, "success": false},
+		{"body": `{"parent_id": ` + rootID + `, "sender": "john@example.com"}`, "success": false},
+		{"body": `{"parent_id": 0, "sender": "john@example.com", "text": "Hi andy"}`, "success": false},
+	}
+	for _, testSample := range testSamples {
+		result := postJSON("POST", "/messages/replies", testSample["body"].(string))
+		if result.Success != testSample["success"].(bool) {
+			t.Errorf("expecting %v but have %v for %v", testSample["success"], result.Success, testSample["body"])
+		}
+	}
+
+	reactions := []string{
+		`{"message_id": ` + rootID + `, "email": "john@example.com", "emoji": "👍"}`,
+		`{"message_id": ` + rootID + `, "email": "kate@example.com", "emoji": "👍"}`,
+		`{"message_id": ` + rootID + `, "email": "kate@example.com", "emoji": "🎉"}`,
+	}
+	for _, reaction := range reactions {
+		if result := postJSON("POST", "/messages/reactions", reaction); !result.Success {
+			t.Errorf("expecting %v but have %v for %v", true, result.Success, reaction)
+		}
+	}
+	if result := postJSON("POST", "/messages/reactions", `{"message_id": `+rootID+`, "email": "lisa@example.com", "emoji": "👍"}`); result.Success {
+		t.Errorf("expecting %v but have %v", false, result.Success)
+	}
+
+	thread := postJSON("GET", "/messages/"+rootID+"/thread?email=john@example.com", "")
+	if !thread.Success || len(thread.Messages) != 2 {
+		t.Fatalf("expecting a thread of 2 messages but have %v", thread)
+	}
+	if thread.Messages[0].Reactions["👍"] != 2 || thread.Messages[0].Reactions["🎉"] != 1 {
+		t.Errorf("expecting %v but have %v", map[string]int{"👍": 2, "🎉": 1}, thread.Messages[0].Reactions)
+	}
+
+	if thread := postJSON("GET", "/messages/"+rootID+"/thread?email=lisa@example.com", ""); thread.Success {
+		t.Errorf("expecting %v but have %v", false, thread.Success)
+	}
+}
+
+func TestV2QueryParameters(t *testing.T) {
+	resetDB()
+	newFriends := []string{
+		"/v2/users/andy@example.com/friends/john@example.com",
+		"/v2/users/andy@example.com/friends/lisa@example.com",
+		"/v2/users/john@example.com/friends/lisa@example.com",
+		"/v2/users/sean@example.com/subscriptions/john@example.com",
+	}
+	for _, newFriend := range newFriends {
+		res, err := http.Post(baseAPI+newFriend, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		actualResult := expectedResult{}
+		if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+		if actualResult.Success != true {
+			t.Errorf("expecting %v but have %v for %v", true, actualResult.Success, newFriend)
+		}
+	}
+
+	testSamples := []map[string]interface{}{
+		{"path": "/v2/users/andy@example.com/friends", "friends": []string{"john@example.com", "lisa@example.com"}},
+		{"path": "/v2/users/andy@example.com/common/john@example.com", "friends": []string{"lisa@example.com"}},
+		{"path": "/v2/users/john@example.com/recipients?text=hi%20kate@example.com", "recipients": []string{"andy@example.com", "kate@example.com", "lisa@example.com", "sean@example.com"}},
+	}
+	for _, testSample := range testSamples {
+		res, err := http.Get(baseAPI + testSample["path"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		actualResult := expectedResult{}
+		if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+
+		expected, actual := testSample["friends"], actualResult.Friends
+		if recipients, ok := testSample["recipients"]; ok {
+			expected, actual = recipients, actualResult.Recipients
+		}
+		sort.Strings(actual)
+		if strings.Join(actual, ",") != strings.Join(expected.([]string), ",") {
+			t.Errorf("expecting %v but have %v for %v", expected, actual, testSample["path"])
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	resetDB()
+	friends := []string{"bob@example.com", "carl@example.com", "dave@example.com", "erin@example.com", "fred@example.com"}
+	for _, friend := range friends {
+		res, err := http.Post(baseAPI+"/v2/users/andy@example.com/friends/"+friend, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	testSamples := []map[string]interface{}{
+		{"query": "limit=2", "pages": [][]string{friends[:2], friends[2:4], friends[4:]}},
+		{"query": "limit=2&order=desc", "pages": [][]string{{friends[4], friends[3]}, {friends[2], friends[1]}, {friends[0]}}},
+		{"query": "limit=3&sort=created_at", "pages": [][]string{friends[:3], friends[3:]}},
+	}
+	for _, testSample := range testSamples {
+		cursor := ""
+		for i, expected := range testSample["pages"].([][]string) {
+			path := baseAPI + "/v2/users/andy@example.com/friends?" + testSample["query"].(string)
+			if cursor != "" {
+				path += "&cursor=" + cursor
+			}
+			res, err := http.Get(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bodyBytes, _ := ioutil.ReadAll(res.Body)
+			actualResult := expectedResult{}
+			if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+				t.Errorf("failed to unmarshal test result %v", err)
+			}
+
+			if strings.Join(actualResult.Friends, ",") != strings.Join(expected, ",") {
+				t.Errorf("expecting %v but have %v for page %v of %v", expected, actualResult.Friends, i+1, testSample["query"])
+			}
+			if actualResult.Total != len(friends) {
+				t.Errorf("expecting total %v but have %v for %v", len(friends), actualResult.Total, testSample["query"])
+			}
+			cursor = actualResult.NextCursor
+		}
+		if cursor != "" {
+			t.Errorf("expecting no cursor after the last page of %v", testSample["query"])
+		}
+	}
+
+	// a cursor is checked against the sort before it reaches the query
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"k":"bob","e":"bob@example.com"}`))
+	for _, query := range []string{"cursor=invalid", "sort=created_at&cursor=" + forged} {
+		res, err := http.Get(baseAPI + "/v2/users/andy@example.com/friends?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("expecting status code %v but have %v for %v", http.StatusUnprocessableEntity, res.StatusCode, query)
+		}
+	}
+}
+
+type batchResponse struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code"`
+	Results []struct {
+		Index      int    `json:"index"`
+		Success    bool   `json:"success"`
+		Code       string `json:"code"`
+		RolledBack bool   `json:"rolled_back"`
+		Skipped    bool   `json:"skipped"`
+	} `json:"results"`
+}
+
+func TestBatchOperations(t *testing.T) {
+	resetDB()
+	testSamples := []map[string]interface{}{
+		{
+			"request": `{"mode": "transactional", "operations": [
+				{"action": "friend", "requestor": "andy@example.com", "target": "john@example.com"},
+				{"action": "friend", "requestor": "john@example.com", "target": "andy@example.com"},
+				{"action": "subscribe", "requestor": "lisa@example.com", "target": "andy@example.com"}
+			]}`,
+			"status": http.StatusConflict, "success": false, "results": []string{"rolled_back", "already_friends", "skipped"},
+			"friends": []string{},
+		},
+		{
+			"request": `{"mode": "best_effort", "operations": [
+				{"action": "friend", "requestor": "andy@example.com", "target": "john@example.com"},
+				{"action": "friend", "requestor": "john@example.com", "target": "andy@example.com"},
+				{"action": "subscribe", "requestor": "lisa@example.com", "target": "andy@example.com"},
+				{"action": "unfriend", "requestor": "andy@example.com", "target": "lisa@example.com"}
+			]}`,
+			"status": http.StatusOK, "success": true, "results": []string{"ok", "already_friends", "ok", "not_friends"},
+			"friends": []string{"john@example.com"},
+		},
+		{
+			"request": `{"operations": [
+				{"action": "unfriend", "requestor": "john@example.com", "target": "andy@example.com"},
+				{"action": "block", "requestor": "andy@example.com", "target": "lisa@example.com"}
+			]}`,
+			"status": http.StatusOK, "success": true, "results": []string{"ok", "ok"},
+			"friends": []string{},
+		},
+	}
+
+	for _, testSample := range testSamples {
+		res, err := http.Post(baseAPI+"/batch", "application/json", strings.NewReader(testSample["request"].(string)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		actualResult := batchResponse{}
+		if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+		if res.StatusCode != testSample["status"].(int) {
+			t.Errorf("expecting status code %v but have %v for %v", testSample["status"], res.StatusCode, testSample["request"])
+		}
+		if actualResult.Success != testSample["success"].(bool) {
+			t.Errorf("expecting %v but have %v for %v", testSample["success"], actualResult.Success, testSample["request"])
+		}
+
+		results := []string{}
+		for _, result := range actualResult.Results {
+			switch {
+			case result.RolledBack:
+				results = append(results, "rolled_back")
+			case result.Skipped:
+				results = append(results, "skipped")
+			case result.Success:
+				results = append(results, "ok")
+			default:
+				results = append(results, result.Code)
+			}
+		}
+		if strings.Join(results, ",") != strings.Join(testSample["results"].([]string), ",") {
+			t.Errorf("expecting results %v but have %v for %v", testSample["results"], results, testSample["request"])
+		}
+
+		res, err = http.Get(baseAPI + "/v2/users/andy@example.com/friends")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ = ioutil.ReadAll(res.Body)
+		friends := expectedResult{}
+		if err := json.Unmarshal(bodyBytes, &friends); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+		if strings.Join(friends.Friends, ",") != strings.Join(testSample["friends"].([]string), ",") {
+			t.Errorf("expecting friends %v but have %v after %v", testSample["friends"], friends.Friends, testSample["request"])
+		}
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	resetDB()
+	testSamples := []map[string]interface{}{
+		{"key": "import-1", "body": `{"friends": ["andy@example.com", "john@example.com"]}`, "status": http.StatusOK, "replayed": false},
+		{"key": "import-1", "body": `{"friends": ["andy@example.com", "john@example.com"]}`, "status": http.StatusOK, "replayed": true},
+		{"key": "import-1", "body": `{"friends": ["andy@example.com", "lisa@example.com"]}`, "status": http.StatusUnprocessableEntity, "code": "idempotency_key_reused"},
+		{"key": "", "body": `{"friends": ["andy@example.com", "john@example.com"]}`, "status": http.StatusConflict, "code": "already_friends"},
+		{"key": "import-2", "body": `{"friends": ["andy@example.com", "john@example.com"]}`, "status": http.StatusConflict, "code": "already_friends"},
+		{"key": "import-2", "body": `{"friends": ["andy@example.com", "john@example.com"]}`, "status": http.StatusConflict, "code": "already_friends", "replayed": true},
+	}
+
+	for i, testSample := range testSamples {
+		req, _ := http.NewRequest("POST", baseAPI+"/friends", strings.NewReader(testSample["body"].(string)))
+		req.Header.Set("Content-Type", "application/json")
+		if key := testSample["key"].(string); key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		actualResult := struct {
+			Success bool   `json:"success"`
+			Code    string `json:"code"`
+		}{}
+		if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+
+		if res.StatusCode != testSample["status"].(int) {
+			t.Errorf("expecting status code %v but have %v for request %v", testSample["status"], res.StatusCode, i)
+		}
+		if code, _ := testSample["code"].(string); actualResult.Code != code {
+			t.Errorf("expecting code %v but have %v for request %v", code, actualResult.Code, i)
+		}
+		replayed, _ := testSample["replayed"].(bool)
+		if (res.Header.Get("Idempotent-Replayed") == "true") != replayed {
+			t.Errorf("expecting replayed %v for request %v", replayed, i)
+		}
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	resetDB()
+	tooLarge := `{"friends": ["andy@example.com", "` + strings.Repeat("a", 1<<20) + `@example.com"]}`
+	testSamples := []map[string]interface{}{
+		{"path": "/webhooks", "type": "application/json", "body": `{"url": "https://example.com/hooks", "events": ["friend.created"], "secret": "secret", "retries": 3}`, "status": http.StatusBadRequest, "code": "invalid_request", "details": []string{"retries"}},
+		{"path": "/friends", "type": "application/json", "body": `{"friends": "andy@example.com"}`, "status": http.StatusBadRequest, "code": "invalid_request", "details": []string{"friends"}},
+		{"path": "/friends", "type": "application/json", "body": `{"friends": ["andy@example.com", "john@example.com"]} {}`, "status": http.StatusBadRequest, "code": "invalid_request"},
+		{"path": "/friends", "type": "application/json", "body": "", "status": http.StatusBadRequest, "code": "invalid_request"},
+		{"path": "/webhooks", "type": "text/plain", "body": `{"url": "https://example.com/hooks", "events": ["friend.created"], "secret": "secret"}`, "status": http.StatusUnsupportedMediaType, "code": "unsupported_media_type"},
+		{"path": "/friends", "type": "application/x-www-form-urlencoded", "body": `{"friends": ["andy@example.com", "john@example.com"], "note": "v1"}`, "status": http.StatusOK, "code": ""},
+		{"path": "/friends", "type": "text/plain", "body": `{"friends": ["andy@example.com", "lisa@example.com"]}`, "status": http.StatusOK, "code": ""},
+		{"path": "/friends", "type": "application/json", "body": tooLarge, "status": http.StatusRequestEntityTooLarge, "code": "request_too_large"},
+		{"path": "/webhooks", "type": "application/json; charset=utf-8", "body": `{"url": "/hooks", "events": ["friend.deleted"]}`, "status": http.StatusUnprocessableEntity, "code": "validation_failed", "details": []string{"url", "events", "secret"}},
+		{"path": "/friends/subscribe", "type": "application/json", "body": `{}`, "status": http.StatusUnprocessableEntity, "code": "validation_failed", "details": []string{"requestor", "target"}},
+	}
+
+	for i, testSample := range testSamples {
+		req, _ := http.NewRequest("POST", baseAPI+testSample["path"].(string), strings.NewReader(testSample["body"].(string)))
+		req.Header.Set("Content-Type", testSample["type"].(string))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		actualResult := struct {
+			Code    string `json:"code"`
+			Details []struct {
+				Field string `json:"field"`
+			} `json:"details"`
+		}{}
+		if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+
+		if res.StatusCode != testSample["status"].(int) {
+			t.Errorf("expecting status code %v but have %v for request %v", testSample["status"], res.StatusCode, i)
+		}
+		if actualResult.Code != testSample["code"].(string) {
+			t.Errorf("expecting code %v but have %v for request %v", testSample["code"], actualResult.Code, i)
+		}
+		fields := []string{}
+		for _, detail := range actualResult.Details {
+			fields = append(fields, detail.Field)
+		}
+		if details, ok := testSample["details"].([]string); ok && strings.Join(fields, ",") != strings.Join(details, ",") {
+			t.Errorf("expecting details for %v but have %v for request %v", details, fields, i)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	resetDB()
+	conninfo := "user=postgres host=db sslmode=disable dbname=friends_management_test"
+	db, err := sql.Open("postgres", conninfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	createTestAPIKey(db, "andy@example.com", "andy-key")
+
+	token := func(subject, scope string) string {
+		claims := jwt.MapClaims{"sub": subject, "scope": scope, "exp": time.Now().Add(time.Hour).Unix()}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(os.Getenv("JWT_SECRET")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + signed
+	}
+
+	testSamples := []map[string]interface{}{
+		{"path": "/friends/block", "body": `{"requestor": "andy@example.com", "target": "john@example.com"}`, "status": http.StatusUnauthorized, "code": "unauthorized"},
+		{"path": "/friends/block", "key": "unknown-key", "body": `{"requestor": "andy@example.com", "target": "john@example.com"}`, "status": http.StatusUnauthorized, "code": "unauthorized"},
+		{"path": "/friends/block", "key": "andy-key", "body": `{"requestor": "lisa@example.com", "target": "john@example.com"}`, "status": http.StatusForbidden, "code": "forbidden"},
+		{"path": "/friends/block", "key": "andy-key", "body": `{"requestor": "andy@example.com", "target": "john@example.com"}`, "status": http.StatusOK},
+		{"path": "/friends", "key": "andy-key", "body": `{"friends": ["lisa@example.com", "andy@example.com"]}`, "status": http.StatusForbidden, "code": "forbidden"},
+		{"path": "/messages", "key": "andy-key", "body": `{"sender": "lisa@example.com", "text": "hi"}`, "status": http.StatusForbidden, "code": "forbidden"},
+		{"path": "/batch", "key": "andy-key", "body": `{"operations": [{"action": "subscribe", "requestor": "andy@example.com", "target": "kate@example.com"}, {"action": "subscribe", "requestor": "lisa@example.com", "target": "kate@example.com"}]}`, "status": http.StatusForbidden, "code": "forbidden"},
+		{"path": "/webhooks", "key": "andy-key", "body": `{"url": "http://localhost/hooks", "events": ["friend.created"], "secret": "secret"}`, "status": http.StatusForbidden, "code": "forbidden"},
+		{"path": "/friends/subscribe", "bearer": token("lisa@example.com", ""), "body": `{"requestor": "lisa@example.com", "target": "john@example.com"}`, "status": http.StatusOK},
+		{"path": "/friends/subscribe", "bearer": token("lisa@example.com", ""), "body": `{"requestor": "kate@example.com", "target": "john@example.com"}`, "status": http.StatusForbidden, "code": "forbidden"},
+		{"path": "/friends/subscribe", "bearer": token("lisa@example.com", "admin"), "body": `{"requestor": "kate@example.com", "target": "john@example.com"}`, "status": http.StatusOK},
+		{"path": "/friends/subscribe", "bearer": "Bearer not-a-token", "body": `{"requestor": "kate@example.com", "target": "john@example.com"}`, "status": http.StatusUnauthorized, "code": "unauthorized"},
+	}
+
+	// a client of its own so that the admin key of the other tests is not added
+	client := &http.Client{}
+	for i, testSample := range testSamples {
+		req, _ := http.NewRequest("POST", baseAPI+testSample["path"].(string), strings.NewReader(testSample["body"].(string)))
+		req.Header.Set("Content-Type", "application/json")
+		if key, ok := testSample["key"].(string); ok {
+			req.Header.Set("X-API-Key", key)
+		}
+		if bearer, ok := testSample["bearer"].(string); ok {
+			req.Header.Set("Authorization", bearer)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		actualResult := struct {
+			Code string `json:"code"`
+		}{}
+		if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+
+		if res.StatusCode != testSample["status"].(int) {
+			t.Errorf("expecting status code %v but have %v for request %v", testSample["status"], res.StatusCode, i)
+		}
+		if code, _ := testSample["code"].(string); actualResult.Code != code {
+			t.Errorf("expecting code %v but have %v for request %v", code, actualResult.Code, i)
+		}
+	}
+
+	res, err := client.Get(baseAPI + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expecting the OpenAPI document to be public but have %v", res.StatusCode)
+	}
+}
+
+func TestOwnershipOfFriendLists(t *testing.T) {
+	resetDB()
+	conninfo := "user=postgres host=db sslmode=disable dbname=friends_management_test"
+	db, err := sql.Open("postgres", conninfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	createTestAPIKey(db, "andy@example.com", "andy-key")
+
+	testSamples := []map[string]interface{}{
+		{"path": "/friends", "body": `{"email": "andy@example.com"}`, "status": http.StatusOK},
+		{"path": "/friends", "body": `{"email": "lisa@example.com"}`, "status": http.StatusForbidden, "code": "forbidden"},
+		{"path": "/friends/common", "body": `{"friends": ["lisa@example.com", "andy@example.com"]}`, "status": http.StatusOK},
+		{"path": "/friends/common", "body": `{"friends": ["lisa@example.com", "john@example.com"]}`, "status": http.StatusForbidden, "code": "forbidden"},
+		{"path": "/v2/users/andy@example.com/friends", "status": http.StatusOK},
+		{"path": "/v2/users/lisa@example.com/friends", "status": http.StatusForbidden, "code": "forbidden"},
+		{"path": "/v2/users/lisa@example.com/common/andy@example.com", "status": http.StatusOK},
+		{"path": "/v2/users/lisa@example.com/common/john@example.com", "status": http.StatusForbidden, "code": "forbidden"},
+	}
+
+	// a client of its own so that the admin key of the other tests is not added
+	client := &http.Client{}
+	for i, testSample := range testSamples {
+		body, _ := testSample["body"].(string)
+		req, _ := http.NewRequest("GET", baseAPI+testSample["path"].(string), strings.NewReader(body))
+		req.Header.Set("X-API-Key", "andy-key")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		actualResult := struct {
+			Code string `json:"code"`
+		}{}
+		if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+
+		if res.StatusCode != testSample["status"].(int) {
+			t.Errorf("expecting status code %v but have %v for request %v", testSample["status"], res.StatusCode, i)
+		}
+		if code, _ := testSample["code"].(string); actualResult.Code != code {
+			t.Errorf("expecting code %v but have %v for request %v", code, actualResult.Code, i)
+		}
+	}
+}
+
+func TestAdminModeration(t *testing.T) {
+	resetDB()
+	conninfo := "user=postgres host=db sslmode=disable dbname=friends_management_test"
+	db, err := sql.Open("postgres", conninfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	createTestAPIKey(db, "andy@example.com", "andy-key")
+	createTestAPIKey(db, "mod@example.com", "moderator-key", "moderator")
+
+	type adminResult struct {
+		Success       bool     `json:"success"`
+		Code          string   `json:"code"`
+		Count         int      `json:"count"`
+		Friends       []string `json:"friends"`
+		Recipients    []string `json:"recipients"`
+		Relationships []struct {
+			Requestor string `json:"requestor"`
+			Target    string `json:"target"`
+		} `json:"relationships"`
+		AuditLog []struct {
+			Actor  string `json:"actor"`
+			Action string `json:"action"`
+		} `json:"audit_log"`
+	}
+	do := func(key, method, path, body string, status int) adminResult {
+		req, _ := http.NewRequest(method, baseAPI+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := adminResult{}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		if err := json.Unmarshal(bodyBytes, &result); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+		if res.StatusCode != status {
+			t.Errorf("expecting status code %v but have %v for %v %v", status, res.StatusCode, method, path)
+		}
+		return result
+	}
+
+	do(testAdminKey, "POST", "/friends", `{"friends": ["andy@example.com", "john@example.com"]}`, http.StatusOK)
+	do(testAdminKey, "POST", "/friends", `{"friends": ["andy@example.com", "lisa@example.com"]}`, http.StatusOK)
+	do(testAdminKey, "POST", "/friends/block", `{"requestor": "kate@example.com", "target": "andy@example.com"}`, http.StatusOK)
+
+	if result := do("andy-key", "GET", "/admin/relationships?email=andy@example.com", "", http.StatusForbidden); result.Code != "forbidden" {
+		t.Errorf("expecting forbidden for a user but have %v", result.Code)
+	}
+
+	do("moderator-key", "POST", "/admin/users/john@example.com/suspension", `{"reason": "spam"}`, http.StatusOK)
+	if result := do("moderator-key", "POST", "/admin/users/john@example.com/suspension", `{"reason": "spam"}`, http.StatusConflict); result.Code != "already_suspended" {
+		t.Errorf("expecting already_suspended but have %v", result.Code)
+	}
+	if result := do(testAdminKey, "GET", "/friends", `{"email": "andy@example.com"}`, http.StatusOK); strings.Join(result.Friends, ",") != "lisa@example.com" {
+		t.Errorf("expecting the suspended john@example.com to be hidden but have %v", result.Friends)
+	}
+	recipients := do(testAdminKey, "GET", "/friends/subscribe", `{"sender": "andy@example.com", "text": "hi john@example.com"}`, http.StatusOK)
+	if strings.Join(recipients.Recipients, ",") != "lisa@example.com" {
+		t.Errorf("expecting the suspended john@example.com to be neither a recipient nor mentioned but have %v", recipients.Recipients)
+	}
+
+	do("moderator-key", "DELETE", "/admin/users/andy@example.com/relationships/lisa@example.com", "", http.StatusOK)
+	if result := do("moderator-key", "DELETE", "/admin/users/andy@example.com/relationships/lisa@example.com", "", http.StatusNotFound); result.Code != "relationship_not_found" {
+		t.Errorf("expecting relationship_not_found but have %v", result.Code)
+	}
+	if result := do("moderator-key", "POST", "/admin/unblocks", `{"blocks": [{"requestor": "kate@example.com", "target": "andy@example.com"}, {"requestor": "sean@example.com", "target": "andy@example.com"}]}`, http.StatusOK); result.Count != 1 {
+		t.Errorf("expecting 1 block to be lifted but have %v", result.Count)
+	}
+	if result := do("moderator-key", "GET", "/admin/relationships?email=andy@example.com", "", http.StatusOK); len(result.Relationships) != 2 {
+		t.Errorf("expecting the 2 rows of the friendship with john@example.com but have %v", result.Relationships)
+	}
+
+	do("moderator-key", "GET", "/admin/audit", "", http.StatusForbidden)
+	audit := do(testAdminKey, "GET", "/admin/audit", "", http.StatusOK)
+	actions := []string{}
+	for _, entry := range audit.AuditLog {
+		if entry.Actor != "mod@example.com" {
+			t.Errorf("expecting mod@example.com to be audited but have %v", entry.Actor)
+		}
+		actions = append(actions, entry.Action)
+	}
+	expected := "relationships.viewed,blocks.removed,relationships.removed,user.suspended"
+	if strings.Join(actions, ",") != expected {
+		t.Errorf("expecting the audit log %v but have %v", expected, actions)
+	}
 }
 
 func resetDB() {
@@ -752,4 +1541,26 @@ func resetDB() {
 		log.Fatalf("error in pinging db %v", err)
 	}
 	db.Exec("DELETE FROM relationships")
+	db.Exec("DELETE FROM webhooks")
+	db.Exec("DELETE FROM outbox")
+	db.Exec("DELETE FROM digests")
+	db.Exec("DELETE FROM digest_items")
+	db.Exec("DELETE FROM delivery_preferences")
+	db.Exec("DELETE FROM messages")
+	db.Exec("DELETE FROM idempotency_keys")
+	db.Exec("DELETE FROM api_keys")
+	db.Exec("DELETE FROM suspended_users")
+	db.Exec("DELETE FROM admin_audit_log")
+	createTestAPIKey(db, "admin@example.com", testAdminKey, "admin")
+}
+
+func createTestAPIKey(db *sql.DB, email, key string, scopes ...string) {
+	sum := sha256.Sum256([]byte(key))
+	_, err := db.Exec(
+		"INSERT INTO api_keys (email, key_hash, scopes, created_at) VALUES ($1, $2, $3, now())",
+		email, hex.EncodeToString(sum[:]), pq.Array(append([]string{}, scopes...)),
+	)
+	if err != nil {
+		log.Fatalf("failed to store api key %v", err)
+	}
 }
@@ -1,2 +1,3 @@
 #!/bin/sh
-go run $(ls -1 *.go | grep -v _test.go)
\ No newline at end of file
+# build first and exec the binary so that SIGTERM from docker reaches the server, go run does not forward it
+go build -o /tmp/friends-management $(ls -1 *.go | grep -v _test.go) && exec /tmp/friends-management
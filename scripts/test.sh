@@ -3,6 +3,7 @@ migrate -path ./migrations -database postgres://postgres@db/friends_management_t
 migrate -path ./migrations -database postgres://postgres@db/friends_management_test?sslmode=disable up
 sh scripts/start.sh &
 sleep 1
-go test *test.go
+go test $(grep -L '^package test$' *.go)
+go test $(grep -l '^package test$' *_test.go)
 echo "test completed, exiting now"
 exit
\ No newline at end of file
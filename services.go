@@ -1,10 +1,13 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"database/sql"
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 const (
@@ -13,7 +16,66 @@ const (
 	relationshipIsSubscribed = "subscribed"
 )
 
-func createFriends(users []string) error {
+// execer is satisfied by both *sql.DB and *txn
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// querier is satisfied by both *sql.DB and *txn, relationship changes take one
+// so that a batch can run several of them in a single transaction
+type querier interface {
+	execer
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type relationshipEvent struct {
+	Requestor string `json:"requestor"`
+	Target    string `json:"target"`
+}
+
+// txn is a transaction of withTx, it keeps the hooks to run once it is committed
+type txn struct {
+	*sql.Tx
+	hooks []func()
+}
+
+// onCommit runs fn once tx is committed, the hooks of a rolled back transaction are dropped
+func (tx *txn) onCommit(fn func()) {
+	tx.hooks = append(tx.hooks, fn)
+}
+
+// withTx runs fn in a transaction which is committed only if fn succeeds
+func withTx(ctx context.Context, fn func(tx *txn) error) error {
+	sqlTx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	tx := &txn{Tx: sqlTx}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, hook := range tx.hooks {
+		hook()
+	}
+	return nil
+}
+
+// inTx runs fn in q when it is already a transaction, otherwise in a new one
+func inTx(ctx context.Context, q querier, fn func(tx *txn) error) error {
+	if tx, ok := q.(*txn); ok {
+		return fn(tx)
+	}
+	return withTx(ctx, fn)
+}
+
+func createFriends(ctx context.Context, q querier, users []string) error {
+	ctx, done := measureQuery(ctx, "create_friends")
+	defer done()
 	insertQuery := `
 		INSERT INTO relationships (requestor, target, status, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5)
@@ -21,49 +83,65 @@ func createFriends(users []string) error {
 	now := time.Now()
 	user1 := strings.ToLower(users[0])
 	user2 := strings.ToLower(users[1])
-	if _, err := db.Exec(insertQuery, user1, user2, relationshipIsFriend, now, now); err != nil {
-		return err
-	}
+	return inTx(ctx, q, func(tx *txn) error {
+		if _, err := tx.ExecContext(ctx, insertQuery, user1, user2, relationshipIsFriend, now, now); err != nil {
+			return err
+		}
 
-	if _, err := db.Exec(insertQuery, user2, user1, relationshipIsFriend, now, now); err != nil {
-		return err
-	}
-	return nil
+		if _, err := tx.ExecContext(ctx, insertQuery, user2, user1, relationshipIsFriend, now, now); err != nil {
+			return err
+		}
+
+		return recordEvent(ctx, tx, eventFriendCreated, pairKey(user1, user2), map[string][]string{"friends": {user1, user2}})
+	})
 }
 
-func getFriendsList(user string) (friends []string, err error) {
+// deleteFriends removes the friendship in both directions
+func deleteFriends(ctx context.Context, q querier, users []string) error {
+	ctx, done := measureQuery(ctx, "delete_friends")
+	defer done()
+	deleteQuery := `
+		DELETE FROM relationships
+		WHERE ((requestor = $1 AND target = $2) OR (requestor = $2 AND target = $1)) AND status = $3
+	`
+	user1 := strings.ToLower(users[0])
+	user2 := strings.ToLower(users[1])
+	return inTx(ctx, q, func(tx *txn) error {
+		if _, err := tx.ExecContext(ctx, deleteQuery, user1, user2, relationshipIsFriend); err != nil {
+			return err
+		}
+
+		return recordEvent(ctx, tx, eventFriendRemoved, pairKey(user1, user2), map[string][]string{"friends": {user1, user2}})
+	})
+}
+
+func getFriendsList(ctx context.Context, user string, page pageRequest) (friends pageResult, err error) {
+	ctx, done := measureQuery(ctx, "get_friends_list")
+	defer done()
 	query := `
-		SELECT requestor_relationships.target target FROM relationships requestor_relationships
+		SELECT requestor_relationships.target email, requestor_relationships.created_at FROM relationships requestor_relationships
 		LEFT JOIN relationships target_relationships ON requestor_relationships.target = target_relationships.requestor
 		WHERE requestor_relationships.requestor=$1 AND target_relationships.target=$1
 		AND requestor_relationships.status=$2 AND target_relationships.status = $2
 	`
 
-	rows, err := db.Query(query, strings.ToLower(user), relationshipIsFriend)
+	friends, err = queryPage(ctx, query, page, strings.ToLower(user), relationshipIsFriend)
 	if err != nil {
-		err = errors.New(fmt.Sprintf("failed to check if user %v has any friends err %v", user, err))
+		err = fmt.Errorf("failed to check if user %v has any friends err %w", user, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		row := relationship{}
-		err = rows.Scan(&row.Target)
-		if err != nil {
-			return
-		}
-		friends = append(friends, row.Target)
-	}
 
-	if len(friends) == 0 {
-		err = errors.New("user doesn't have any friends")
+	if friends.Total == 0 {
+		err = newNotFoundError("no_friends", "user doesn't have any friends")
 		return
 	}
 
 	return
 }
 
-func getCommonFriendsList(users []string) (friends []string, err error) {
+func getCommonFriendsList(ctx context.Context, users []string, page pageRequest) (friends pageResult, err error) {
+	ctx, done := measureQuery(ctx, "get_common_friends_list")
+	defer done()
 	query := `
 		/* 
 			a = requestors_relationship (user 1 and user 2 relationship)
@@ -73,9 +151,10 @@ func getCommonFriendsList(users []string) (friends []string, err error) {
 
 			these requires all related parties to have status of "friend", "blocked" or "subscribed" will not match
 			table alias names are intentionally kept short to maintain readability
+			the common friendship is as old as the most recent of c and d
 		*/
 		
-		SELECT d.target
+		SELECT d.target email, GREATEST(c.created_at, d.created_at) created_at
 		FROM 
 			relationships a
 		INNER JOIN 
@@ -92,75 +171,82 @@ func getCommonFriendsList(users []string) (friends []string, err error) {
 			d.requestor = $2
 	`
 
-	rows, err := db.Query(query, strings.ToLower(users[0]), strings.ToLower(users[1]), relationshipIsFriend)
+	friends, err = queryPage(ctx, query, page, strings.ToLower(users[0]), strings.ToLower(users[1]), relationshipIsFriend)
 	if err != nil {
-		err = errors.New(fmt.Sprintf("failed to check if user %v and user %v has any common friends err %v", users[0], users[1], err))
+		err = fmt.Errorf("failed to check if user %v and user %v has any common friends err %w", users[0], users[1], err)
 		return
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		row := relationship{}
-		err = rows.Scan(&row.Target)
-		if err != nil {
-			return
-		}
-		friends = append(friends, row.Target)
-	}
-
-	if len(friends) == 0 {
-		err = errors.New("users doesn't have any common friends")
+	if friends.Total == 0 {
+		err = newNotFoundError("no_common_friends", "users doesn't have any common friends")
 		return
 	}
 
 	return
 }
 
-func subscribeUpdates(requestor, target string) error {
+func subscribeUpdates(ctx context.Context, q querier, requestor, target string) error {
+	ctx, done := measureQuery(ctx, "subscribe_updates")
+	defer done()
 	subscribeQuery := `
 		INSERT INTO relationships (requestor, target, status, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5)
 	`
 	now := time.Now()
-	if _, err := db.Exec(subscribeQuery, requestor, target, relationshipIsSubscribed, now, now); err != nil {
-		return err
-	}
+	return inTx(ctx, q, func(tx *txn) error {
+		if _, err := tx.ExecContext(ctx, subscribeQuery, requestor, target, relationshipIsSubscribed, now, now); err != nil {
+			return err
+		}
 
-	return nil
+		return recordEvent(ctx, tx, eventSubscriptionCreated, pairKey(requestor, target), relationshipEvent{requestor, target})
+	})
 }
 
-func blockUpdates(requestor, target string) error {
+func blockUpdates(ctx context.Context, q querier, requestor, target string) error {
+	ctx, done := measureQuery(ctx, "block_updates")
+	defer done()
 	blockQuery := `
 		INSERT INTO relationships (requestor, target, status, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5)
 	`
 	now := time.Now()
-	if _, err := db.Exec(blockQuery, requestor, target, relationshipIsBlocked, now, now); err != nil {
-		return err
-	}
+	return inTx(ctx, q, func(tx *txn) error {
+		if _, err := tx.ExecContext(ctx, blockQuery, requestor, target, relationshipIsBlocked, now, now); err != nil {
+			return err
+		}
 
-	return nil
+		return recordEvent(ctx, tx, eventBlockCreated, pairKey(requestor, target), relationshipEvent{requestor, target})
+	})
 }
 
-func blockExistingRelationship(requestor, target string) error {
+func blockExistingRelationship(ctx context.Context, q querier, requestor, target string) error {
+	ctx, done := measureQuery(ctx, "block_existing_relationship")
+	defer done()
 	blockQuery := `
 		UPDATE relationships 
 		SET status = $1, updated_at = $2
 		WHERE requestor = $3 AND target = $4
 	`
 	now := time.Now()
-	if _, err := db.Exec(blockQuery, relationshipIsBlocked, now, requestor, target); err != nil {
-		return err
-	}
+	return inTx(ctx, q, func(tx *txn) error {
+		if _, err := tx.ExecContext(ctx, blockQuery, relationshipIsBlocked, now, requestor, target); err != nil {
+			return err
+		}
 
-	return nil
+		return recordEvent(ctx, tx, eventBlockCreated, pairKey(requestor, target), relationshipEvent{requestor, target})
+	})
 }
 
-func getSubscribedList(sender string) (subscribers []string, err error) {
+// getSubscribedList pages through the friends and subscribers of the sender the message reaches,
+// leaving out the excluded users
+func getSubscribedList(ctx context.Context, sender string, excluded []string, page pageRequest) (subscribers pageResult, err error) {
+	ctx, done := measureQuery(ctx, "get_subscribed_list")
+	defer done()
 	subscriberQuery := `
 		/*
 			target_relationship.status may be null because subscription is not set two ways, unlike friendships
 			i.e. user A subscribe to user B will not result in user B subscribe to user A
+			email is null when the sender has blocked the subscriber
 		*/
 
 		SELECT 
@@ -169,7 +255,8 @@ func getSubscribedList(sender string) (subscribers []string, err error) {
 					AND target_relationship.status <> $2 THEN requestor_relationships.requestor
 				WHEN requestor_relationships.status = $3 
 					AND target_relationship.status IS NULL THEN requestor_relationships.requestor
-			END) requestor 
+			END) email,
+			requestor_relationships.created_at
 		FROM 
 			relationships requestor_relationships
 		LEFT JOIN 
@@ -178,37 +265,109 @@ func getSubscribedList(sender string) (subscribers []string, err error) {
 		WHERE 
 			requestor_relationships.target = $1 
 			AND (requestor_relationships.status = $3 OR requestor_relationships.status = $4)
+			AND requestor_relationships.requestor <> ALL($5)
 	`
 
-	rows, err := db.Query(subscriberQuery, sender, relationshipIsBlocked, relationshipIsSubscribed, relationshipIsFriend)
+	excluded = append([]string{}, excluded...)
+	subscribers, err = queryPage(ctx, subscriberQuery, page, sender, relationshipIsBlocked, relationshipIsSubscribed, relationshipIsFriend, pq.Array(excluded))
 	if err != nil {
-		err = errors.New(fmt.Sprintf("failed to check if sender %v has any subscribers err %v", sender, err))
+		err = fmt.Errorf("failed to check if sender %v has any subscribers err %w", sender, err)
+	}
+	return
+}
+
+// getAudience lists the friends and subscribers of the sender whether or not a block
+// keeps the message from them, suspended users are left out
+func getAudience(ctx context.Context, sender string) (audience []string, err error) {
+	ctx, done := measureQuery(ctx, "get_audience")
+	defer done()
+	query := `
+		SELECT requestor FROM relationships
+		WHERE target = $1 AND (status = $2 OR status = $3)
+			AND NOT EXISTS (SELECT 1 FROM suspended_users WHERE email = requestor)
+		ORDER BY requestor
+	`
+
+	rows, err := db.QueryContext(ctx, query, sender, relationshipIsSubscribed, relationshipIsFriend)
+	if err != nil {
+		err = fmt.Errorf("failed to list the audience of sender %v err %w", sender, err)
 		return
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		row := relationship{}
-		err = rows.Scan(&row.Requestor)
-		if err != nil {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return
+		}
+		audience = append(audience, email)
+	}
+	return audience, rows.Err()
+}
+
+// getBlockedUsers lists everyone who has blocked the user or has been blocked by the user
+func getBlockedUsers(ctx context.Context, user string) (users []string, err error) {
+	ctx, done := measureQuery(ctx, "get_blocked_users")
+	defer done()
+	query := `
+		SELECT DISTINCT (CASE WHEN requestor = $1 THEN target ELSE requestor END) blocked_user
+		FROM relationships
+		WHERE (requestor = $1 OR target = $1) AND status = $2
+		ORDER BY blocked_user
+	`
+
+	rows, err := db.QueryContext(ctx, query, user, relationshipIsBlocked)
+	if err != nil {
+		err = fmt.Errorf("failed to check if user %v has blocked or been blocked by anyone err %w", user, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blockedUser string
+		if err = rows.Scan(&blockedUser); err != nil {
 			return
 		}
-		subscribers = append(subscribers, row.Requestor)
+		users = append(users, blockedUser)
 	}
+	return
+}
+
+// countFriendsOfUsers counts the distinct friends of the users, leaving out the excluded ones
+func countFriendsOfUsers(ctx context.Context, users, excluded []string) (count int, err error) {
+	ctx, done := measureQuery(ctx, "count_friends_of_users")
+	defer done()
+	query := `
+		SELECT count(DISTINCT friend_relationships.target)
+		FROM relationships friend_relationships
+		INNER JOIN relationships back_relationships ON back_relationships.requestor = friend_relationships.target
+			AND back_relationships.target = friend_relationships.requestor
+			AND back_relationships.status = $3
+		WHERE friend_relationships.requestor = ANY($1)
+			AND friend_relationships.status = $3
+			AND NOT (friend_relationships.target = ANY($2))
+			AND NOT EXISTS (SELECT 1 FROM suspended_users WHERE email = friend_relationships.target)
+	`
 
+	err = db.QueryRowContext(ctx, query, pq.Array(users), pq.Array(excluded), relationshipIsFriend).Scan(&count)
+	if err != nil {
+		err = fmt.Errorf("failed to count the friends of the recipients err %w", err)
+	}
 	return
 }
 
-func ifExistsRelationship(users []string) (exists bool, relationships relationships, err error) {
+func ifExistsRelationship(ctx context.Context, q querier, users []string) (exists bool, relationships relationships, err error) {
+	ctx, done := measureQuery(ctx, "if_exists_relationship")
+	defer done()
 	statusQuery := `
 		SELECT requestor, target, status FROM relationships 
 		WHERE (requestor=$1 AND target=$2)
 		OR (requestor=$2 AND target=$1)
 	`
 
-	rows, err := db.Query(statusQuery, strings.ToLower(users[0]), strings.ToLower(users[1]))
+	rows, err := q.QueryContext(ctx, statusQuery, strings.ToLower(users[0]), strings.ToLower(users[1]))
 	if err != nil {
-		err = errors.New(fmt.Sprintf("failed to check if any relationships exists between the users %v", err))
+		err = fmt.Errorf("failed to check if any relationships exists between the users %w", err)
 		return
 	}
 
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+var errMessageNotFound = newNotFoundError("message_not_found", "message does not exist")
+
+type storedMessage struct {
+	ID        int            `json:"id"`
+	Sender    string         `json:"sender"`
+	Text      string         `json:"text"`
+	ParentID  *int           `json:"parent_id,omitempty"`
+	ThreadID  int            `json:"thread_id"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+type reply struct {
+	ParentID int `json:"parent_id"`
+	Sender   string
+	Text     string
+}
+
+type reaction struct {
+	MessageID int `json:"message_id"`
+	Email     string
+	Emoji     string
+}
+
+// post stores the message as the root of a new thread and fans it out to the recipients
+func (m message) post(ctx context.Context) (stored storedMessage, recipients user, err error) {
+	ctx, span := tracer.Start(ctx, "message.post")
+	defer span.End()
+
+	err = validate(
+		check("sender", m.Sender, validEmail("invalid message")),
+		check("text", m.Text, required("no text was provided")),
+	)
+	if err != nil {
+		return
+	}
+
+	// every recipient is sent the message, whatever page a listing of them would be on
+	m.Page = pageRequest{}
+	recipients, err = m.getRecipients(ctx)
+	if err != nil {
+		return
+	}
+
+	err = withTx(ctx, func(tx *txn) error {
+		if stored, err = insertMessage(ctx, tx, strings.ToLower(m.Sender), m.Text, nil); err != nil {
+			return err
+		}
+		return recordMessageSent(ctx, tx, stored, recipients.Subscribers)
+	})
+	return
+}
+
+// post stores the reply and notifies the participants without a block with the replier
+func (r reply) post(ctx context.Context) (stored storedMessage, err error) {
+	ctx, span := tracer.Start(ctx, "reply.post")
+	defer span.End()
+
+	err = validate(
+		check("sender", r.Sender, validEmail("invalid user")),
+		check("parent_id", r.ParentID, positive("no parent message was provided")),
+		check("text", r.Text, required("no text was provided")),
+	)
+	if err != nil {
+		return
+	}
+
+	sender := strings.ToLower(r.Sender)
+	blocked, err := getBlockedSet(ctx, sender)
+	if err != nil {
+		return
+	}
+	parent, err := getVisibleMessage(ctx, r.ParentID, blocked)
+	if err != nil {
+		return
+	}
+	thread, err := getThreadMessages(ctx, parent.ThreadID)
+	if err != nil {
+		return
+	}
+	participants := []string{}
+	seen := map[string]bool{sender: true}
+	for _, m := range thread {
+		if !seen[m.Sender] && !blocked[m.Sender] {
+			participants = append(participants, m.Sender)
+		}
+		seen[m.Sender] = true
+	}
+
+	err = withTx(ctx, func(tx *txn) error {
+		if stored, err = insertMessage(ctx, tx, sender, r.Text, &parent); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, eventMessageReplied, threadKey(stored.ThreadID), newMessageEvent(stored, participants))
+	})
+	return
+}
+
+func (r reaction) validate() error {
+	return validate(
+		check("email", r.Email, validEmail("invalid user")),
+		check("message_id", r.MessageID, positive("no message was provided")),
+		check("emoji", r.Emoji, required("invalid emoji"), atMost(8, "invalid emoji"), withoutSpaces("invalid emoji")),
+	)
+}
+
+func (r reaction) add(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "reaction.add")
+	defer span.End()
+
+	if err := r.validate(); err != nil {
+		return err
+	}
+	email := strings.ToLower(r.Email)
+	blocked, err := getBlockedSet(ctx, email)
+	if err != nil {
+		return err
+	}
+	if _, err := getVisibleMessage(ctx, r.MessageID, blocked); err != nil {
+		return err
+	}
+	return addReaction(ctx, r.MessageID, email, r.Emoji)
+}
+
+func (r reaction) remove(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "reaction.remove")
+	defer span.End()
+
+	if err := r.validate(); err != nil {
+		return err
+	}
+	return removeReaction(ctx, r.MessageID, strings.ToLower(r.Email), r.Emoji)
+}
+
+// getThread returns the root message and the replies the viewer may see
+func getThread(ctx context.Context, messageID int, viewer string) (messages []storedMessage, err error) {
+	ctx, span := tracer.Start(ctx, "getThread")
+	defer span.End()
+
+	if err = validate(check("email", viewer, validEmail("invalid user"))); err != nil {
+		return
+	}
+	viewer = strings.ToLower(viewer)
+
+	blocked, err := getBlockedSet(ctx, viewer)
+	if err != nil {
+		return
+	}
+
+	message, err := getVisibleMessage(ctx, messageID, blocked)
+	if err != nil {
+		return
+	}
+
+	thread, err := getThreadMessages(ctx, message.ThreadID)
+	if err != nil {
+		return
+	}
+	for _, m := range thread {
+		if !blocked[m.Sender] {
+			messages = append(messages, m)
+		}
+	}
+	return messages, loadReactions(ctx, messages)
+}
+
+// getVisibleMessage loads the message unless a blocked user of the viewer wrote it or its thread
+func getVisibleMessage(ctx context.Context, messageID int, blocked map[string]bool) (message storedMessage, err error) {
+	message, err = getStoredMessage(ctx, messageID)
+	if err != nil {
+		return
+	}
+
+	if blocked[message.Sender] {
+		err = errMessageNotFound
+		return
+	}
+	if message.ThreadID != message.ID {
+		root, rootErr := getStoredMessage(ctx, message.ThreadID)
+		if rootErr != nil {
+			err = rootErr
+			return
+		}
+		if blocked[root.Sender] {
+			err = errMessageNotFound
+		}
+	}
+	return
+}
+
+// getBlockedSet is the set of users who blocked or were blocked by the user
+func getBlockedSet(ctx context.Context, user string) (map[string]bool, error) {
+	blockedUsers, err := getBlockedUsers(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	blocked := map[string]bool{}
+	for _, blockedUser := range blockedUsers {
+		blocked[blockedUser] = true
+	}
+	return blocked, nil
+}
+
+func loadReactions(ctx context.Context, messages []storedMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	reactions, err := getReactionCounts(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+	}
+	return nil
+}
+
+// recordMessageSent writes the message.sent event and queues the digest items in tx
+func recordMessageSent(ctx context.Context, tx *txn, message storedMessage, recipients []string) error {
+	if err := recordEvent(ctx, tx, eventMessageSent, threadKey(message.ThreadID), newMessageEvent(message, recipients)); err != nil {
+		return err
+	}
+	tx.onCommit(func() { countMessageSent(len(recipients)) })
+	return queueDigestItems(ctx, tx, message.Sender, message.Text, recipients)
+}
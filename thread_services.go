@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// insertMessage stores a reply to parent, or a new thread when parent is nil
+func insertMessage(ctx context.Context, q querier, sender, text string, parent *storedMessage) (message storedMessage, err error) {
+	ctx, done := measureQuery(ctx, "insert_message")
+	defer done()
+	insertQuery := `
+		WITH next AS (SELECT nextval(pg_get_serial_sequence('messages', 'id')) id)
+		INSERT INTO messages (id, sender, text, parent_id, thread_id, created_at)
+		SELECT id, $1, $2, $3, COALESCE($4, id), $5 FROM next
+		RETURNING id, thread_id
+	`
+	message = storedMessage{Sender: sender, Text: text, CreatedAt: time.Now()}
+	var parentID, threadID sql.NullInt64
+	if parent != nil {
+		message.ParentID = &parent.ID
+		parentID = sql.NullInt64{Int64: int64(parent.ID), Valid: true}
+		threadID = sql.NullInt64{Int64: int64(parent.ThreadID), Valid: true}
+	}
+
+	err = q.QueryRowContext(ctx, insertQuery, sender, text, parentID, threadID, message.CreatedAt).Scan(&message.ID, &message.ThreadID)
+	if err != nil {
+		err = fmt.Errorf("failed to store message of sender %v err %w", sender, err)
+	}
+	return
+}
+
+func getStoredMessage(ctx context.Context, id int) (message storedMessage, err error) {
+	ctx, done := measureQuery(ctx, "get_stored_message")
+	defer done()
+	query := `SELECT id, sender, text, parent_id, thread_id, created_at FROM messages WHERE id = $1`
+
+	message, err = scanStoredMessage(db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		err = errMessageNotFound
+	}
+	return
+}
+
+func getThreadMessages(ctx context.Context, threadID int) (messages []storedMessage, err error) {
+	ctx, done := measureQuery(ctx, "get_thread_messages")
+	defer done()
+	query := `
+		SELECT id, sender, text, parent_id, thread_id, created_at FROM messages
+		WHERE thread_id = $1
+		ORDER BY id
+	`
+
+	rows, err := db.QueryContext(ctx, query, threadID)
+	if err != nil {
+		err = fmt.Errorf("failed to get messages of thread %v err %w", threadID, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		message, scanErr := scanStoredMessage(rows)
+		if scanErr != nil {
+			err = scanErr
+			return
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanStoredMessage(row rowScanner) (message storedMessage, err error) {
+	var parentID sql.NullInt64
+	if err = row.Scan(&message.ID, &message.Sender, &message.Text, &parentID, &message.ThreadID, &message.CreatedAt); err != nil {
+		return
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		message.ParentID = &id
+	}
+	return
+}
+
+// addReaction stores the reaction unless the user has a block with the author of the message or thread
+func addReaction(ctx context.Context, messageID int, email, emoji string) error {
+	ctx, done := measureQuery(ctx, "add_reaction")
+	defer done()
+	insertQuery := `
+		INSERT INTO message_reactions (message_id, email, emoji, created_at)
+		SELECT m.id, $2, $3, $4
+		FROM messages m
+		INNER JOIN messages root ON root.id = m.thread_id
+		WHERE m.id = $1 AND NOT EXISTS (
+			SELECT 1 FROM relationships
+			WHERE status = $5 AND (
+				(requestor = $2 AND target IN (m.sender, root.sender))
+				OR (target = $2 AND requestor IN (m.sender, root.sender))
+			)
+		)
+		ON CONFLICT DO NOTHING
+		RETURNING message_id
+	`
+	var id int
+	err := db.QueryRowContext(ctx, insertQuery, messageID, email, emoji, time.Now(), relationshipIsBlocked).Scan(&id)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	// nothing was inserted, either the reaction exists already or the message is not visible
+	exists := false
+	existsQuery := `SELECT EXISTS (SELECT 1 FROM message_reactions WHERE message_id = $1 AND email = $2 AND emoji = $3)`
+	if err := db.QueryRowContext(ctx, existsQuery, messageID, email, emoji).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+func removeReaction(ctx context.Context, messageID int, email, emoji string) error {
+	ctx, done := measureQuery(ctx, "remove_reaction")
+	defer done()
+	deleteQuery := `DELETE FROM message_reactions WHERE message_id = $1 AND email = $2 AND emoji = $3`
+	result, err := db.ExecContext(ctx, deleteQuery, messageID, email, emoji)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return newNotFoundError("reaction_not_found", "reaction does not exist")
+	}
+	return nil
+}
+
+// getReactionCounts counts the reactions of each message by emoji
+func getReactionCounts(ctx context.Context, messageIDs []int) (counts map[int]map[string]int, err error) {
+	ctx, done := measureQuery(ctx, "get_reaction_counts")
+	defer done()
+	query := `
+		SELECT message_id, emoji, count(*) FROM message_reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+	`
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(messageIDs))
+	if err != nil {
+		err = fmt.Errorf("failed to count reactions err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	counts = map[int]map[string]int{}
+	for rows.Next() {
+		var messageID, count int
+		var emoji string
+		if err = rows.Scan(&messageID, &emoji, &count); err != nil {
+			return
+		}
+		if counts[messageID] == nil {
+			counts[messageID] = map[string]int{}
+		}
+		counts[messageID][emoji] = count
+	}
+	return counts, rows.Err()
+}
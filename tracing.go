@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const serviceName = "friends-management"
+
+var (
+	// tracer starts every span of the server, it follows the provider set by setupTracing
+	// and drops the spans while tracing is off
+	tracer = otel.Tracer(serviceName)
+
+	// propagator reads and writes the W3C traceparent, tracestate and baggage headers
+	propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+)
+
+// setupTracing sends the spans to the exporter of the config, the returned provider must be
+// shut down to flush the spans still buffered, it is nil when tracing is off
+func setupTracing(c tracingConfig) (*sdktrace.TracerProvider, error) {
+	otel.SetTextMapPropagator(propagator)
+	if c.Exporter == "none" {
+		return nil, nil
+	}
+
+	exporter, err := newSpanExporter(c)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}
+
+func newSpanExporter(c tracingConfig) (sdktrace.SpanExporter, error) {
+	switch c.Exporter {
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		endpoint, err := url.Parse(c.OTLPEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+		if endpoint.Scheme == "http" {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		if endpoint.Path != "" && endpoint.Path != "/" {
+			options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+		}
+		return otlptracehttp.New(context.Background(), options...)
+	}
+	return nil, errors.New("unknown trace exporter " + c.Exporter)
+}
+
+// startQuerySpan starts the span of a query of the services files, see measureQuery
+func startQuerySpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "query "+name, trace.WithAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", name),
+	))
+}
+
+// traceStatement starts the span of a single SQL statement of a query, e.g. the count and
+// the page of a paged list, the statement is kept so that a slow one can be explained
+func traceStatement(ctx context.Context, name, statement string) trace.Span {
+	_, span := tracer.Start(ctx, "sql "+name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.statement", statement),
+	))
+	return span
+}
+
+// spanWriter keeps the status code and the error of a response for its span
+type spanWriter struct {
+	http.ResponseWriter
+	status int
+	span   trace.Span
+}
+
+func (w *spanWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *spanWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// traceRequests continues the trace of the caller when the request carries a traceparent
+// header and starts a server span named after the route, the spans of the handler, its
+// domain methods and their queries are its children
+func traceRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeOf(r)
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("http.target", r.URL.Path),
+			attribute.String("net.sock.peer.addr", clientIP(r)),
+		))
+		defer span.End()
+
+		writer := &spanWriter{ResponseWriter: w, status: http.StatusOK, span: span}
+		h.ServeHTTP(writer, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", writer.status))
+		if writer.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(writer.status))
+		}
+	})
+}
+
+// metadataCarrier lets the propagator read the trace context of gRPC calls
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// startGRPCSpan continues the trace of the caller from the metadata of the call
+func startGRPCSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = propagator.Extract(ctx, metadataCarrier(md))
+	return tracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.method", method),
+	))
+}
+
+// endSpan marks the span as failed when err is a server error, client errors such as a
+// failed validation are what the API is for and leave the span as it is
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		failed := toAPIError(err).Kind == errorKindInternal
+		if s, ok := status.FromError(err); ok {
+			failed = s.Code() == grpccodes.Internal
+		}
+		if failed {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// traceparent is a W3C trace context as a caller would send it
+const (
+	traceparent   = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	callerTraceID = "0af7651916cd43dd8448eb211c80319c"
+	callerSpanID  = "b7ad6b7169203331"
+)
+
+// recordSpans sends the spans of the test to an in-memory exporter
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := tracer
+	tracer = provider.Tracer(serviceName)
+	t.Cleanup(func() { tracer = previous })
+	return exporter
+}
+
+func spansByName(spans tracetest.SpanStubs) map[string]tracetest.SpanStub {
+	byName := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	return byName
+}
+
+func TestTraceRequestsContinuesTheCallerTrace(t *testing.T) {
+	exporter := recordSpans(t)
+
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set("traceparent", traceparent)
+	traceRequests(router).ServeHTTP(httptest.NewRecorder(), req)
+
+	span, ok := spansByName(exporter.GetSpans())["GET /healthz"]
+	if !ok {
+		t.Fatalf("expected a span named after the route, have %v", exporter.GetSpans())
+	}
+	if span.SpanContext.TraceID().String() != callerTraceID {
+		t.Errorf("expected the trace of the caller, have %v", span.SpanContext.TraceID())
+	}
+	if !span.Parent.IsRemote() || span.Parent.SpanID().String() != callerSpanID {
+		t.Errorf("expected the span of the caller as parent, have %v", span.Parent.SpanID())
+	}
+}
+
+func TestTraceSpanTree(t *testing.T) {
+	needsDB(t)
+
+	db.Exec("DELETE FROM relationships")
+	for _, friends := range [][]string{
+		{"andy@example.com", "lisa@example.com"},
+		{"john@example.com", "lisa@example.com"},
+	} {
+		if err := (&user{Friends: friends}).createFriends(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exporter := recordSpans(t)
+
+	body := strings.NewReader(`{"friends": ["andy@example.com", "john@example.com"]}`)
+	req := httptest.NewRequest("GET", "/api/friends/common", body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", traceparent)
+	res := httptest.NewRecorder()
+	traceRequests(router).ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, have %v %v", res.Code, res.Body)
+	}
+
+	spans := spansByName(exporter.GetSpans())
+	parents := map[string]string{
+		"user.getCommonFriends":         "GET /api/friends/common",
+		"query if_exists_relationship":  "user.getCommonFriends",
+		"query get_common_friends_list": "user.getCommonFriends",
+		"sql count":                     "query get_common_friends_list",
+		"sql page":                      "query get_common_friends_list",
+	}
+	for name, parentName := range parents {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected a span %v", name)
+			continue
+		}
+		if parent := spans[parentName]; span.Parent.SpanID() != parent.SpanContext.SpanID() {
+			t.Errorf("expected %v to be a child of %v", name, parentName)
+		}
+		if span.SpanContext.TraceID().String() != callerTraceID {
+			t.Errorf("expected %v to be in the trace of the caller", name)
+		}
+	}
+	for _, attr := range spans["sql page"].Attributes {
+		if attr.Key == "db.statement" && !strings.Contains(attr.Value.AsString(), "ORDER BY list.email") {
+			t.Errorf("expected the page statement, have %v", attr.Value.AsString())
+		}
+	}
+}
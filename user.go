@@ -1,32 +1,42 @@
 package main
 
-import (
-	"errors"
-)
+import "context"
 
 type user struct {
 	Email       string
 	Friends     []string
 	QueryStatus bool
 	Subscribers []string
+	Page        pageRequest `json:"-"`
+	Total       int         `json:"-"`
+	NextCursor  string      `json:"-"`
 }
 
-func (u *user) createFriends() error {
-	if len(u.Friends) != 2 {
-		return errors.New("incorrect number of friends")
-	}
+// friendsRequest is the body of the routes taking a pair of users
+type friendsRequest struct {
+	Friends []string
+}
 
-	for _, user := range u.Friends {
-		if !isEmailValid(user) {
-			return errors.New("invalid email being submitted")
-		}
-	}
+// emailRequest is the body of the routes taking a single user
+type emailRequest struct {
+	Email string
+}
 
-	if u.Friends[0] == u.Friends[1] {
-		return errors.New("cannot be friends with oneself")
+// createFriends connects the two users in Friends, q is either the database or the transaction of a batch
+func (u *user) createFriends(ctx context.Context, q querier) error {
+	ctx, span := tracer.Start(ctx, "user.createFriends")
+	defer span.End()
+
+	err := validate(check("friends", u.Friends,
+		exactly(2, "incorrect number of friends"),
+		each(validEmail("invalid email being submitted")),
+		distinct("cannot be friends with oneself"),
+	))
+	if err != nil {
+		return err
 	}
 
-	exists, relationships, err := ifExistsRelationship(u.Friends)
+	exists, relationships, err := ifExistsRelationship(ctx, q, u.Friends)
 	if err != nil {
 		return err
 	}
@@ -43,33 +53,62 @@ func (u *user) createFriends() error {
 		}
 	}
 
-	return createFriends(u.Friends)
+	return createFriends(ctx, q, u.Friends)
 }
 
-func (u *user) getFriends() error {
-	if !isEmailValid(u.Email) {
-		return errors.New("invalid user")
+// unfriend removes the friendship between the two users in Friends
+func (u *user) unfriend(ctx context.Context, q querier) error {
+	ctx, span := tracer.Start(ctx, "user.unfriend")
+	defer span.End()
+
+	err := validate(check("friends", u.Friends,
+		exactly(2, "incorrect number of friends"),
+		each(validEmail("invalid email being submitted")),
+	))
+	if err != nil {
+		return err
 	}
-	friends, err := getFriendsList(u.Email)
+
+	_, relationships, err := ifExistsRelationship(ctx, q, u.Friends)
 	if err != nil {
 		return err
 	}
-	u.Friends = friends
-	return nil
+
+	if isFriend, _ := relationships.isFriend(); !isFriend {
+		return newNotFoundError("not_friends", "users are not friends")
+	}
+
+	return deleteFriends(ctx, q, u.Friends)
 }
 
-func (u *user) getCommonFriends() error {
-	if len(u.Friends) != 2 {
-		return errors.New("incorrect number of friends")
+func (u *user) getFriends(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "user.getFriends")
+	defer span.End()
+
+	if err := validate(check("email", u.Email, validEmail("invalid user"))); err != nil {
+		return err
 	}
+	friends, err := getFriendsList(ctx, u.Email, u.Page)
+	if err != nil {
+		return err
+	}
+	u.Friends, u.Total, u.NextCursor = friends.Items, friends.Total, friends.NextCursor
+	return nil
+}
 
-	for _, user := range u.Friends {
-		if !isEmailValid(user) {
-			return errors.New("invalid user")
-		}
+func (u *user) getCommonFriends(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "user.getCommonFriends")
+	defer span.End()
+
+	err := validate(check("friends", u.Friends,
+		exactly(2, "incorrect number of friends"),
+		each(validEmail("invalid user")),
+	))
+	if err != nil {
+		return err
 	}
 
-	exists, relationships, err := ifExistsRelationship(u.Friends)
+	exists, relationships, err := ifExistsRelationship(ctx, db, u.Friends)
 	if err != nil {
 		return err
 	}
@@ -80,15 +119,23 @@ func (u *user) getCommonFriends() error {
 		}
 	}
 
-	friends, err := getCommonFriendsList(u.Friends)
+	friends, err := getCommonFriendsList(ctx, u.Friends, u.Page)
 	if err != nil {
 		return err
 	}
 
-	u.Friends = friends
+	u.Friends, u.Total, u.NextCursor = friends.Items, friends.Total, friends.NextCursor
 	return nil
 }
 
+// actor is the user a friend request is made by, the first of Friends
+func (u *user) actor() string {
+	if len(u.Friends) == 0 {
+		return ""
+	}
+	return u.Friends[0]
+}
+
 func (u *user) getSubscribers() {
 
 }
@@ -108,3 +155,11 @@ func (u *user) getCount() int {
 func (u *user) listSubscribers() []string {
 	return u.Subscribers
 }
+
+func (u *user) getTotal() int {
+	return u.Total
+}
+
+func (u *user) getNextCursor() string {
+	return u.NextCursor
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"strings"
 )
 
@@ -10,19 +10,26 @@ type userRequest struct {
 	Target    string
 }
 
-func (u userRequest) subscribeUpdates() error {
-	if u.Requestor == "" {
-		return errors.New("no requestor was provided")
-	}
-	if u.Target == "" {
-		return errors.New("no target was provided")
+func (u userRequest) validate() error {
+	return validate(
+		check("requestor", u.Requestor, required("no requestor was provided")),
+		check("target", u.Target, required("no target was provided")),
+	)
+}
+
+func (u userRequest) subscribeUpdates(ctx context.Context, q querier) error {
+	ctx, span := tracer.Start(ctx, "userRequest.subscribeUpdates")
+	defer span.End()
+
+	if err := u.validate(); err != nil {
+		return err
 	}
 
 	requestor := strings.ToLower(u.Requestor)
 	target := strings.ToLower(u.Target)
 
 	users := []string{requestor, target}
-	exists, relationships, err := ifExistsRelationship(users)
+	exists, relationships, err := ifExistsRelationship(ctx, q, users)
 	if err != nil {
 		return err
 	}
@@ -38,21 +45,21 @@ func (u userRequest) subscribeUpdates() error {
 			return err
 		}
 	}
-	return subscribeUpdates(requestor, target)
+	return subscribeUpdates(ctx, q, requestor, target)
 }
 
-func (u userRequest) blockUpdates() error {
-	if u.Requestor == "" {
-		return errors.New("no requestor was provided")
-	}
-	if u.Target == "" {
-		return errors.New("no target was provided")
+func (u userRequest) blockUpdates(ctx context.Context, q querier) error {
+	ctx, span := tracer.Start(ctx, "userRequest.blockUpdates")
+	defer span.End()
+
+	if err := u.validate(); err != nil {
+		return err
 	}
 
 	requestor := strings.ToLower(u.Requestor)
 	target := strings.ToLower(u.Target)
 	users := []string{requestor, target}
-	exists, relationships, err := ifExistsRelationship(users)
+	exists, relationships, err := ifExistsRelationship(ctx, q, users)
 	if err != nil {
 		return err
 	}
@@ -62,12 +69,12 @@ func (u userRequest) blockUpdates() error {
 			return err
 		}
 		if isFriend, _ := relationships.isFriend(); isFriend {
-			return blockExistingRelationship(u.Requestor, u.Target)
+			return blockExistingRelationship(ctx, q, requestor, target)
 		}
 		if isSubscribed, _ := relationships.isSubscribed(); isSubscribed {
-			return blockExistingRelationship(u.Requestor, u.Target)
+			return blockExistingRelationship(ctx, q, requestor, target)
 		}
 	}
 
-	return blockUpdates(u.Requestor, u.Target)
+	return blockUpdates(ctx, q, requestor, target)
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// rule checks a single value and returns why it is invalid, or an empty string when it is valid
+type rule func(value interface{}) string
+
+// fieldCheck holds the rules of a single field, they run in order and stop at the first failure
+type fieldCheck struct {
+	field string
+	value interface{}
+	rules []rule
+}
+
+func check(field string, value interface{}, rules ...rule) fieldCheck {
+	return fieldCheck{field, value, rules}
+}
+
+// validate runs every check and reports all the invalid fields in a single error
+func validate(checks ...fieldCheck) error {
+	var details []fieldError
+	for _, c := range checks {
+		for _, r := range c.rules {
+			if message := r(c.value); message != "" {
+				details = append(details, fieldError{c.field, message})
+				break
+			}
+		}
+	}
+	if len(details) == 0 {
+		return nil
+	}
+	return newValidationErrors(details)
+}
+
+// required rejects zero values and blank strings
+func required(message string) rule {
+	return func(value interface{}) string {
+		if s, ok := value.(string); ok && strings.TrimSpace(s) == "" {
+			return message
+		}
+		v := reflect.ValueOf(value)
+		if !v.IsValid() || v.IsZero() || (v.Kind() == reflect.Slice && v.Len() == 0) {
+			return message
+		}
+		return ""
+	}
+}
+
+func validEmail(message string) rule {
+	return func(value interface{}) string {
+		if s, _ := value.(string); !isEmailValid(s) {
+			return message
+		}
+		return ""
+	}
+}
+
+// exactly checks the length of a list
+func exactly(n int, message string) rule {
+	return func(value interface{}) string {
+		if reflect.ValueOf(value).Len() != n {
+			return message
+		}
+		return ""
+	}
+}
+
+// atMost checks the length of a list or of a string in characters
+func atMost(n int, message string) rule {
+	return func(value interface{}) string {
+		length := reflect.ValueOf(value).Len()
+		if s, ok := value.(string); ok {
+			length = len([]rune(s))
+		}
+		if length > n {
+			return message
+		}
+		return ""
+	}
+}
+
+func withoutSpaces(message string) rule {
+	return func(value interface{}) string {
+		if s, _ := value.(string); strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+			return message
+		}
+		return ""
+	}
+}
+
+func positive(message string) rule {
+	return func(value interface{}) string {
+		if reflect.ValueOf(value).Int() <= 0 {
+			return message
+		}
+		return ""
+	}
+}
+
+func oneOf(message string, allowed ...string) rule {
+	return func(value interface{}) string {
+		s, _ := value.(string)
+		for _, a := range allowed {
+			if s == a {
+				return ""
+			}
+		}
+		return message
+	}
+}
+
+// distinct rejects lists holding the same value twice
+func distinct(message string) rule {
+	return func(value interface{}) string {
+		v := reflect.ValueOf(value)
+		seen := map[interface{}]bool{}
+		for i := 0; i < v.Len(); i++ {
+			if seen[v.Index(i).Interface()] {
+				return message
+			}
+			seen[v.Index(i).Interface()] = true
+		}
+		return ""
+	}
+}
+
+func absoluteURL(message string) rule {
+	return func(value interface{}) string {
+		s, _ := value.(string)
+		u, err := url.Parse(s)
+		if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+			return message
+		}
+		return ""
+	}
+}
+
+// each applies the rules to every item of a list, the first invalid item is reported
+func each(rules ...rule) rule {
+	return func(value interface{}) string {
+		v := reflect.ValueOf(value)
+		for i := 0; i < v.Len(); i++ {
+			for _, r := range rules {
+				if message := r(v.Index(i).Interface()); message != "" {
+					return message
+				}
+			}
+		}
+		return ""
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	eventFriendCreated       = "friend.created"
+	eventFriendRemoved       = "friend.removed"
+	eventSubscriptionCreated = "subscription.created"
+	eventBlockCreated        = "block.created"
+	eventMessageSent         = "message.sent"
+	eventMessageReplied      = "message.replied"
+
+	deliveryIsPending   = "pending"
+	deliveryIsDelivered = "delivered"
+	deliveryIsDead      = "dead"
+
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+var (
+	webhookEvents = []string{eventFriendCreated, eventFriendRemoved, eventSubscriptionCreated, eventBlockCreated, eventMessageSent, eventMessageReplied}
+
+	// webhookPollInterval is how often the worker looks for due deliveries
+	webhookPollInterval = time.Second
+	// webhookBackoff is the delay before the first retry, doubled on every failed attempt
+	webhookBackoff     = 2 * time.Second
+	webhookMaxBackoff  = time.Hour
+	webhookMaxAttempts = 8
+	// webhookLease keeps other workers off a delivery in flight
+	webhookLease     = time.Minute
+	webhookBatchSize = 50
+
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+type webhook struct {
+	ID     int      `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+type webhookDelivery struct {
+	ID          int        `json:"id"`
+	WebhookID   int        `json:"webhook_id"`
+	Event       string     `json:"event"`
+	Payload     string     `json:"payload"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextAttempt time.Time  `json:"next_attempt_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+
+	url    string
+	secret string
+}
+
+type webhookEvent struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+func webhookEventRule(value interface{}) string {
+	if event, _ := value.(string); !isWebhookEvent(event) {
+		return fmt.Sprintf("unknown event %v", event)
+	}
+	return ""
+}
+
+func (w *webhook) register(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "webhook.register")
+	defer span.End()
+
+	err := validate(
+		check("url", w.URL, required("no url was provided"), absoluteURL("invalid url being submitted")),
+		check("events", w.Events, required("no events were provided"), each(webhookEventRule)),
+		check("secret", w.Secret, required("no secret was provided")),
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := createWebhook(ctx, w.URL, w.Events, w.Secret)
+	if err != nil {
+		return err
+	}
+	w.ID = id
+	w.Secret = ""
+	return nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 of timestamp + "." + payload
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// fireWebhookEvent queues a delivery of the event for every webhook subscribed to it
+func fireWebhookEvent(ctx context.Context, q execer, event string, data interface{}) error {
+	payload, err := json.Marshal(webhookEvent{Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		return err
+	}
+	return enqueueWebhookDeliveries(ctx, q, event, string(payload))
+}
+
+func startWebhookWorker() {
+	workers.every("webhooks", webhookPollInterval, deliverPendingWebhooks)
+}
+
+func deliverPendingWebhooks(ctx context.Context) error {
+	deliveries, err := claimWebhookDeliveries(ctx, webhookBatchSize, webhookLease)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		sendErr := delivery.send()
+		if err := recordWebhookAttempt(ctx, delivery, sendErr); err != nil {
+			slog.Error("failed to record webhook attempt", "delivery", delivery.ID, "err", err)
+		}
+	}
+	return nil
+}
+
+func (d webhookDelivery) send() error {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.Itoa(d.ID))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(d.secret, timestamp, []byte(d.Payload)))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with status code %v", res.StatusCode)
+	}
+	return nil
+}
+
+// webhookRetryDelay is the backoff before the given attempt is retried
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return delay
+}
+
+func recordWebhookAttempt(ctx context.Context, d webhookDelivery, sendErr error) error {
+	attempts := d.Attempts + 1
+	if sendErr == nil {
+		return markWebhookDelivered(ctx, d.ID, attempts)
+	}
+
+	status := deliveryIsPending
+	if attempts >= webhookMaxAttempts {
+		status = deliveryIsDead
+	}
+	return markWebhookFailed(ctx, d.ID, attempts, status, sendErr.Error(), time.Now().Add(webhookRetryDelay(attempts)))
+}
+
+func (w *webhook) listDeliveries(ctx context.Context) (deliveries []webhookDelivery, err error) {
+	ctx, span := tracer.Start(ctx, "webhook.listDeliveries")
+	defer span.End()
+
+	if w.ID <= 0 {
+		err = newValidationError("id", "invalid webhook")
+		return
+	}
+	return getWebhookDeliveries(ctx, w.ID)
+}
+
+func (w *webhook) retryDelivery(ctx context.Context, deliveryID int) error {
+	ctx, span := tracer.Start(ctx, "webhook.retryDelivery")
+	defer span.End()
+
+	if w.ID <= 0 || deliveryID <= 0 {
+		return newValidationError("delivery", "invalid webhook delivery")
+	}
+	return requeueDeadWebhookDelivery(ctx, w.ID, deliveryID)
+}
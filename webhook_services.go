@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func createWebhook(ctx context.Context, url string, events []string, secret string) (id int, err error) {
+	ctx, done := measureQuery(ctx, "create_webhook")
+	defer done()
+	insertQuery := `
+		INSERT INTO webhooks (url, events, secret, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+	now := time.Now()
+	err = db.QueryRowContext(ctx, insertQuery, url, pq.Array(events), secret, now, now).Scan(&id)
+	return
+}
+
+func getWebhooks(ctx context.Context) (webhooks []webhook, err error) {
+	ctx, done := measureQuery(ctx, "get_webhooks")
+	defer done()
+	query := `SELECT id, url, events FROM webhooks ORDER BY id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		err = fmt.Errorf("failed to list webhooks err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := webhook{}
+		if err = rows.Scan(&row.ID, &row.URL, pq.Array(&row.Events)); err != nil {
+			return
+		}
+		webhooks = append(webhooks, row)
+	}
+	return webhooks, rows.Err()
+}
+
+func deleteWebhook(ctx context.Context, id int) error {
+	ctx, done := measureQuery(ctx, "delete_webhook")
+	defer done()
+	result, err := db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return newNotFoundError("webhook_not_found", "webhook does not exist")
+	}
+	return nil
+}
+
+func enqueueWebhookDeliveries(ctx context.Context, q execer, event, payload string) error {
+	ctx, done := measureQuery(ctx, "enqueue_webhook_deliveries")
+	defer done()
+	insertQuery := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at, updated_at)
+		SELECT id, $1, $2, $3, $4, $4, $4 FROM webhooks WHERE $1 = ANY(events)
+	`
+	if _, err := q.ExecContext(ctx, insertQuery, event, payload, deliveryIsPending, time.Now()); err != nil {
+		return fmt.Errorf("failed to queue webhook deliveries for %v err %w", event, err)
+	}
+	return nil
+}
+
+// claimWebhookDeliveries leases due deliveries, SKIP LOCKED keeps workers from sending one twice
+func claimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) (deliveries []webhookDelivery, err error) {
+	ctx, done := measureQuery(ctx, "claim_webhook_deliveries")
+	defer done()
+	claimQuery := `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = $2, updated_at = $1
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $3 AND next_attempt_at <= $1
+			ORDER BY id
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts, w.url, w.secret
+	`
+	now := time.Now()
+	rows, err := db.QueryContext(ctx, claimQuery, now, now.Add(lease), deliveryIsPending, limit)
+	if err != nil {
+		err = fmt.Errorf("failed to claim webhook deliveries err %w", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := webhookDelivery{Status: deliveryIsPending}
+		if err = rows.Scan(&row.ID, &row.WebhookID, &row.Event, &row.Payload, &row.Attempts, &row.url, &row.secret); err != nil {
+			return
+		}
+		deliveries = append(deliveries, row)
+	}
+	return deliveries, rows.Err()
+}
+
+func markWebhookDelivered(ctx context.Context, id, attempts int) error {
+	ctx, done := measureQuery(ctx, "mark_webhook_delivered")
+	defer done()
+	updateQuery := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, last_error = NULL, delivered_at = $3, updated_at = $3
+		WHERE id = $4
+	`
+	_, err := db.ExecContext(ctx, updateQuery, deliveryIsDelivered, attempts, time.Now(), id)
+	return err
+}
+
+func markWebhookFailed(ctx context.Context, id, attempts int, status, lastError string, nextAttempt time.Time) error {
+	ctx, done := measureQuery(ctx, "mark_webhook_failed")
+	defer done()
+	updateQuery := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, last_error = $3, next_attempt_at = $4, updated_at = $5
+		WHERE id = $6
+	`
+	_, err := db.ExecContext(ctx, updateQuery, status, attempts, lastError, nextAttempt, time.Now(), id)
+	return err
+}
+
+func getWebhookDeliveries(ctx context.Context, webhookID int) (deliveries []webhookDelivery, err error) {
+	ctx, done := measureQuery(ctx, "get_webhook_deliveries")
+	defer done()
+	query := `
+		SELECT id, webhook_id, event, payload, status, attempts, last_error, next_attempt_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id
+	`
+
+	rows, err := db.QueryContext(ctx, query, webhookID)
+	if err != nil {
+		err = fmt.Errorf("failed to list deliveries of webhook %v err %w", webhookID, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := webhookDelivery{}
+		var lastError sql.NullString
+		var deliveredAt pq.NullTime
+		if err = rows.Scan(&row.ID, &row.WebhookID, &row.Event, &row.Payload, &row.Status, &row.Attempts, &lastError, &row.NextAttempt, &deliveredAt); err != nil {
+			return
+		}
+		row.LastError = lastError.String
+		if deliveredAt.Valid {
+			row.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, row)
+	}
+	return deliveries, rows.Err()
+}
+
+func requeueDeadWebhookDelivery(ctx context.Context, webhookID, deliveryID int) error {
+	ctx, done := measureQuery(ctx, "requeue_dead_webhook_delivery")
+	defer done()
+	updateQuery := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = 0, next_attempt_at = $2, updated_at = $2
+		WHERE id = $3 AND webhook_id = $4 AND status = $5
+	`
+	result, err := db.ExecContext(ctx, updateQuery, deliveryIsPending, time.Now(), deliveryID, webhookID, deliveryIsDead)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return newNotFoundError("dead_delivery_not_found", "no dead delivery to retry")
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+type receivedWebhook struct {
+	event     string
+	timestamp string
+	signature string
+	body      []byte
+}
+
+type webhookEvent struct {
+	Event string                 `json:"event"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	resetDB()
+	secret := "webhook-test-secret"
+
+	// the receiver rejects the first delivery to make sure failed deliveries are retried
+	var mu sync.Mutex
+	attempts := 0
+	received := make(chan receivedWebhook, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		attempt := attempts
+		mu.Unlock()
+		if attempt == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- receivedWebhook{r.Header.Get("X-Webhook-Event"), r.Header.Get("X-Webhook-Timestamp"), r.Header.Get("X-Webhook-Signature"), body}
+	}))
+	defer receiver.Close()
+
+	testSamples := []map[string]interface{}{
+		{ // valid webhook
+			"json":    webhookRequest{URL: receiver.URL, Events: []string{"friend.created"}, Secret: secret},
+			"success": true,
+		},
+		{ // unknown event
+			"json":    webhookRequest{URL: receiver.URL, Events: []string{"friend.deleted"}, Secret: secret},
+			"success": false,
+		},
+		{ // without secret
+			"json":    webhookRequest{URL: receiver.URL, Events: []string{"friend.created"}},
+			"success": false,
+		},
+		{ // relative url
+			"json":    webhookRequest{URL: "/hooks", Events: []string{"friend.created"}, Secret: secret},
+			"success": false,
+		},
+	}
+
+	for _, testSample := range testSamples {
+		jsonWebhook, _ := json.Marshal(testSample["json"])
+		req, err := http.NewRequest("POST", baseAPI+"/webhooks", strings.NewReader(string(jsonWebhook)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		actualResult := expectedResult{}
+		if err := json.Unmarshal(bodyBytes, &actualResult); err != nil {
+			t.Errorf("failed to unmarshal test result %v", err)
+		}
+		if actualResult.Success != testSample["success"].(bool) {
+			t.Errorf("expecting %v but have %v %v", testSample["success"], actualResult.Success, string(bodyBytes))
+		}
+	}
+
+	// events without a registered webhook must not be delivered
+	jsonSubscriber, _ := json.Marshal(userActions{Requestor: "sean@example.com", Target: "john@example.com"})
+	req, _ := http.NewRequest("POST", baseAPI+"/friends/subscribe", strings.NewReader(string(jsonSubscriber)))
+	req.Header.Set("Content-Type", "application/json")
+	http.DefaultClient.Do(req)
+
+	jsonFriends, _ := json.Marshal(expectedResult{Friends: []string{"andy@example.com", "john@example.com"}})
+	req, _ = http.NewRequest("POST", baseAPI+"/friends", strings.NewReader(string(jsonFriends)))
+	req.Header.Set("Content-Type", "application/json")
+	http.DefaultClient.Do(req)
+
+	select {
+	case webhook := <-received:
+		if webhook.event != "friend.created" {
+			t.Errorf("expecting %v but have %v", "friend.created", webhook.event)
+		}
+
+		sentAt, err := strconv.ParseInt(webhook.timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(sentAt, 0)) > time.Minute {
+			t.Errorf("expecting a recent timestamp but have %q", webhook.timestamp)
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(webhook.timestamp + "."))
+		mac.Write(webhook.body)
+		expectedSignature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if webhook.signature != expectedSignature {
+			t.Errorf("expecting %v but have %v", expectedSignature, webhook.signature)
+		}
+
+		event := webhookEvent{}
+		if err := json.Unmarshal(webhook.body, &event); err != nil {
+			t.Errorf("failed to unmarshal webhook payload %v", err)
+		}
+		friends, _ := json.Marshal(event.Data["friends"])
+		if string(friends) != `["andy@example.com","john@example.com"]` {
+			t.Errorf("expecting %v but have %v", `["andy@example.com","john@example.com"]`, string(friends))
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	mu.Lock()
+	if attempts != 2 {
+		t.Errorf("expecting %v but have %v", 2, attempts)
+	}
+	mu.Unlock()
+}
+
+func TestListingRecipientsSendsNothing(t *testing.T) {
+	resetDB()
+	received := make(chan webhookEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := webhookEvent{}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer receiver.Close()
+
+	post := func(path, body string) {
+		req, _ := http.NewRequest("POST", baseAPI+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if _, err := http.DefaultClient.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jsonWebhook, _ := json.Marshal(webhookRequest{URL: receiver.URL, Events: []string{"message.sent"}, Secret: "secret"})
+	post("/webhooks", string(jsonWebhook))
+	post("/friends/subscribe", `{"requestor": "lisa@example.com", "target": "john@example.com"}`)
+
+	// only the posted message is sent, the listings of its recipients are not
+	req, _ := http.NewRequest("GET", baseAPI+"/friends/subscribe", strings.NewReader(`{"sender": "john@example.com", "text": "listed"}`))
+	req.Header.Set("Content-Type", "application/json")
+	http.DefaultClient.Do(req)
+	http.Get(baseAPI + "/v2/users/john@example.com/recipients?text=listed")
+	post("/messages", `{"sender": "john@example.com", "text": "posted"}`)
+
+	select {
+	case event := <-received:
+		if event.Data["text"] != "posted" {
+			t.Errorf("expecting the posted message but have %v", event.Data["text"])
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	select {
+	case event := <-received:
+		t.Errorf("expecting a single message.sent but have another for %v", event.Data["text"])
+	case <-time.After(3 * time.Second):
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// workers are the background loops of the server, a loop finishes its current run
+// before it stops
+var workers = newWorkerGroup()
+
+type workerGroup struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	running  sync.WaitGroup
+
+	mu       sync.Mutex
+	statuses map[string]*workerStatus
+}
+
+// workerStatus is what readiness reports of a loop, LastRun is when its last run finished
+type workerStatus struct {
+	Name      string        `json:"name"`
+	Interval  time.Duration `json:"-"`
+	LastRun   time.Time     `json:"last_run"`
+	LastError string        `json:"last_error,omitempty"`
+	Stopped   bool          `json:"stopped"`
+}
+
+// stale tells a loop that missed a few runs, most likely stuck in a run
+func (s workerStatus) stale(now time.Time) bool {
+	return now.Sub(s.LastRun) > 3*s.Interval+time.Minute
+}
+
+func newWorkerGroup() *workerGroup {
+	return &workerGroup{stop: make(chan struct{}), statuses: map[string]*workerStatus{}}
+}
+
+// every runs fn right away and then every interval until the group is stopped,
+// errors are logged and the loop carries on. Each run is the root span of its own trace
+func (g *workerGroup) every(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	g.mu.Lock()
+	status := &workerStatus{Name: name, Interval: interval, LastRun: time.Now()}
+	g.statuses[name] = status
+	g.mu.Unlock()
+
+	g.running.Add(1)
+	go func() {
+		defer g.running.Done()
+		for {
+			ctx, span := tracer.Start(context.Background(), "worker "+name)
+			err := fn(ctx)
+			endSpan(span, err)
+			if err != nil {
+				slog.Error("worker run failed", "worker", name, "err", err)
+			}
+			g.mu.Lock()
+			status.LastRun, status.LastError = time.Now(), ""
+			if err != nil {
+				status.LastError = err.Error()
+			}
+			g.mu.Unlock()
+
+			select {
+			case <-g.stop:
+				g.mu.Lock()
+				status.Stopped = true
+				g.mu.Unlock()
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// status lists the loops by name
+func (g *workerGroup) status() []workerStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	statuses := []workerStatus{}
+	for _, status := range g.statuses {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// shutdown stops the loops and waits for their current runs until ctx is done
+func (g *workerGroup) shutdown(ctx context.Context) error {
+	g.stopOnce.Do(func() { close(g.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		g.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerGroupShutdown(t *testing.T) {
+	group := newWorkerGroup()
+	var runs int32
+	group.every("test", time.Hour, func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := group.shutdown(ctx); err != nil {
+		t.Fatalf("expected the worker to stop while it waits, got %v", err)
+	}
+	if atomic.LoadInt32(&runs) != 1 {
+		t.Errorf("expected a single run, got %v", runs)
+	}
+}
+
+func TestWorkerGroupShutdownDeadline(t *testing.T) {
+	group := newWorkerGroup()
+	release := make(chan struct{})
+	defer close(release)
+	group.every("test", time.Hour, func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := group.shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the shutdown to give up on a stuck run, got %v", err)
+	}
+}